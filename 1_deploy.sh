@@ -32,16 +32,8 @@ if [ "$BASTION_IP" = "" ]; then
   exit 1
 fi
 
-# Configure SSH jumphost so we can run nodetool on Cassandra hosts (requires write access to ~/.ssh/config)
-if ! grep -q "$BASTION_IP" ~/.ssh/config; then
-  echo "Adding a new jumphost to ~/.ssh/config..."
-  echo "" | tee -a ~/.ssh/config
-  echo "Host $BASTION_IP" | tee -a ~/.ssh/config
-  echo "  User $CAPIDEPLOY_SSH_USER" | tee -a ~/.ssh/config
-  echo "  StrictHostKeyChecking=no" | tee -a ~/.ssh/config
-  echo "  UserKnownHostsFile=/dev/null" | tee -a ~/.ssh/config
-  echo "  IdentityFile  $CAPIDEPLOY_AWS_SSH_ROOT_KEYPAIR_PRIVATE_KEY_OR_PATH" | tee -a ~/.ssh/config
-fi
+# Deployment-scoped ssh config with jumphost entries for all instances, see deploy.log for the Include line for ~/.ssh/config
+./capideploy export_ssh_config -p sample.jsonnet >> deploy.log
 
 set -x
 
@@ -65,7 +57,7 @@ set -x
 ./capideploy config_services "bastion,rabbitmq,prometheus,daemon*" -p sample.jsonnet -v >> deploy.log
 #./capideploy config_services "bastion" -p sample.jsonnet -v >> deploy.log
 
-ssh -o StrictHostKeyChecking=no -i $CAPIDEPLOY_AWS_SSH_ROOT_KEYPAIR_PRIVATE_KEY_OR_PATH -J $BASTION_IP $CAPIDEPLOY_SSH_USER@10.5.0.11 'nodetool describecluster;nodetool status'
+./capideploy exec "cass001" -p sample.jsonnet -- 'nodetool describecluster;nodetool status'
 
 duration=$SECONDS
 echo "$(($duration / 60))m $(($duration % 60))s elapsed."
@@ -0,0 +1,71 @@
+package cldaws
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+)
+
+// cloud-init prints instance host keys to the console between these lines
+const (
+	consoleHostKeysBegin string = "-----BEGIN SSH HOST KEY KEYS-----"
+	consoleHostKeysEnd   string = "-----END SSH HOST KEY KEYS-----"
+)
+
+func parseSshHostKeysFromConsoleOutput(consoleOutput string) []string {
+	beginIdx := strings.LastIndex(consoleOutput, consoleHostKeysBegin)
+	if beginIdx < 0 {
+		return nil
+	}
+	endIdx := strings.Index(consoleOutput[beginIdx:], consoleHostKeysEnd)
+	if endIdx < 0 {
+		return nil
+	}
+	keys := make([]string, 0)
+	for _, line := range strings.Split(consoleOutput[beginIdx+len(consoleHostKeysBegin):beginIdx+endIdx], "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
+
+// Console output shows up a few minutes after the instance is running, so wait for it.
+// Returns host keys in authorized_keys format, like "ssh-ed25519 AAAA... root@ip-10-5-0-11"
+func GetInstanceSshHostKeysFromConsoleOutput(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, instanceId string, timeoutSeconds int) ([]string, error) {
+	startWaitTs := time.Now()
+	for {
+		out, err := ec2Client.GetConsoleOutput(goCtx, &ec2.GetConsoleOutputInput{InstanceId: aws.String(instanceId)})
+		if err != nil {
+			return nil, fmt.Errorf("cannot get console output for instance %s: %s", instanceId, err.Error())
+		}
+		consoleOutput := ""
+		if out.Output != nil {
+			consoleOutputBytes, err := base64.StdEncoding.DecodeString(*out.Output)
+			if err != nil {
+				return nil, fmt.Errorf("cannot decode console output for instance %s: %s", instanceId, err.Error())
+			}
+			consoleOutput = string(consoleOutputBytes)
+		}
+		// Do not log the whole console output, it's huge
+		lb.Add(fmt.Sprintf("GetConsoleOutput(instanceId=%s): %d bytes", instanceId, len(consoleOutput)))
+
+		keys := parseSshHostKeysFromConsoleOutput(consoleOutput)
+		if len(keys) > 0 {
+			return keys, nil
+		}
+		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
+			return nil, fmt.Errorf("giving up after waiting for ssh host keys in console output of instance %s for %ds", instanceId, timeoutSeconds)
+		}
+		if err := waitBeforeRetry(goCtx, 5*time.Second); err != nil {
+			return nil, err
+		}
+	}
+}
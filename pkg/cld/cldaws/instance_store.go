@@ -0,0 +1,122 @@
+package cldaws
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+)
+
+type InstanceStoreInfo struct {
+	DiskCount  int
+	DiskSizeGb int64
+	IsNvme     bool
+}
+
+// Zero DiskCount means the instance type has no instance store (EBS only)
+func GetInstanceTypeInstanceStoreInfo(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, flavorName string) (*InstanceStoreInfo, error) {
+	out, err := ec2Client.DescribeInstanceTypes(goCtx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []types.InstanceType{types.InstanceType(flavorName)}})
+	lb.AddObject(fmt.Sprintf("DescribeInstanceTypes(InstanceType=%s)", flavorName), out)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find flavor %s:%s", flavorName, err.Error())
+	}
+	if len(out.InstanceTypes) == 0 {
+		return nil, fmt.Errorf("found zero results for flavor %s", flavorName)
+	}
+	info := InstanceStoreInfo{}
+	storageInfo := out.InstanceTypes[0].InstanceStorageInfo
+	if out.InstanceTypes[0].InstanceStorageSupported == nil || !*out.InstanceTypes[0].InstanceStorageSupported || storageInfo == nil {
+		return &info, nil
+	}
+	for _, disk := range storageInfo.Disks {
+		if disk.Count != nil {
+			info.DiskCount += int(*disk.Count)
+		}
+		if disk.SizeInGB != nil {
+			info.DiskSizeGb = *disk.SizeInGB
+		}
+	}
+	info.IsNvme = storageInfo.NvmeSupport == types.EphemeralNvmeSupportRequired || storageInfo.NvmeSupport == types.EphemeralNvmeSupportSupported
+	return &info, nil
+}
+
+// Finds NVMe instance store devices by model name (EBS volumes are "Amazon Elastic Block Store"), optionally assembles them
+// into a RAID0 array, formats and mounts them at mountPointPrefix0, mountPointPrefix1 etc. Idempotent: existing array,
+// file systems and mounts are reused. No fstab entries: instance store is gone after stop/start anyways.
+// Last line of the output is the comma-separated list of mount points.
+const InitInstanceStoreFunc string = `
+init_instance_store()
+{
+  local expectedCount=$1
+  local mountPointPrefix=$2
+  local raid0=$3
+  local fsType=$4
+  local mountOptions=$5
+  local permissions=$6
+  local owner=$7
+
+  # Devices may show up a few seconds after the instance is reachable
+  local devices=""
+  for i in $(seq 1 30); do
+    devices=$(lsblk -d -n -p -o NAME,MODEL | grep "Amazon EC2 NVMe Instance Storage" | awk '{print $1}' | sort | tr '\n' ' ')
+    if [ "$(echo $devices | wc -w)" -ge "$expectedCount" ]; then
+      break
+    fi
+    sleep 1
+  done
+  local deviceCount=$(echo $devices | wc -w)
+  if [ "$deviceCount" -ne "$expectedCount" ]; then
+    echo Error, expected $expectedCount instance store devices, found $deviceCount: $devices
+    lsblk -d -o NAME,MODEL,SIZE
+    return 1
+  fi
+
+  if [ "$raid0" = "true" ] && [ "$deviceCount" -gt "1" ]; then
+    if [ ! -b /dev/md0 ]; then
+      sudo mdadm --create /dev/md0 --level=0 --raid-devices=$deviceCount $devices --run 2>&1
+      if [ "$?" -ne "0" ]; then
+        echo Error $?, cannot create RAID0 array from $devices
+        return 1
+      fi
+    fi
+    devices=/dev/md0
+  fi
+
+  local mountPoints=""
+  local deviceNumber=0
+  for deviceName in $devices; do
+    local mountPoint=$mountPointPrefix$deviceNumber
+    if [ "$(sudo blkid -s TYPE -o value $deviceName)" = "" ]; then
+      sudo mkfs.$fsType $deviceName > /dev/null 2>&1
+      if [ "$?" -ne "0" ]; then
+        echo Error $?, cannot make $fsType file system on device $deviceName for $mountPoint
+        return 1
+      fi
+    fi
+    sudo mkdir -p $mountPoint
+    if ! mountpoint -q $mountPoint; then
+      sudo mount -o $mountOptions $deviceName $mountPoint
+      if [ "$?" -ne "0" ]; then
+        echo Error $?, cannot mount $deviceName at $mountPoint
+        return 1
+      fi
+    fi
+    sudo chmod $permissions $mountPoint
+    if [ -n "$owner" ]; then
+      sudo chown $owner $mountPoint
+      if [ "$?" -ne "0" ]; then
+        echo Error $?, cannot change $mountPoint owner to $owner
+        return 1
+      fi
+    fi
+    mountPoints=$mountPoints,$mountPoint
+    deviceNumber=$((deviceNumber+1))
+  done
+
+  echo ${mountPoints#,}
+  return 0
+}
+`
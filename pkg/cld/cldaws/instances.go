@@ -3,6 +3,8 @@ package cldaws
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -47,17 +49,76 @@ func GetImageInfoById(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBui
 	return out.Images[0].State, out.Images[0].BlockDeviceMappings, nil
 }
 
-func GetImageInfoByName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, imageName string) (string, types.ImageState, []types.BlockDeviceMapping, error) {
+// Returns "x86_64", "arm64" etc
+func GetImageArchitecture(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, imageId string) (string, error) {
 	out, err := ec2Client.DescribeImages(goCtx, &ec2.DescribeImagesInput{Filters: []types.Filter{{
-		Name: aws.String("tag:Name"), Values: []string{imageName}}}})
-	lb.AddObject(fmt.Sprintf("DescribeImages(tag:Name=%s)", imageName), out)
+		Name: aws.String("image-id"), Values: []string{imageId}}}})
+	lb.AddObject(fmt.Sprintf("DescribeImages(image-id=%s)", imageId), out)
 	if err != nil {
-		return "", "", nil, fmt.Errorf("cannot find image %s:%s", imageName, err.Error())
+		return "", fmt.Errorf("cannot find image %s:%s", imageId, err.Error())
 	}
 	if len(out.Images) == 0 {
-		return "", "", nil, nil
+		return "", fmt.Errorf("found zero results for image %s", imageId)
+	}
+	return string(out.Images[0].Architecture), nil
+}
+
+func GetImageRootDeviceName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, imageId string) (string, error) {
+	out, err := ec2Client.DescribeImages(goCtx, &ec2.DescribeImagesInput{Filters: []types.Filter{{
+		Name: aws.String("image-id"), Values: []string{imageId}}}})
+	lb.AddObject(fmt.Sprintf("DescribeImages(image-id=%s)", imageId), out)
+	if err != nil {
+		return "", fmt.Errorf("cannot find image %s:%s", imageId, err.Error())
+	}
+	if len(out.Images) == 0 || out.Images[0].RootDeviceName == nil {
+		return "", fmt.Errorf("cannot find root device name for image %s", imageId)
+	}
+	return *out.Images[0].RootDeviceName, nil
+}
+
+// Overrides root ebs volume settings (or adds a root mapping) in image block device mappings, so RunInstances
+// creates root disk of required size/type/performance/encryption. Zero size and empty type mean image defaults.
+func SetRootBlockDeviceMapping(blockDeviceMappings []types.BlockDeviceMapping, rootDeviceName string, size int32, volTypeString string, iops int32, throughput int32, encrypted bool, kmsKeyId string) ([]types.BlockDeviceMapping, error) {
+	var rootMapping *types.BlockDeviceMapping
+	for i := range blockDeviceMappings {
+		if blockDeviceMappings[i].DeviceName != nil && *blockDeviceMappings[i].DeviceName == rootDeviceName {
+			rootMapping = &blockDeviceMappings[i]
+			break
+		}
+	}
+	if rootMapping == nil {
+		blockDeviceMappings = append(blockDeviceMappings, types.BlockDeviceMapping{DeviceName: aws.String(rootDeviceName)})
+		rootMapping = &blockDeviceMappings[len(blockDeviceMappings)-1]
+	}
+	if rootMapping.Ebs == nil {
+		rootMapping.Ebs = &types.EbsBlockDevice{}
+	}
+	if size > 0 {
+		rootMapping.Ebs.VolumeSize = aws.Int32(size)
+	}
+	if volTypeString != "" {
+		volType, err := stringToVolType(volTypeString)
+		if err != nil {
+			return nil, err
+		}
+		rootMapping.Ebs.VolumeType = volType
+		// Image iops/throughput may not be valid for the new type
+		rootMapping.Ebs.Iops = nil
+		rootMapping.Ebs.Throughput = nil
+	}
+	if iops > 0 {
+		rootMapping.Ebs.Iops = aws.Int32(iops)
+	}
+	if throughput > 0 {
+		rootMapping.Ebs.Throughput = aws.Int32(throughput)
+	}
+	if encrypted {
+		rootMapping.Ebs.Encrypted = aws.Bool(true)
+		if kmsKeyId != "" {
+			rootMapping.Ebs.KmsKeyId = aws.String(kmsKeyId)
+		}
 	}
-	return *out.Images[0].ImageId, out.Images[0].State, out.Images[0].BlockDeviceMappings, nil
+	return blockDeviceMappings, nil
 }
 
 func VerifyKeypair(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, keypairName string) error {
@@ -134,6 +195,7 @@ func getInstanceStateName(ec2Client *ec2.Client, goCtx context.Context, lb *l.Lo
 	return "", nil
 }
 
+// Once AWS has assigned an instance id, it is returned even with an error (like a wait timeout), so the caller can clean up
 func CreateInstance(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder,
 	instanceTypeString string,
 	imageId string,
@@ -150,13 +212,14 @@ func CreateInstance(ec2Client *ec2.Client, goCtx context.Context, tags map[strin
 		return "", err
 	}
 
-	if imageId == "" || instName == "" || privateIpAddress == "" || securityGroupId == "" || rootKeyName == "" || subnetId == "" {
-		return "", fmt.Errorf("empty parameter not allowed: imageId (%s), instName (%s), privateIpAddress (%s), securityGroupId (%s), rootKeyName (%s), subnetId (%s)",
-			imageId, instName, privateIpAddress, securityGroupId, rootKeyName, subnetId)
+	// Empty privateIpAddress means AWS picks one from the subnet (temporary instances like bake_image builders)
+	if imageId == "" || instName == "" || securityGroupId == "" || rootKeyName == "" || subnetId == "" {
+		return "", fmt.Errorf("empty parameter not allowed: imageId (%s), instName (%s), securityGroupId (%s), rootKeyName (%s), subnetId (%s)",
+			imageId, instName, securityGroupId, rootKeyName, subnetId)
 	}
 
 	// NOTE: AWS doesn't allow to specify hostname on creation, it assigns names like "ip-10-5-0-11"
-	runOut, err := ec2Client.RunInstances(goCtx, &ec2.RunInstancesInput{
+	runInstancesInput := ec2.RunInstancesInput{
 		InstanceType:        instanceType,
 		ImageId:             aws.String(imageId),
 		MinCount:            aws.Int32(1),
@@ -164,11 +227,14 @@ func CreateInstance(ec2Client *ec2.Client, goCtx context.Context, tags map[strin
 		KeyName:             aws.String(rootKeyName),
 		SecurityGroupIds:    []string{securityGroupId},
 		SubnetId:            aws.String(subnetId),
-		PrivateIpAddress:    aws.String(privateIpAddress),
 		BlockDeviceMappings: blockDeviceMappings,
 		TagSpecifications: []types.TagSpecification{{
 			ResourceType: types.ResourceTypeInstance,
-			Tags:         mapToTags(instName, tags)}}})
+			Tags:         mapToTags(instName, tags)}}}
+	if privateIpAddress != "" {
+		runInstancesInput.PrivateIpAddress = aws.String(privateIpAddress)
+	}
+	runOut, err := ec2Client.RunInstances(goCtx, &runInstancesInput)
 	lb.AddObject(fmt.Sprintf("RunInstances(InstanceType=%s,ImageId=%s,tag:Name=%s)", instanceType, imageId, instName), runOut)
 	if err != nil {
 		return "", fmt.Errorf("cannot create instance %s: %s", instName, err.Error())
@@ -187,7 +253,7 @@ func CreateInstance(ec2Client *ec2.Client, goCtx context.Context, tags map[strin
 	for {
 		stateName, err := getInstanceStateName(ec2Client, goCtx, lb, newId)
 		if err != nil {
-			return "", err
+			return newId, err
 		}
 		// If no state name returned - the instance creation has just began, give it some time
 		if stateName != "" {
@@ -195,17 +261,50 @@ func CreateInstance(ec2Client *ec2.Client, goCtx context.Context, tags map[strin
 				break
 			}
 			if stateName != types.InstanceStateNamePending {
-				return "", fmt.Errorf("%s(%s) was built, but the status is unknown: %s", instName, newId, stateName)
+				return newId, fmt.Errorf("%s(%s) was built, but the status is unknown: %s", instName, newId, stateName)
 			}
 		}
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
-			return "", fmt.Errorf("giving up after waiting for %s(%s) to be created", instName, newId)
+			return newId, fmt.Errorf("giving up after waiting for %s(%s) to be created", instName, newId)
+		}
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return newId, err
 		}
-		time.Sleep(1 * time.Second)
 	}
 	return newId, nil
 }
 
+func GetInstancePrivateIpById(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, instanceId string) (string, error) {
+	out, err := ec2Client.DescribeInstances(goCtx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceId}})
+	lb.AddObject(fmt.Sprintf("DescribeInstances(instanceId=%s)", instanceId), out)
+	if err != nil {
+		return "", fmt.Errorf("cannot find instance by id %s:%s", instanceId, err.Error())
+	}
+	if len(out.Reservations) == 0 || len(out.Reservations[0].Instances) == 0 || out.Reservations[0].Instances[0].PrivateIpAddress == nil {
+		return "", fmt.Errorf("found zero instances with private ip for instanceId %s", instanceId)
+	}
+	return *out.Reservations[0].Instances[0].PrivateIpAddress, nil
+}
+
+// Running or pending instance with this private or public ip address, empty if none
+func GetInstanceIdByIpAddress(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, ipAddress string) (string, error) {
+	for _, filterName := range []string{"private-ip-address", "ip-address"} {
+		out, err := ec2Client.DescribeInstances(goCtx, &ec2.DescribeInstancesInput{Filters: []types.Filter{
+			{Name: aws.String(filterName), Values: []string{ipAddress}},
+			{Name: aws.String("instance-state-name"), Values: []string{string(types.InstanceStateNameRunning), string(types.InstanceStateNamePending)}}}})
+		lb.AddObject(fmt.Sprintf("DescribeInstances(%s=%s)", filterName, ipAddress), out)
+		if err != nil {
+			return "", fmt.Errorf("cannot find instance by ip address %s: %s", ipAddress, err.Error())
+		}
+		for _, res := range out.Reservations {
+			for _, inst := range res.Instances {
+				return *inst.InstanceId, nil
+			}
+		}
+	}
+	return "", nil
+}
+
 func AssignAwsFloatingIp(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, instanceId string, ipAddress string) (string, error) {
 	out, err := ec2Client.AssociateAddress(goCtx, &ec2.AssociateAddressInput{
 		InstanceId: aws.String(instanceId),
@@ -250,7 +349,9 @@ func DeleteInstance(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuild
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return fmt.Errorf("giving up after waiting for %s to be deleted", instanceId)
 		}
-		time.Sleep(1 * time.Second)
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -278,22 +379,220 @@ func StopInstance(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return fmt.Errorf("giving up after waiting for instance %s to be stop", instanceId)
 		}
-		time.Sleep(1 * time.Second)
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+func StartInstance(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, instanceId string, timeoutSeconds int) error {
+	out, err := ec2Client.StartInstances(goCtx, &ec2.StartInstancesInput{InstanceIds: []string{instanceId}})
+	lb.AddObject(fmt.Sprintf("StartInstances(instanceId=%s)", instanceId), out)
+	if err != nil {
+		return fmt.Errorf("cannot start instance %s: %s", instanceId, err.Error())
+	}
+
+	startWaitTs := time.Now()
+	for {
+		stateName, err := getInstanceStateName(ec2Client, goCtx, lb, instanceId)
+		if err != nil {
+			return err
+		}
+
+		if stateName == types.InstanceStateNameRunning {
+			break
+		}
+		if stateName != types.InstanceStateNamePending && stateName != types.InstanceStateNameStopped {
+			return fmt.Errorf("cannot start instance %s, uknown state: %s", instanceId, stateName)
+		}
+		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
+			return fmt.Errorf("giving up after waiting for instance %s to start", instanceId)
+		}
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetInstanceTypeById(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, instanceId string) (string, error) {
+	out, err := ec2Client.DescribeInstances(goCtx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceId}})
+	lb.AddObject(fmt.Sprintf("DescribeInstances(instanceId=%s)", instanceId), out)
+	if err != nil {
+		return "", fmt.Errorf("cannot find instance by id %s:%s", instanceId, err.Error())
+	}
+	if len(out.Reservations) == 0 || len(out.Reservations[0].Instances) == 0 {
+		return "", fmt.Errorf("found zero instances for instanceId %s", instanceId)
+	}
+	return string(out.Reservations[0].Instances[0].InstanceType), nil
+}
+
+// Instance must be stopped
+func ModifyInstanceType(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, instanceId string, instanceTypeString string) error {
+	instanceType, err := stringToInstanceType(instanceTypeString)
+	if err != nil {
+		return err
+	}
+	out, err := ec2Client.ModifyInstanceAttribute(goCtx, &ec2.ModifyInstanceAttributeInput{
+		InstanceId:   aws.String(instanceId),
+		InstanceType: &types.AttributeValue{Value: aws.String(string(instanceType))}})
+	lb.AddObject(fmt.Sprintf("ModifyInstanceAttribute(instanceId=%s,InstanceType=%s)", instanceId, instanceType), out)
+	if err != nil {
+		return fmt.Errorf("cannot change instance %s type to %s: %s", instanceId, instanceType, err.Error())
+	}
+	return nil
+}
+
+const ImageNicknameTagName string = "ImageNickname"
+const ImageSnapshotLabelTagName string = "ImageSnapshotLabel"
+
+const BakedImagePurposeTagName string = "BakedImagePurpose"
+const BakedImageArchTagName string = "BakedImageArch"
+const BakedImageScriptHashTagName string = "BakedImageScriptHash"
+
+type ImageInfo struct {
+	Id                  string
+	Label               string
+	State               types.ImageState
+	CreationDate        time.Time
+	BlockDeviceMappings []types.BlockDeviceMapping
+	Tags                map[string]string
+}
+
+// Returns all generations of the snapshot image (all images tagged with this name), most recent first
+func GetImagesByName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, imageName string) ([]ImageInfo, error) {
+	if imageName == "" {
+		return nil, fmt.Errorf("empty parameter not allowed: imageName (%s)", imageName)
+	}
+	return GetImagesByTags(ec2Client, goCtx, lb, map[string]string{"Name": imageName})
+}
+
+// Returns own images that have all these tags, most recent first
+func GetImagesByTags(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, tagMap map[string]string) ([]ImageInfo, error) {
+	filters := make([]types.Filter, 0, len(tagMap))
+	filterStrings := make([]string, 0, len(tagMap))
+	for k, v := range tagMap {
+		filters = append(filters, types.Filter{Name: aws.String("tag:" + k), Values: []string{v}})
+		filterStrings = append(filterStrings, fmt.Sprintf("tag:%s=%s", k, v))
+	}
+	sort.Strings(filterStrings)
+	out, err := ec2Client.DescribeImages(goCtx, &ec2.DescribeImagesInput{
+		Owners:  []string{"self"},
+		Filters: filters})
+	lb.AddObject(fmt.Sprintf("DescribeImages(%s)", strings.Join(filterStrings, ",")), out)
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe images %s: %s", strings.Join(filterStrings, ","), err.Error())
+	}
+	result := make([]ImageInfo, len(out.Images))
+	for i, image := range out.Images {
+		result[i] = ImageInfo{Id: *image.ImageId, State: image.State, BlockDeviceMappings: image.BlockDeviceMappings, Tags: map[string]string{}}
+		if image.CreationDate != nil {
+			// Like 2024-01-31T23:59:59.000Z
+			creationDate, err := time.Parse(time.RFC3339, *image.CreationDate)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse image %s creation date %s: %s", *image.ImageId, *image.CreationDate, err.Error())
+			}
+			result[i].CreationDate = creationDate
+		}
+		for _, tag := range image.Tags {
+			result[i].Tags[*tag.Key] = *tag.Value
+			if *tag.Key == ImageSnapshotLabelTagName {
+				result[i].Label = *tag.Value
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreationDate.After(result[j].CreationDate) })
+	return result, nil
+}
+
 // aws ec2 create-image --region "us-east-1" --instance-id i-03c10fd5566a08476 --name ami-i-03c10fd5566a08476 --no-reboot
-func CreateImageFromInstance(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, imageName string, instanceId string, timeoutSeconds int) (string, error) {
+// AMI names must be unique, so amiName is different for each generation, while the image is tagged with imageName
+func CreateImageFromInstance(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, imageName string, amiName string, instanceId string, noReboot bool, timeoutSeconds int) (string, error) {
+	imageId, err := StartCreateImageFromInstance(ec2Client, goCtx, tags, lb, imageName, amiName, instanceId, noReboot)
+	if err != nil {
+		return "", err
+	}
+	return imageId, WaitForImageAvailable(ec2Client, goCtx, lb, imageName, imageId, timeoutSeconds)
+}
+
+// With noReboot, the instance keeps running and the image is crash-consistent as of this call:
+// the caller is expected to sync/freeze file systems before and may thaw them right after
+func StartCreateImageFromInstance(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, imageName string, amiName string, instanceId string, noReboot bool) (string, error) {
 	out, err := ec2Client.CreateImage(goCtx, &ec2.CreateImageInput{
 		InstanceId: aws.String(instanceId),
-		Name:       aws.String(imageName),
+		Name:       aws.String(amiName),
+		NoReboot:   aws.Bool(noReboot),
 		TagSpecifications: []types.TagSpecification{{
 			ResourceType: types.ResourceTypeImage,
 			Tags:         mapToTags(imageName, tags)}}})
-	lb.AddObject(fmt.Sprintf("CreateImage(imageName=%s,instanceId=%s)", imageName, instanceId), out)
+	lb.AddObject(fmt.Sprintf("CreateImage(imageName=%s,amiName=%s,instanceId=%s,noReboot=%t)", imageName, amiName, instanceId, noReboot), out)
+	if err != nil {
+		return "", fmt.Errorf("cannot create snapshot image %s from instance %s: %s", amiName, instanceId, err.Error())
+	}
+	return *out.ImageId, nil
+}
+
+// Reports snapshot progress every 10% while waiting
+func WaitForImageAvailable(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, imageName string, imageId string, timeoutSeconds int) error {
+	startWaitTs := time.Now()
+	reportedProgress := -1
+	for {
+		state, blockDeviceMappings, err := GetImageInfoById(ec2Client, goCtx, lb, imageId)
+		if err != nil {
+			return err
+		}
+		if state == types.ImageStateAvailable {
+			return nil
+		}
+		if state != types.ImageStatePending {
+			return fmt.Errorf("image %s(%s) was built, but the status is unknown: %s", imageName, imageId, state)
+		}
+		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
+			return fmt.Errorf("giving up after waiting for image %s(%s) to be created for %ds", imageName, imageId, timeoutSeconds)
+		}
+
+		// Snapshot ids show up in the mappings shortly after the image creation starts
+		snapshotIds := make([]string, 0)
+		for _, mapping := range blockDeviceMappings {
+			if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil && *mapping.Ebs.SnapshotId != "" {
+				snapshotIds = append(snapshotIds, *mapping.Ebs.SnapshotId)
+			}
+		}
+		if len(snapshotIds) > 0 {
+			progress, err := GetSnapshotsProgress(ec2Client, goCtx, lb, snapshotIds)
+			if err != nil {
+				return err
+			}
+			if progress/10 > reportedProgress/10 {
+				lb.AddAlways(fmt.Sprintf("image %s(%s) snapshots %d%% complete, elapsed %.0fs", imageName, imageId, progress, time.Since(startWaitTs).Seconds()))
+				reportedProgress = progress
+			}
+		}
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// Called on the destination region client. Copies the image and its snapshots from sourceRegion, re-encrypting them with kmsKeyId if specified.
+func CopyImage(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, sourceRegion string, sourceImageId string, amiName string, kmsKeyId string, timeoutSeconds int) (string, error) {
+	if sourceRegion == "" || sourceImageId == "" || amiName == "" {
+		return "", fmt.Errorf("empty parameter not allowed: sourceRegion (%s), sourceImageId (%s), amiName (%s)", sourceRegion, sourceImageId, amiName)
+	}
+	copyImageInput := ec2.CopyImageInput{
+		SourceRegion:  aws.String(sourceRegion),
+		SourceImageId: aws.String(sourceImageId),
+		Name:          aws.String(amiName),
+		CopyImageTags: aws.Bool(true)}
+	if kmsKeyId != "" {
+		copyImageInput.Encrypted = aws.Bool(true)
+		copyImageInput.KmsKeyId = aws.String(kmsKeyId)
+	}
+	out, err := ec2Client.CopyImage(goCtx, &copyImageInput)
+	lb.AddObject(fmt.Sprintf("CopyImage(sourceRegion=%s,sourceImageId=%s,amiName=%s,kmsKeyId=%s)", sourceRegion, sourceImageId, amiName, kmsKeyId), out)
 	if err != nil {
-		return "", fmt.Errorf("cannot create snapshot image %s from instance %s: %s", imageName, instanceId, err.Error())
+		return "", fmt.Errorf("cannot copy image %s from %s: %s", sourceImageId, sourceRegion, err.Error())
 	}
 
 	imageId := *out.ImageId
@@ -308,16 +607,84 @@ func CreateImageFromInstance(ec2Client *ec2.Client, goCtx context.Context, tags
 			break
 		}
 		if state != types.ImageStatePending {
-			return "", fmt.Errorf("image %s(%s) was built, but the status is unknown: %s", imageName, imageId, state)
+			return "", fmt.Errorf("image %s(%s) was copied, but the status is unknown: %s", amiName, imageId, state)
 		}
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
-			return "", fmt.Errorf("giving up after waiting for image %s(%s) to be created for %ds", imageName, imageId, timeoutSeconds)
+			return "", fmt.Errorf("giving up after waiting for image %s(%s) to be copied for %ds", amiName, imageId, timeoutSeconds)
+		}
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return "", err
 		}
-		time.Sleep(1 * time.Second)
 	}
 	return imageId, nil
 }
 
+// Allows accountId to launch instances from the image; image snapshots have to be shared separately
+func ShareImage(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, imageId string, accountId string) error {
+	out, err := ec2Client.ModifyImageAttribute(goCtx, &ec2.ModifyImageAttributeInput{
+		ImageId: aws.String(imageId),
+		LaunchPermission: &types.LaunchPermissionModifications{
+			Add: []types.LaunchPermission{{UserId: aws.String(accountId)}}}})
+	lb.AddObject(fmt.Sprintf("ModifyImageAttribute(imageId=%s,launchPermission.add=%s)", imageId, accountId), out)
+	if err != nil {
+		return fmt.Errorf("cannot share image %s with account %s: %s", imageId, accountId, err.Error())
+	}
+	return nil
+}
+
+func ShareSnapshot(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, snapshotId string, accountId string) error {
+	out, err := ec2Client.ModifySnapshotAttribute(goCtx, &ec2.ModifySnapshotAttributeInput{
+		SnapshotId: aws.String(snapshotId),
+		Attribute:  types.SnapshotAttributeNameCreateVolumePermission,
+		CreateVolumePermission: &types.CreateVolumePermissionModifications{
+			Add: []types.CreateVolumePermission{{UserId: aws.String(accountId)}}}})
+	lb.AddObject(fmt.Sprintf("ModifySnapshotAttribute(snapshotId=%s,createVolumePermission.add=%s)", snapshotId, accountId), out)
+	if err != nil {
+		return fmt.Errorf("cannot share snapshot %s with account %s: %s", snapshotId, accountId, err.Error())
+	}
+	return nil
+}
+
+// Returns empty key id for unencrypted snapshots
+func GetSnapshotKmsKeyId(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, snapshotId string) (string, error) {
+	out, err := ec2Client.DescribeSnapshots(goCtx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{snapshotId}})
+	lb.AddObject(fmt.Sprintf("DescribeSnapshots(SnapshotIds=%s)", snapshotId), out)
+	if err != nil {
+		return "", fmt.Errorf("cannot describe snapshot %s: %s", snapshotId, err.Error())
+	}
+	if len(out.Snapshots) == 0 {
+		return "", fmt.Errorf("cannot describe snapshot %s: not found", snapshotId)
+	}
+	if out.Snapshots[0].Encrypted == nil || !*out.Snapshots[0].Encrypted || out.Snapshots[0].KmsKeyId == nil {
+		return "", nil
+	}
+	return *out.Snapshots[0].KmsKeyId, nil
+}
+
+// Returns the progress of the least complete snapshot, 0-100
+func GetSnapshotsProgress(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, snapshotIds []string) (int, error) {
+	out, err := ec2Client.DescribeSnapshots(goCtx, &ec2.DescribeSnapshotsInput{SnapshotIds: snapshotIds})
+	lb.AddObject(fmt.Sprintf("DescribeSnapshots(SnapshotIds=%s)", strings.Join(snapshotIds, ",")), out)
+	if err != nil {
+		return 0, fmt.Errorf("cannot describe snapshots %s: %s", strings.Join(snapshotIds, ","), err.Error())
+	}
+	minProgress := 100
+	for _, snapshot := range out.Snapshots {
+		progress := 0
+		if snapshot.Progress != nil {
+			// "45%", empty right after the snapshot is started
+			progress, err = strconv.Atoi(strings.TrimSuffix(*snapshot.Progress, "%"))
+			if err != nil {
+				progress = 0
+			}
+		}
+		if progress < minProgress {
+			minProgress = progress
+		}
+	}
+	return minProgress, nil
+}
+
 func DeregisterImage(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, imageId string) error {
 	out, err := ec2Client.DeregisterImage(goCtx, &ec2.DeregisterImageInput{ImageId: aws.String(imageId)})
 	lb.AddObject(fmt.Sprintf("DeregisterImage(imageId=%s)", imageId), out)
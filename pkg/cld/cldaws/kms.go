@@ -0,0 +1,55 @@
+package cldaws
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmsTypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+)
+
+// Makes sure the key exists, is enabled, and the caller can use it: EBS encryption needs GenerateDataKeyWithoutPlaintext
+// (and CreateGrant/Decrypt, but there is no harmless way to check those)
+func VerifyKmsKey(kmsClient *kms.Client, goCtx context.Context, lb *l.LogBuilder, keyId string) error {
+	if keyId == "" {
+		return fmt.Errorf("empty parameter not allowed: keyId (%s)", keyId)
+	}
+	out, err := kmsClient.DescribeKey(goCtx, &kms.DescribeKeyInput{KeyId: aws.String(keyId)})
+	lb.AddObject(fmt.Sprintf("DescribeKey(KeyId=%s)", keyId), out)
+	if err != nil {
+		return fmt.Errorf("cannot describe kms key %s: %s", keyId, err.Error())
+	}
+	if out.KeyMetadata == nil {
+		return fmt.Errorf("cannot describe kms key %s: no metadata returned", keyId)
+	}
+	if out.KeyMetadata.KeyState != kmsTypes.KeyStateEnabled {
+		return fmt.Errorf("kms key %s has invalid state %s, expected %s", keyId, out.KeyMetadata.KeyState, kmsTypes.KeyStateEnabled)
+	}
+	if out.KeyMetadata.KeyUsage != kmsTypes.KeyUsageTypeEncryptDecrypt || out.KeyMetadata.KeySpec != kmsTypes.KeySpecSymmetricDefault {
+		return fmt.Errorf("kms key %s cannot be used for EBS encryption, expected symmetric %s key, got %s %s", keyId, kmsTypes.KeyUsageTypeEncryptDecrypt, out.KeyMetadata.KeySpec, out.KeyMetadata.KeyUsage)
+	}
+
+	outGen, err := kmsClient.GenerateDataKeyWithoutPlaintext(goCtx, &kms.GenerateDataKeyWithoutPlaintextInput{
+		KeyId:   aws.String(keyId),
+		KeySpec: kmsTypes.DataKeySpecAes256})
+	lb.AddObject(fmt.Sprintf("GenerateDataKeyWithoutPlaintext(KeyId=%s)", keyId), outGen)
+	if err != nil {
+		return fmt.Errorf("cannot use kms key %s: %s", keyId, err.Error())
+	}
+	return nil
+}
+
+// Snapshots encrypted with AWS managed keys (aws/ebs) cannot be shared with other accounts
+func IsAwsManagedKmsKey(kmsClient *kms.Client, goCtx context.Context, lb *l.LogBuilder, keyId string) (bool, error) {
+	out, err := kmsClient.DescribeKey(goCtx, &kms.DescribeKeyInput{KeyId: aws.String(keyId)})
+	lb.AddObject(fmt.Sprintf("DescribeKey(KeyId=%s)", keyId), out)
+	if err != nil {
+		return false, fmt.Errorf("cannot describe kms key %s: %s", keyId, err.Error())
+	}
+	if out.KeyMetadata == nil {
+		return false, fmt.Errorf("cannot describe kms key %s: no metadata returned", keyId)
+	}
+	return out.KeyMetadata.KeyManager == kmsTypes.KeyManagerTypeAws, nil
+}
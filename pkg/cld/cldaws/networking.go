@@ -115,7 +115,9 @@ func CreateVpc(ec2Client *ec2.Client, goCtx context.Context, tags map[string]str
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return "", fmt.Errorf("giving up after waiting for vpc (network) %s to be created after %ds", newVpcId, timeoutSeconds)
 		}
-		time.Sleep(1 * time.Second)
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return "", err
+		}
 	}
 
 	return newVpcId, nil
@@ -244,7 +246,9 @@ func CreateNatGateway(ec2Client *ec2.Client, goCtx context.Context, tags map[str
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return "", fmt.Errorf("giving up after waiting for nat gateway %s to be created after %ds", natGatewayId, timeoutSeconds)
 		}
-		time.Sleep(3 * time.Second)
+		if err := waitBeforeRetry(goCtx, 3*time.Second); err != nil {
+			return "", err
+		}
 	}
 	return natGatewayId, nil
 }
@@ -283,7 +287,9 @@ func DeleteNatGateway(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBui
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return fmt.Errorf("giving up after waiting for nat gateway %s to be deleted after %ds", natGatewayId, timeoutSeconds)
 		}
-		time.Sleep(3 * time.Second)
+		if err := waitBeforeRetry(goCtx, 3*time.Second); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -180,22 +180,17 @@ func getResourceState(ec2Client *ec2.Client, goCtx context.Context, r *cld.Resou
 	}
 }
 
-func getResourceDeploymentNameAndNameTags(ec2Client *ec2.Client, goCtx context.Context, resourceId string) (string, string, error) {
+func getResourceTags(ec2Client *ec2.Client, goCtx context.Context, resourceId string) (map[string]string, error) {
 	out, err := ec2Client.DescribeTags(goCtx, &ec2.DescribeTagsInput{Filters: []types.Filter{{
 		Name: aws.String("resource-id"), Values: []string{resourceId}}}})
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
-	deploymentNameTagValue := ""
-	resourceNameTagValue := ""
+	tags := map[string]string{}
 	for _, tagDesc := range out.Tags {
-		if *tagDesc.Key == "Name" {
-			resourceNameTagValue = *tagDesc.Value
-		} else if *tagDesc.Key == cld.DeploymentNameTagName {
-			deploymentNameTagValue = *tagDesc.Value
-		}
+		tags[*tagDesc.Key] = *tagDesc.Value
 	}
-	return deploymentNameTagValue, resourceNameTagValue, nil
+	return tags, nil
 }
 
 func GetResourcesByTag(tClient *tagging.Client, ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, region string, tagFilters []taggingTypes.TagFilter, readState bool) ([]*cld.Resource, error) {
@@ -221,12 +216,14 @@ func GetResourcesByTag(tClient *tagging.Client, ec2Client *ec2.Client, goCtx con
 					res.BilledState = billedState
 				}
 			}
-			deploymentName, resourceName, err := getResourceDeploymentNameAndNameTags(ec2Client, goCtx, res.Id)
+			tags, err := getResourceTags(ec2Client, goCtx, res.Id)
 			if err != nil {
 				lb.Add(err.Error())
 			} else {
-				res.DeploymentName = deploymentName
-				res.Name = resourceName
+				res.DeploymentName = tags[cld.DeploymentNameTagName]
+				res.Name = tags["Name"]
+				res.Owner = tags[cld.DeploymentOwnerTagName]
+				res.ExpiresAt = tags[cld.DeploymentExpiresAtTagName]
 			}
 			resources = append(resources, &res)
 		}
@@ -3,6 +3,7 @@ package cldaws
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -35,3 +36,13 @@ func mapToTags(tagName string, tagMap map[string]string) []types.Tag {
 	}
 	return result
 }
+
+// Pause between wait loop iterations, returns early if the command is cancelled (Ctrl+C)
+func waitBeforeRetry(goCtx context.Context, d time.Duration) error {
+	select {
+	case <-goCtx.Done():
+		return fmt.Errorf("cancelled while waiting: %s", goCtx.Err().Error())
+	case <-time.After(d):
+		return nil
+	}
+}
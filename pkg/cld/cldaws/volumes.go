@@ -3,6 +3,7 @@ package cldaws
 import (
 	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -18,17 +19,20 @@ init_volume_attachment()
   local volumeMountPath=$2
   local permissions=$3
   local owner=$4
+  local fsType=${5:-ext4}
+  local mountOptions=$6
 
   # Check if file system is already there
   local deviceBlockId=$(blkid -s UUID -o value $deviceName)
   if [ "$deviceBlockId" = "" ]; then
-    # Make file system (it outputs to stderr, so ignore it)
-    sudo mkfs.ext4 $deviceName 2>/dev/null
-    if [ "$?" -ne "0" ]; then
-      echo Error $?, cannot make file system on device $deviceName for $volumeMountPath
+    # Make file system (it reports progress to stderr, only the exit code matters)
+    sudo mkfs.$fsType $deviceName
+    local mkfsExitCode=$?
+    if [ "$mkfsExitCode" -ne "0" ]; then
+      echo Error $mkfsExitCode, cannot make file system on device $deviceName for $volumeMountPath
 	  echo lsblk returns:
 	  lsblk
-      return $?
+      return $mkfsExitCode
     fi
   fi
 
@@ -44,7 +48,7 @@ init_volume_attachment()
   fi
 
   # Mount point should exist by this time
-  sudo mount -o discard $deviceName $volumeMountPath
+  sudo mount -o ${mountOptions:-discard} $deviceName $volumeMountPath
   sudo systemctl daemon-reload
 
   # Set permissions
@@ -65,7 +69,7 @@ init_volume_attachment()
   local alreadyMounted=$(cat /etc/fstab | grep $volumeMountPath)
   if [ "$alreadyMounted" = "" ]; then
 	  # Adds a line to /etc/fstab
-    echo "UUID=$deviceBlockId   $volumeMountPath   ext4   defaults   0   2 " | sudo tee -a /etc/fstab
+    echo "UUID=$deviceBlockId   $volumeMountPath   $fsType   ${mountOptions:-defaults}   0   2 " | sudo tee -a /etc/fstab
   fi
 
   # Report UUID
@@ -74,6 +78,38 @@ init_volume_attachment()
 }
 `
 
+// On Nitro instances, EBS volumes are NVMe devices and their names (nvme1n1 etc) do not follow the order of attachment,
+// especially when there are NVMe instance stores. The serial number of the NVMe device is the volume id without the dash,
+// and udev creates /dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0123... symlinks using it.
+// Xen instances (t2, m4) do not have NVMe: the device is there under the name that was requested on attach, with sd replaced by xvd.
+const FindEbsVolumeDeviceFunc string = `
+find_ebs_volume_device()
+{
+  local volumeId=$1
+  local xenDeviceName=$2
+  local volumeSerial=$(echo $volumeId | tr -d '-')
+
+  # The device may show up a few seconds after AWS reports the volume attached
+  for i in $(seq 1 30); do
+    if [ -e "/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_$volumeSerial" ]; then
+      readlink -f /dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_$volumeSerial
+      return 0
+    fi
+    local serialDeviceName=$(lsblk -d -n -o NAME,SERIAL | awk -v s=$volumeSerial '$2 == s { print "/dev/" $1 }')
+    if [ -n "$serialDeviceName" ]; then
+      echo $serialDeviceName
+      return 0
+    fi
+    if [ -n "$xenDeviceName" ] && [ -b "$xenDeviceName" ]; then
+      echo $xenDeviceName
+      return 0
+    fi
+    sleep 1
+  done
+  return 1
+}
+`
+
 func GetVolumeIdByName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, volName string) (string, error) {
 	if volName == "" {
 		return "", fmt.Errorf("empty parameter not allowed: volName (%s)", volName)
@@ -117,7 +153,9 @@ func stringToVolType(volTypeString string) (types.VolumeType, error) {
 	return types.VolumeTypeStandard, fmt.Errorf("unknown volume type %s", volTypeString)
 }
 
-func CreateVolume(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, volName string, availabilityZone string, size int32, volTypeString string) (string, error) {
+// If snapshotId is not empty, the volume is restored from the snapshot (and re-encrypted with kmsKeyId if specified).
+// Zero iops/throughput mean volume type defaults.
+func CreateVolume(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, volName string, availabilityZone string, size int32, volTypeString string, iops int32, throughput int32, snapshotId string, encrypted bool, kmsKeyId string) (string, error) {
 	volType, err := stringToVolType(volTypeString)
 	if err != nil {
 		return "", err
@@ -125,14 +163,30 @@ func CreateVolume(ec2Client *ec2.Client, goCtx context.Context, tags map[string]
 	if volName == "" || availabilityZone == "" || size == 0 {
 		return "", fmt.Errorf("empty parameter not allowed: volName (%s), availabilityZone (%s), size (%d)", volName, availabilityZone, size)
 	}
-	out, err := ec2Client.CreateVolume(goCtx, &ec2.CreateVolumeInput{
+	createVolumeInput := ec2.CreateVolumeInput{
 		AvailabilityZone: aws.String(availabilityZone),
 		Size:             aws.Int32(size),
 		VolumeType:       volType,
 		TagSpecifications: []types.TagSpecification{{
 			ResourceType: types.ResourceTypeVolume,
-			Tags:         mapToTags(volName, tags)}}})
-	lb.AddObject(fmt.Sprintf("CreateVolume(volName=%s,availabilityZone=%s,size=%d)", volName, availabilityZone, size), out)
+			Tags:         mapToTags(volName, tags)}}}
+	if iops > 0 {
+		createVolumeInput.Iops = aws.Int32(iops)
+	}
+	if throughput > 0 {
+		createVolumeInput.Throughput = aws.Int32(throughput)
+	}
+	if snapshotId != "" {
+		createVolumeInput.SnapshotId = aws.String(snapshotId)
+	}
+	if encrypted {
+		createVolumeInput.Encrypted = aws.Bool(true)
+		if kmsKeyId != "" {
+			createVolumeInput.KmsKeyId = aws.String(kmsKeyId)
+		}
+	}
+	out, err := ec2Client.CreateVolume(goCtx, &createVolumeInput)
+	lb.AddObject(fmt.Sprintf("CreateVolume(volName=%s,availabilityZone=%s,size=%d,volType=%s,iops=%d,throughput=%d,snapshotId=%s,encrypted=%t,kmsKeyId=%s)", volName, availabilityZone, size, volTypeString, iops, throughput, snapshotId, encrypted, kmsKeyId), out)
 	if err != nil {
 		return "", fmt.Errorf("cannot create volume %s: %s", volName, err.Error())
 	}
@@ -172,7 +226,9 @@ func AttachVolume(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return "", fmt.Errorf("giving up after waiting for volume %s to attach to instance %s as device %s", volId, instanceId, suggestedDevice)
 		}
-		time.Sleep(1 * time.Second)
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return "", err
+		}
 	}
 
 	return newDevice, nil
@@ -206,7 +262,33 @@ func DetachVolume(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder
 		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
 			return fmt.Errorf("giving up after waiting for volume %s to detach from instance %s", volId, instanceId)
 		}
-		time.Sleep(1 * time.Second)
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Volumes get detached by AWS when the instance is terminated, but it's not instant
+func WaitForVolumeDetached(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, volId string, timeoutSeconds int) error {
+	if volId == "" {
+		return fmt.Errorf("empty parameter not allowed: volId (%s)", volId)
+	}
+	startWaitTs := time.Now()
+	for {
+		foundDevice, state, err := GetVolumeAttachedDeviceById(ec2Client, goCtx, lb, volId)
+		if err != nil {
+			return err
+		}
+		if foundDevice == "" || state == types.VolumeAttachmentStateDetached {
+			break
+		}
+		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
+			return fmt.Errorf("giving up after waiting for volume %s to detach from device %s, state %s", volId, foundDevice, state)
+		}
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -219,3 +301,211 @@ func DeleteVolume(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder
 	}
 	return nil
 }
+
+// Volume snapshots are found by this tag, not by Name: Name is unique for each snapshot generation
+const VolumeNameTagName string = "VolumeName"
+const VolumeSnapshotLabelTagName string = "VolumeSnapshotLabel"
+
+type VolumeSnapshotInfo struct {
+	Id        string
+	Label     string
+	State     types.SnapshotState
+	StartTime time.Time
+}
+
+// Returns snapshots of the volume, most recent first
+func GetVolumeSnapshotsByVolumeName(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, volName string) ([]VolumeSnapshotInfo, error) {
+	if volName == "" {
+		return nil, fmt.Errorf("empty parameter not allowed: volName (%s)", volName)
+	}
+	out, err := ec2Client.DescribeSnapshots(goCtx, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []string{"self"},
+		Filters:  []types.Filter{{Name: aws.String("tag:" + VolumeNameTagName), Values: []string{volName}}}})
+	lb.AddObject(fmt.Sprintf("DescribeSnapshots(tag:%s=%s)", VolumeNameTagName, volName), out)
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe snapshots for volume %s: %s", volName, err.Error())
+	}
+	result := make([]VolumeSnapshotInfo, len(out.Snapshots))
+	for i, snapshot := range out.Snapshots {
+		result[i] = VolumeSnapshotInfo{Id: *snapshot.SnapshotId, State: snapshot.State}
+		if snapshot.StartTime != nil {
+			result[i].StartTime = *snapshot.StartTime
+		}
+		for _, tag := range snapshot.Tags {
+			if *tag.Key == VolumeSnapshotLabelTagName {
+				result[i].Label = *tag.Value
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].StartTime.After(result[j].StartTime) })
+	return result, nil
+}
+
+func getSnapshotState(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, snapshotId string) (types.SnapshotState, error) {
+	out, err := ec2Client.DescribeSnapshots(goCtx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{snapshotId}})
+	lb.AddObject(fmt.Sprintf("DescribeSnapshots(SnapshotIds=%s)", snapshotId), out)
+	if err != nil {
+		return types.SnapshotStateError, fmt.Errorf("cannot describe snapshot %s: %s", snapshotId, err.Error())
+	}
+	if len(out.Snapshots) == 0 {
+		return types.SnapshotStateError, fmt.Errorf("cannot describe snapshot %s: not found", snapshotId)
+	}
+	return out.Snapshots[0].State, nil
+}
+
+func CreateVolumeSnapshot(ec2Client *ec2.Client, goCtx context.Context, tags map[string]string, lb *l.LogBuilder, snapshotName string, volId string, timeoutSeconds int) (string, error) {
+	if snapshotName == "" || volId == "" {
+		return "", fmt.Errorf("empty parameter not allowed: snapshotName (%s), volId (%s)", snapshotName, volId)
+	}
+	out, err := ec2Client.CreateSnapshot(goCtx, &ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(volId),
+		Description: aws.String(snapshotName),
+		TagSpecifications: []types.TagSpecification{{
+			ResourceType: types.ResourceTypeSnapshot,
+			Tags:         mapToTags(snapshotName, tags)}}})
+	lb.AddObject(fmt.Sprintf("CreateSnapshot(snapshotName=%s,volId=%s)", snapshotName, volId), out)
+	if err != nil {
+		return "", fmt.Errorf("cannot create snapshot %s of volume %s: %s", snapshotName, volId, err.Error())
+	}
+
+	snapshotId := *out.SnapshotId
+
+	startWaitTs := time.Now()
+	for {
+		state, err := getSnapshotState(ec2Client, goCtx, lb, snapshotId)
+		if err != nil {
+			return "", err
+		}
+		if state == types.SnapshotStateCompleted {
+			break
+		}
+		if state != types.SnapshotStatePending {
+			return "", fmt.Errorf("snapshot %s(%s) was requested, but has unexpected state %s", snapshotName, snapshotId, state)
+		}
+		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
+			return "", fmt.Errorf("giving up after waiting for snapshot %s(%s) to be created for %ds", snapshotName, snapshotId, timeoutSeconds)
+		}
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return "", err
+		}
+	}
+	return snapshotId, nil
+}
+
+// Volumes created from snapshots are not attachable right away
+func WaitForVolumeAvailable(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, volId string, timeoutSeconds int) error {
+	startWaitTs := time.Now()
+	for {
+		out, err := ec2Client.DescribeVolumes(goCtx, &ec2.DescribeVolumesInput{VolumeIds: []string{volId}})
+		lb.AddObject(fmt.Sprintf("DescribeVolumes(VolumeIds=%s)", volId), out)
+		if err != nil {
+			return fmt.Errorf("cannot describe volume by id %s: %s", volId, err.Error())
+		}
+		if len(out.Volumes) == 0 {
+			return fmt.Errorf("cannot describe volume by id %s: not found", volId)
+		}
+		if out.Volumes[0].State == types.VolumeStateAvailable {
+			return nil
+		}
+		if out.Volumes[0].State != types.VolumeStateCreating {
+			return fmt.Errorf("volume %s was requested, but has unexpected state %s", volId, out.Volumes[0].State)
+		}
+		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
+			return fmt.Errorf("giving up after waiting for volume %s to become available for %ds", volId, timeoutSeconds)
+		}
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+func GetVolumeSizeById(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, volId string) (int32, error) {
+	if volId == "" {
+		return 0, fmt.Errorf("empty parameter not allowed: volId (%s)", volId)
+	}
+	out, err := ec2Client.DescribeVolumes(goCtx, &ec2.DescribeVolumesInput{VolumeIds: []string{volId}})
+	lb.AddObject(fmt.Sprintf("DescribeVolumes(VolumeIds=%s)", volId), out)
+	if err != nil {
+		return 0, fmt.Errorf("cannot describe volume by id %s: %s", volId, err.Error())
+	}
+	if len(out.Volumes) == 0 || out.Volumes[0].Size == nil {
+		return 0, fmt.Errorf("cannot describe volume by id %s: not found", volId)
+	}
+	return *out.Volumes[0].Size, nil
+}
+
+// Waits until the modification reaches optimizing state: from this point, the new size is available to the instance
+func ModifyVolumeSize(ec2Client *ec2.Client, goCtx context.Context, lb *l.LogBuilder, volId string, size int32, timeoutSeconds int) error {
+	if volId == "" || size == 0 {
+		return fmt.Errorf("empty parameter not allowed: volId (%s), size (%d)", volId, size)
+	}
+	out, err := ec2Client.ModifyVolume(goCtx, &ec2.ModifyVolumeInput{VolumeId: aws.String(volId), Size: aws.Int32(size)})
+	lb.AddObject(fmt.Sprintf("ModifyVolume(VolumeId=%s,Size=%d)", volId, size), out)
+	if err != nil {
+		return fmt.Errorf("cannot modify volume %s size to %d: %s", volId, size, err.Error())
+	}
+
+	startWaitTs := time.Now()
+	for {
+		outMod, err := ec2Client.DescribeVolumesModifications(goCtx, &ec2.DescribeVolumesModificationsInput{VolumeIds: []string{volId}})
+		lb.AddObject(fmt.Sprintf("DescribeVolumesModifications(VolumeIds=%s)", volId), outMod)
+		if err != nil {
+			return fmt.Errorf("cannot describe volume %s modifications: %s", volId, err.Error())
+		}
+		if len(outMod.VolumesModifications) == 0 {
+			return fmt.Errorf("cannot describe volume %s modifications: none found", volId)
+		}
+		state := outMod.VolumesModifications[0].ModificationState
+		if state == types.VolumeModificationStateOptimizing || state == types.VolumeModificationStateCompleted {
+			break
+		}
+		if state != types.VolumeModificationStateModifying {
+			return fmt.Errorf("volume %s modification has unexpected state %s", volId, state)
+		}
+		if time.Since(startWaitTs).Seconds() > float64(timeoutSeconds) {
+			return fmt.Errorf("giving up after waiting for volume %s modification for %ds", volId, timeoutSeconds)
+		}
+		if err := waitBeforeRetry(goCtx, 1*time.Second); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Grows the partition (if the filesystem is on a partition, not on the whole device) and the filesystem.
+const GrowVolumeFilesystemFunc string = `
+grow_volume_filesystem()
+{
+  local deviceName=$1
+  local volumeMountPath=$2
+
+  local fsDeviceName=$deviceName
+  local partitionName=$(lsblk -n -p -o NAME,TYPE $deviceName | awk '$2 == "part" { print $1 }' | head -n 1)
+  if [ -n "$partitionName" ]; then
+    local partitionNumber=$(cat /sys/class/block/$(basename $partitionName)/partition)
+    sudo growpart $deviceName $partitionNumber
+    fsDeviceName=$partitionName
+  fi
+
+  local fsType=$(sudo blkid -s TYPE -o value $fsDeviceName)
+  case "$fsType" in
+    ext2|ext3|ext4)
+      sudo resize2fs $fsDeviceName
+      ;;
+    xfs)
+      sudo xfs_growfs $volumeMountPath
+      ;;
+    *)
+      echo Error, cannot grow unsupported filesystem type \"$fsType\" on $fsDeviceName
+      return 1
+      ;;
+  esac
+  if [ "$?" -ne "0" ]; then
+    echo Error, cannot grow $fsType filesystem on $fsDeviceName
+    return 1
+  fi
+
+  df -h $volumeMountPath | tail -n 1
+  return 0
+}
+`
@@ -13,6 +13,12 @@ const (
 const DeploymentNameTagName string = "DeploymentName"
 const DeploymentOperatorTagName string = "DeploymentOperator"
 const DeploymentOperatorTagValue string = "capideploy"
+const DeploymentOwnerTagName string = "DeploymentOwner"
+const DeploymentCreatedAtTagName string = "DeploymentCreatedAt"
+const DeploymentExpiresAtTagName string = "DeploymentExpiresAt"
+
+// Used for DeploymentCreatedAt and DeploymentExpiresAt tag values
+const DeploymentTimestampLayout string = "2006-01-02T15:04:05Z"
 
 type Resource struct {
 	DeploymentName string              `json:"deployment_name"`
@@ -22,6 +28,8 @@ type Resource struct {
 	Name           string              `json:"name"`
 	State          string              `json:"state"`
 	BilledState    ResourceBilledState `json:"billed_state"`
+	Owner          string              `json:"owner"`
+	ExpiresAt      string              `json:"expires_at"`
 }
 
 func (r *Resource) String() string {
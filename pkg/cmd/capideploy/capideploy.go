@@ -6,11 +6,16 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/capillariesio/capillaries-deploy/pkg/cld"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
 	"github.com/capillariesio/capillaries-deploy/pkg/prj"
 	"github.com/capillariesio/capillaries-deploy/pkg/provider"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
 )
 
 func usage(flagset *flag.FlagSet) {
@@ -39,16 +44,35 @@ Commands:
   %s <comma-separated list of instances to attach volumes on, or *> -p <jsonnet project file>
   %s <comma-separated list of instances to detach volumes on, or *> -p <jsonnet project file>
   %s <comma-separated list of instances to delete volumes on, or *> -p <jsonnet project file>
+  %s <comma-separated list of instances to snapshot volumes on, or *> -p <jsonnet project file>
+  %s <comma-separated list of instances to restore volumes from snapshots for, or *> -p <jsonnet project file> -volume_label <volume snapshot label, default latest>
+  %s <comma-separated list of instances to grow volumes on, or *> -p <jsonnet project file>
   %s <comma-separated list of instances to create, or *> -p <jsonnet project file>
   %s <comma-separated list of instances to delete, or *> -p <jsonnet project file>
   %s <comma-separated list of instances to ping, or *> -p <jsonnet project file> -n <number of repetitions, default 1>
-  %s <comma-separated list of instances to install services on, or *> -p <jsonnet project file>
+  %s <comma-separated list of instances to install services on, or *> -p <jsonnet project file> -stream
   %s <comma-separated list of instances to config services on, or *> -p <jsonnet project file>
   %s <comma-separated list of instances to start services on, or *> -p <jsonnet project file>
   %s <comma-separated list of instances to stop services on, or *> -p <jsonnet project file>
-  %s <comma-separated list of instances to create snapshot images for, or *> -p <jsonnet project file>
-  %s <comma-separated list of instances to create from snapshot images, or *> -p <jsonnet project file>
-  %s <comma-separated list of instances to delete snapshot images for, or *> -p <jsonnet project file>
+  %s <comma-separated list of instances to create snapshot images for, or *> -p <jsonnet project file> -l <generation label, default timestamp> -no_reboot
+  %s <comma-separated list of instances to create from snapshot images, or *> -p <jsonnet project file> -l <latest, yyyy-mm-dd or generation label, default latest>
+  %s <comma-separated list of instances to delete snapshot images for, or *> -p <jsonnet project file> -l <generation label, default all>
+  %s <comma-separated list of instances to copy snapshot images for, or *> -p <jsonnet project file> -region <destination region> -kms_key_id <destination key, optional> -l <latest, yyyy-mm-dd or generation label, default latest>
+  %s <comma-separated list of instances to share snapshot images for, or *> -p <jsonnet project file> -account <aws account id> -l <latest, yyyy-mm-dd or generation label, default latest>
+
+  %s <comma-separated list of instances to resize one by one, or *> -p <jsonnet project file>
+  %s <comma-separated list of instances to add to the deployment if they do not exist yet, or *> -p <jsonnet project file>
+  %s <instance to terminate and re-create with the same ip address and volumes> -p <jsonnet project file>
+  %s <instance purpose to build a base image with installed services for: bastion, cassandra, daemon, rabbitmq or prometheus> -p <jsonnet project file>
+
+  %s <instance to open interactive shell on> -p <jsonnet project file>
+  %s <instance>:<port> <local port, default same as instance port> -p <jsonnet project file>
+  %s <comma-separated list of instances to run command on, or *> -p <jsonnet project file> [-script <local script file>] [-- <command>]
+
+  %s -p <jsonnet project file> -o <output file, default ~/.capideploy/<deployment>_ssh_config>
+  %s -p <jsonnet project file> -format <ini or yaml, default ini> -o <output file, default stdout>
+
+  %s [-r]
 
   %s -p <jsonnet project file>
 `,
@@ -72,6 +96,9 @@ Commands:
 		provider.CmdAttachVolumes,
 		provider.CmdDetachVolumes,
 		provider.CmdDeleteVolumes,
+		provider.CmdBackupVolumes,
+		provider.CmdRestoreVolumes,
+		provider.CmdResizeVolumes,
 
 		provider.CmdCreateInstances,
 		provider.CmdDeleteInstances,
@@ -85,6 +112,22 @@ Commands:
 		provider.CmdCreateSnapshotImages,
 		provider.CmdCreateInstancesFromSnapshotImages,
 		provider.CmdDeleteSnapshotImages,
+		provider.CmdCopySnapshotImages,
+		provider.CmdShareSnapshotImages,
+
+		provider.CmdResizeInstances,
+		provider.CmdScaleOut,
+		provider.CmdReplaceInstance,
+		provider.CmdBakeImage,
+
+		provider.CmdSsh,
+		provider.CmdForward,
+		provider.CmdExec,
+
+		provider.CmdExportSshConfig,
+		provider.CmdExportInventory,
+
+		provider.CmdReapExpired,
 
 		provider.CmdCheckCassStatus,
 	)
@@ -106,6 +149,17 @@ func main() {
 	argNumberOfRepetitions := commonArgs.Int("n", 50, "Number of repetitions")
 	argShowProjectDetails := commonArgs.Bool("s", false, "Show project details (may contain sensitive info)")
 	argIgnoreAttachedVolumes := commonArgs.Bool("i", false, "Ignore attached volumes on instance delete")
+	argReportOnly := commonArgs.Bool("r", false, "Report expired deployments, do not delete them")
+	argSnapshotLabel := commonArgs.String("l", "", "Snapshot image generation label; when selecting a generation, also latest or yyyy-mm-dd")
+	argVolumeSnapshotLabel := commonArgs.String("volume_label", "", "Volume snapshot label for restore_volumes, default latest")
+	argRegion := commonArgs.String("region", "", "Destination region for snapshot image copies")
+	argAccount := commonArgs.String("account", "", "AWS account id to share snapshot images with")
+	argKmsKeyId := commonArgs.String("kms_key_id", "", "KMS key id, alias or arn in the destination region to encrypt snapshot image copies with")
+	argNoReboot := commonArgs.Bool("no_reboot", false, "Create snapshot images without stopping instances, freeze root file system instead")
+	argStreamOutput := commonArgs.Bool("stream", false, "Print remote script output line by line as it arrives, prefixed with instance nickname and script name")
+	argExecScriptFile := commonArgs.String("script", "", "Local script file to run on instances with exec, instead of the command after --")
+	argOutputPath := commonArgs.String("o", "", "Output file for exported ssh config or inventory")
+	argInventoryFormat := commonArgs.String("format", provider.InventoryFormatIni, "Exported inventory format: ini or yaml")
 
 	cmd := os.Args[1]
 	nicknames := ""
@@ -118,16 +172,46 @@ func main() {
 		nicknames = os.Args[2]
 		parseFromArgIdx = 3
 	}
+	forwardLocalPort := 0
+	if cmd == provider.CmdForward && len(os.Args) > 3 && !strings.HasPrefix(os.Args[3], "-") {
+		var err error
+		forwardLocalPort, err = strconv.Atoi(os.Args[3])
+		if err != nil {
+			usage(commonArgs)
+			log.Fatalf("invalid local port %s", os.Args[3])
+		}
+		parseFromArgIdx = 4
+	}
 	parseErr := commonArgs.Parse(os.Args[parseFromArgIdx:])
 	if parseErr != nil {
 		log.Fatalf(parseErr.Error())
 	}
 
+	// Everything after -- is the command for exec, each argument stays one word on the remote side
+	if cmd != provider.CmdExec && len(commonArgs.Args()) > 0 {
+		usage(commonArgs)
+		log.Fatalf("unexpected arguments for %s: %s", cmd, strings.Join(commonArgs.Args(), " "))
+	}
+	execCommandWords := make([]string, len(commonArgs.Args()))
+	for i, arg := range commonArgs.Args() {
+		execCommandWords[i] = rexec.ShellQuote(arg)
+	}
+	execCommand := strings.Join(execCommandWords, " ")
+
 	var project *prj.Project
 	var prjErr error
-	project, prjErr = prj.LoadProject(*argPrjFile)
-	if prjErr != nil {
-		log.Fatalf(prjErr.Error())
+	if provider.IsCmdRequiresProject(cmd) {
+		project, prjErr = prj.LoadProject(*argPrjFile)
+		if prjErr != nil {
+			log.Fatalf(prjErr.Error())
+		}
+		for _, warning := range project.LoadWarnings() {
+			fmt.Fprintf(os.Stderr, "%sWARNING: %s%s\n", l.LogColorYellow, warning, l.LogColorReset)
+		}
+	} else {
+		// No project file, but the provider still needs to know what it is, and timeouts are needed
+		project = &prj.Project{DeployProviderName: prj.DeployProviderAws}
+		project.InitDefaults()
 	}
 
 	// Unbuffered channels: write immediately to stdout/stderr/file/whatever
@@ -147,7 +231,11 @@ func main() {
 		}
 	}(cOut, cErr, cDone)
 
-	deployProvider, deployProviderErr := provider.DeployProviderFactory(project, context.TODO(),
+	// Ctrl+C cancels AWS wait loops and remote commands (remote processes get SIGTERM), instead of killing capideploy mid-way
+	goCtx, cancelGoCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelGoCtx()
+
+	deployProvider, deployProviderErr := provider.DeployProviderFactory(project, goCtx,
 		&provider.AssumeRoleConfig{
 			RoleArn:    os.Getenv("CAPIDEPLOY_AWS_ROLE_TO_ASSUME_ARN"),
 			ExternalId: os.Getenv("CAPIDEPLOY_AWS_ROLE_TO_ASSUME_EXTERNAL_ID")},
@@ -198,11 +286,14 @@ func main() {
 		}
 		finalErr = err
 	} else {
-		finalErr = deployProvider.ExecCmdWithNoResult(cmd, nicknames, &provider.ExecArgs{IgnoreAttachedVolumes: *argIgnoreAttachedVolumes, Verbosity: *argVerbosity, NumberOfRepetitions: *argNumberOfRepetitions, ShowProjectDetails: *argShowProjectDetails}, cOut, cErr)
+		finalErr = deployProvider.ExecCmdWithNoResult(cmd, nicknames, &provider.ExecArgs{IgnoreAttachedVolumes: *argIgnoreAttachedVolumes, Verbosity: *argVerbosity, NumberOfRepetitions: *argNumberOfRepetitions, ShowProjectDetails: *argShowProjectDetails, ReportOnly: *argReportOnly, SnapshotLabel: *argSnapshotLabel, VolumeSnapshotLabel: *argVolumeSnapshotLabel, Region: *argRegion, Account: *argAccount, KmsKeyId: *argKmsKeyId, NoReboot: *argNoReboot, StreamOutput: *argStreamOutput, ForwardLocalPort: forwardLocalPort, ExecCommand: execCommand, ExecScriptFile: *argExecScriptFile, OutputPath: *argOutputPath, InventoryFormat: *argInventoryFormat}, cOut, cErr)
 	}
 
+	rexec.CloseSshPool()
+
 	cDone <- 0
 
+	cancelGoCtx()
 	if finalErr != nil {
 		os.Exit(1)
 	}
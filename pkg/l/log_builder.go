@@ -19,6 +19,7 @@ type LogMsg string
 const LogColorReset string = "\033[0m"
 const LogColorRed string = "\033[31m"
 const LogColorGreen string = "\033[32m"
+const LogColorYellow string = "\033[33m"
 
 func NewLogBuilder(header string, isVerbose bool) *LogBuilder {
 	lb := LogBuilder{Sb: &strings.Builder{}, IsVerbose: isVerbose, Header: header, StartTs: time.Now()}
@@ -59,6 +60,11 @@ func (lb *LogBuilder) AddAlways(content string) {
 	lb.Sb.WriteString(fmt.Sprintf("%s\n", content))
 }
 
+// Always written, not an error
+func (lb *LogBuilder) AddWarning(content string) {
+	lb.Sb.WriteString(fmt.Sprintf("%sWARNING: %s%s\n", LogColorYellow, content, LogColorReset))
+}
+
 func (lb *LogBuilder) Complete(err error) (LogMsg, error) {
 	if lb.IsVerbose {
 		lb.Sb.WriteString(fmt.Sprintf("%s : ", lb.Header))
@@ -6,7 +6,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
 	"github.com/google/go-jsonnet"
@@ -22,6 +25,23 @@ const (
 	InstancePurposePrometheus InstancePurpose = "CAPIDEPLOY.INTERNAL.PURPOSE_PROMETHEUS"
 )
 
+const instancePurposePrefix string = "CAPIDEPLOY.INTERNAL.PURPOSE_"
+
+// "cassandra" for CAPIDEPLOY.INTERNAL.PURPOSE_CASSANDRA
+func (purpose InstancePurpose) ShortName() string {
+	return strings.ToLower(strings.TrimPrefix(string(purpose), instancePurposePrefix))
+}
+
+// Accepts both short names like "cassandra" and full names like CAPIDEPLOY.INTERNAL.PURPOSE_CASSANDRA
+func ParseInstancePurpose(name string) (InstancePurpose, error) {
+	for _, purpose := range []InstancePurpose{InstancePurposeBastion, InstancePurposeCassandra, InstancePurposeDaemon, InstancePurposeRabbitmq, InstancePurposePrometheus} {
+		if name == string(purpose) || name == purpose.ShortName() {
+			return purpose, nil
+		}
+	}
+	return "", fmt.Errorf("unknown instance purpose %s, expected bastion, cassandra, daemon, rabbitmq or prometheus", name)
+}
+
 type ExecTimeouts struct {
 	CreateInstance   int `json:"create_instance"`
 	DeleteInstance   int `json:"delete_instance"`
@@ -32,6 +52,13 @@ type ExecTimeouts struct {
 	DetachVolume     int `json:"detach_volume"`
 	CreateImage      int `json:"create_image"`
 	StopInstance     int `json:"stop_instance"`
+	StartInstance    int `json:"start_instance"`
+	CassandraJoin    int `json:"cassandra_join"`
+	CreateSnapshot   int `json:"create_snapshot"`
+	CreateVolume     int `json:"create_volume"`
+	ModifyVolume     int `json:"modify_volume"`
+	ConsoleOutput    int `json:"console_output"`
+	RemoteCommand    int `json:"remote_command"` // Default for ssh commands and scripts, see ServiceCommandsDef.Timeouts for per-script overrides
 }
 
 func (t *ExecTimeouts) InitDefaults() {
@@ -62,6 +89,27 @@ func (t *ExecTimeouts) InitDefaults() {
 	if t.StopInstance == 0 {
 		t.StopInstance = 300
 	}
+	if t.StartInstance == 0 {
+		t.StartInstance = 300
+	}
+	if t.CassandraJoin == 0 {
+		t.CassandraJoin = 600 // Bootstrapping a node may take a while
+	}
+	if t.CreateSnapshot == 0 {
+		t.CreateSnapshot = 600
+	}
+	if t.CreateVolume == 0 {
+		t.CreateVolume = 120
+	}
+	if t.ModifyVolume == 0 {
+		t.ModifyVolume = 300
+	}
+	if t.ConsoleOutput == 0 {
+		t.ConsoleOutput = 600 // Console output is updated every few minutes
+	}
+	if t.RemoteCommand == 0 {
+		t.RemoteCommand = 1800 // Installing Cassandra or Capillaries binaries on a slow instance takes a while
+	}
 }
 
 type SecurityGroupRuleDef struct {
@@ -123,27 +171,47 @@ type NetworkDef struct {
 }
 
 type VolumeDef struct {
-	Name             string `json:"name"`
-	MountPoint       string `json:"mount_point"`
-	Size             int    `json:"size"`
-	Type             string `json:"type"`
-	Permissions      int    `json:"permissions"`
-	Owner            string `json:"owner"`
-	AvailabilityZone string `json:"availability_zone"`
+	Name              string `json:"name"`
+	MountPoint        string `json:"mount_point"`
+	Size              int    `json:"size"`
+	Type              string `json:"type"`
+	Permissions       int    `json:"permissions"`
+	Owner             string `json:"owner"`
+	AvailabilityZone  string `json:"availability_zone"`
+	BackupGenerations int    `json:"backup_generations"` // How many backup_volumes snapshots to keep, 0 means keep all
+	Encrypted         bool   `json:"encrypted"`
+	KmsKeyId          string `json:"kms_key_id"`    // Key id, alias or arn; empty means AWS-managed aws/ebs key
+	Iops              int    `json:"iops"`          // gp3, io1, io2 only; 0 means gp3 baseline
+	Throughput        int    `json:"throughput"`    // MiB/s, gp3 only; 0 means gp3 baseline
+	FsType            string `json:"fs_type"`       // ext4 (default) or xfs
+	MountOptions      string `json:"mount_options"` // Comma-separated, like "noatime,discard"; empty means discard on mount, defaults in fstab
 	//VolumeId         string `json:"id"`
 	//Device           string `json:"device"`
 	//BlockDeviceId    string `json:"block_device_id"`
 }
 
 type ServiceCommandsDef struct {
-	Install []string `json:"install"`
-	Config  []string `json:"config"`
-	Start   []string `json:"start"`
-	Stop    []string `json:"stop"`
+	Install      []string       `json:"install"`
+	Config       []string       `json:"config"`
+	Start        []string       `json:"start"`
+	Stop         []string       `json:"stop"`
+	Timeouts     map[string]int `json:"timeouts,omitempty"`      // Script path -> seconds, overrides timeouts.remote_command
+	StrictStderr []string       `json:"strict_stderr,omitempty"` // Scripts that fail if they write anything to stderr, even with exit code 0
 }
 type ServiceDef struct {
-	Env map[string]string  `json:"env"`
-	Cmd ServiceCommandsDef `json:"cmd"`
+	Env             map[string]string  `json:"env"`
+	Params          map[string]any     `json:"params,omitempty"` // Typed values for script templates, as .Params
+	Cmd             ServiceCommandsDef `json:"cmd"`
+	renderedScripts map[string]string
+}
+
+// What script templates see. Rendered at project load: values capideploy populates later,
+// like bastion external ip address, are not there yet, pass them in env.
+type ScriptTemplateData struct {
+	Nickname string
+	Instance *InstanceDef
+	Project  *Project
+	Params   map[string]any
 }
 
 type UserDef struct {
@@ -151,6 +219,31 @@ type UserDef struct {
 	PublicKeyPath string `json:"public_key_path"`
 }
 
+// Root disk of the instance, if not specified, the image defaults are used
+type RootVolumeDef struct {
+	Size       int    `json:"size"`
+	Type       string `json:"type"`
+	Encrypted  bool   `json:"encrypted"`
+	KmsKeyId   string `json:"kms_key_id"` // Key id, alias or arn; empty means AWS-managed aws/ebs key
+	Iops       int    `json:"iops"`
+	Throughput int    `json:"throughput"`
+}
+
+// Local NVMe instance store disks, discovered by capideploy using instance type info.
+// Mounted at MountPointPrefix0, MountPointPrefix1 etc (or MountPointPrefix0 only for RAID0), mount points
+// are passed to service scripts as INSTANCE_STORE_MOUNTS (comma-separated) and INSTANCE_STORE_MOUNT_0, INSTANCE_STORE_MOUNT_1 etc.
+type InstanceStoreDef struct {
+	MountPointPrefix string `json:"mount_point_prefix"` // Like "/data"
+	Raid0            bool   `json:"raid0"`              // Assemble all disks into one /dev/md0 array
+	FsType           string `json:"fs_type"`            // xfs (default) or ext4
+	MountOptions     string `json:"mount_options"`      // Comma-separated, empty means defaults
+	Permissions      int    `json:"permissions"`
+	Owner            string `json:"owner"` // user or user:group, empty keeps root
+}
+
+// Instance store owner goes to chown in a remote shell command
+var instanceStoreOwnerRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]*(:[a-z_][a-z0-9_-]*)?$`)
+
 type InstanceDef struct {
 	Purpose  string `json:"purpose"`
 	InstName string `json:"inst_name"`
@@ -166,6 +259,11 @@ type InstanceDef struct {
 	Volumes                   map[string]*VolumeDef `json:"volumes,omitempty"`
 	Service                   ServiceDef            `json:"service"`
 	AssociatedInstanceProfile string                `json:"associated_instance_profile"` // CAPIDEPLOY_AWS_INSTANCE_PROFILE_WITH_S3_ACCESS=RoleAccessCapillariesTestbucket
+	RootVolume                *RootVolumeDef        `json:"root_volume,omitempty"`
+	InstanceStore             *InstanceStoreDef     `json:"instance_store,omitempty"`
+	SnapshotImageGenerations  int                   `json:"snapshot_image_generations"` // How many create_snapshot_images generations to keep, 0 means keep all
+	UseBakedImage             bool                  `json:"use_baked_image"`            // Create from the latest bake_image result for this purpose and skip install
+	SnapshotNoReboot          bool                  `json:"snapshot_no_reboot"`         // Safe to snapshot running instance with frozen root fs, no stop needed
 	//SubnetType            string                `json:"subnet_type"`
 	//Id                    string                `json:"id"`
 	//SnapshotImageId       string                `json:"snapshot_image_id"`
@@ -191,19 +289,115 @@ func (iDef *InstanceDef) BestIpAddress() string {
 // 	}
 // }
 
+// Used when the deployment is restored from copied snapshot images in another region
+type RegionOverrideDef struct {
+	PrivateSubnetAvailabilityZone string `json:"private_subnet_availability_zone"`
+	PublicSubnetAvailabilityZone  string `json:"public_subnet_availability_zone"`
+	VolumeAvailabilityZone        string `json:"volume_availability_zone"`
+}
+
 type Project struct {
-	DeploymentName     string                       `json:"deployment_name"`
-	SshConfig          *rexec.SshConfigDef          `json:"ssh_config"`
-	Timeouts           ExecTimeouts                 `json:"timeouts"`
-	SecurityGroups     map[string]*SecurityGroupDef `json:"security_groups"`
-	Network            NetworkDef                   `json:"network"`
-	Instances          map[string]*InstanceDef      `json:"instances"`
-	DeployProviderName string                       `json:"deploy_provider_name"`
+	DeploymentName     string                        `json:"deployment_name"`
+	SshConfig          *rexec.SshConfigDef           `json:"ssh_config"`
+	Timeouts           ExecTimeouts                  `json:"timeouts"`
+	SecurityGroups     map[string]*SecurityGroupDef  `json:"security_groups"`
+	Network            NetworkDef                    `json:"network"`
+	Instances          map[string]*InstanceDef       `json:"instances"`
+	DeployProviderName string                        `json:"deploy_provider_name"`
+	Ttl                string                        `json:"ttl"`                        // Go duration like "72h", used by reap_expired; empty means the deployment never expires
+	RegionOverrides    map[string]*RegionOverrideDef `json:"region_overrides,omitempty"` // Region -> availability zones to use there
+	ScriptDirs         []string                      `json:"script_dirs,omitempty"`      // Laid out like the embedded scripts dir, relative to the project file; first dir with the script wins, embedded scripts are the last resort
+	loadWarnings       []string
 	// EnvVariablesUsed   []string                     `json:"env_variables_used"`
 }
 
 func (p *Project) InitDefaults() {
 	p.Timeouts.InitDefaults()
+	if p.SshConfig != nil && p.SshConfig.KnownHostsPath == "" {
+		p.SshConfig.KnownHostsPath = fmt.Sprintf("~/.capideploy/%s_known_hosts", p.DeploymentName)
+	}
+}
+
+// Per-script timeouts of this instance on top of the project default, and scripts that are not allowed to write to stderr
+func (p *Project) ScriptExecPolicy(iDef *InstanceDef) rexec.ScriptExecPolicy {
+	return rexec.ScriptExecPolicy{DefaultTimeout: p.Timeouts.RemoteCommand, Timeouts: iDef.Service.Cmd.Timeouts, StrictStderr: iDef.Service.Cmd.StrictStderr, RenderedScripts: iDef.Service.renderedScripts, ScriptDirs: p.ScriptDirs}
+}
+
+// Problems found by LoadProject that do not prevent using the project
+func (p *Project) LoadWarnings() []string {
+	return p.loadWarnings
+}
+
+// Absolute paths, so scripts are found no matter where capideploy runs from
+func (p *Project) resolveScriptDirs(prjDirPath string) {
+	for i, scriptDir := range p.ScriptDirs {
+		scriptDir = rexec.ExpandHomePath(scriptDir)
+		if !filepath.IsAbs(scriptDir) {
+			scriptDir = filepath.Join(prjDirPath, scriptDir)
+		}
+		p.ScriptDirs[i] = filepath.Clean(scriptDir)
+	}
+}
+
+func (iDef *InstanceDef) allScripts() []string {
+	return append(append(append(append([]string{}, iDef.Service.Cmd.Install...), iDef.Service.Cmd.Config...), iDef.Service.Cmd.Start...), iDef.Service.Cmd.Stop...)
+}
+
+// Template errors fail the project load, not the deployment halfway through
+func (p *Project) renderScriptTemplates() error {
+	for iNickname, iDef := range p.Instances {
+		params := iDef.Service.Params
+		if params == nil {
+			params = map[string]any{}
+		}
+		iDef.Service.renderedScripts = map[string]string{}
+		for _, scriptPath := range iDef.allScripts() {
+			if !rexec.IsScriptTemplate(scriptPath) {
+				continue
+			}
+			if _, ok := iDef.Service.renderedScripts[scriptPath]; ok {
+				continue
+			}
+			rendered, err := rexec.RenderScriptTemplate(p.ScriptDirs, scriptPath, &ScriptTemplateData{Nickname: iNickname, Instance: iDef, Project: p, Params: params})
+			if err != nil {
+				return fmt.Errorf("instance %s: %s", iNickname, err.Error())
+			}
+			iDef.Service.renderedScripts[scriptPath] = rendered
+		}
+	}
+	return nil
+}
+
+// Instance nickname by its internal or bastion external ip address, empty if not found
+func (p *Project) NicknameByIpAddress(ipAddress string) string {
+	for iNickname, iDef := range p.Instances {
+		if iDef.IpAddress == ipAddress || iDef.ExternalIpAddress != "" && iDef.ExternalIpAddress == ipAddress {
+			return iNickname
+		}
+	}
+	return ""
+}
+
+// Returns true if the project has overrides for this region
+func (p *Project) ApplyRegionOverride(region string) bool {
+	o, ok := p.RegionOverrides[region]
+	if !ok || o == nil {
+		return false
+	}
+	if o.PrivateSubnetAvailabilityZone != "" {
+		p.Network.PrivateSubnet.AvailabilityZone = o.PrivateSubnetAvailabilityZone
+	}
+	if o.PublicSubnetAvailabilityZone != "" {
+		p.Network.PublicSubnet.AvailabilityZone = o.PublicSubnetAvailabilityZone
+	}
+	if o.VolumeAvailabilityZone != "" {
+		for _, iDef := range p.Instances {
+			for _, volDef := range iDef.Volumes {
+				volDef.AvailabilityZone = o.VolumeAvailabilityZone
+			}
+		}
+	}
+	return true
 }
 
 const DeployProviderAws string = "aws"
@@ -294,7 +488,80 @@ type ProjectPair struct {
 // 	prjPair.Live.Instances[iNickname].SnapshotImageId = newId
 // }
 
+// EBS limits per volume type, see https://docs.aws.amazon.com/ebs/latest/userguide/ebs-volume-types.html
+// Empty volType is allowed for root volumes only: the type comes from the image then.
+func validateEbsVolumeSpec(volType string, size int, iops int, throughput int) error {
+	if size < 0 || iops < 0 || throughput < 0 {
+		return fmt.Errorf("negative size (%d), iops (%d) or throughput (%d) not allowed", size, iops, throughput)
+	}
+	switch volType {
+	case "gp3":
+		if iops != 0 && (iops < 3000 || iops > 16000) {
+			return fmt.Errorf("gp3 iops %d out of range 3000-16000", iops)
+		}
+		if throughput != 0 && (throughput < 125 || throughput > 1000) {
+			return fmt.Errorf("gp3 throughput %d out of range 125-1000 MiB/s", throughput)
+		}
+		// Max 0.25 MiB/s per provisioned IOPS
+		if throughput > 125 && throughput*4 > max(iops, 3000) {
+			return fmt.Errorf("gp3 throughput %d MiB/s requires at least %d iops", throughput, throughput*4)
+		}
+		if size > 0 && iops > 500*size {
+			return fmt.Errorf("gp3 iops %d exceed 500 iops per GiB for size %d", iops, size)
+		}
+	case "io1", "io2":
+		if iops < 100 {
+			return fmt.Errorf("%s requires iops, at least 100, got %d", volType, iops)
+		}
+		maxIops, maxIopsPerGb := 64000, 50
+		if volType == "io2" {
+			maxIops, maxIopsPerGb = 256000, 1000
+		}
+		if iops > maxIops {
+			return fmt.Errorf("%s iops %d exceed %d", volType, iops, maxIops)
+		}
+		if size > 0 && iops > maxIopsPerGb*size {
+			return fmt.Errorf("%s iops %d exceed %d iops per GiB for size %d", volType, iops, maxIopsPerGb, size)
+		}
+		if throughput != 0 {
+			return fmt.Errorf("%s does not support throughput, it's derived from iops", volType)
+		}
+	case "gp2", "st1", "sc1", "standard", "":
+		if iops != 0 || throughput != 0 {
+			return fmt.Errorf("volume type '%s' does not support iops (%d) or throughput (%d), use gp3, io1 or io2", volType, iops, throughput)
+		}
+	default:
+		return fmt.Errorf("unknown volume type %s", volType)
+	}
+	return nil
+}
+
 func (prj *Project) validate() error {
+	if prj.Ttl != "" {
+		ttl, err := time.ParseDuration(prj.Ttl)
+		if err != nil {
+			return fmt.Errorf("invalid ttl %s, expected Go duration like 72h: %s", prj.Ttl, err.Error())
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("invalid ttl %s, expected positive duration", prj.Ttl)
+		}
+	}
+
+	if prj.SshConfig.Transport != "" && prj.SshConfig.Transport != rexec.TransportSsh && prj.SshConfig.Transport != rexec.TransportSsm {
+		return fmt.Errorf("invalid ssh_config transport %s, expected %s or %s", prj.SshConfig.Transport, rexec.TransportSsh, rexec.TransportSsm)
+	}
+	if prj.SshConfig.KnownHostsPath == rexec.NoKnownHostsPath && prj.SshConfig.HostKeysFromConsoleOutput {
+		return fmt.Errorf("ssh_config has host_keys_from_console_output, but known_hosts_path is %s", rexec.NoKnownHostsPath)
+	}
+	if prj.SshConfig.Transport == rexec.TransportSsm {
+		// SSM agent on the instance needs the instance profile to reach SSM
+		for iNickname, iDef := range prj.Instances {
+			if iDef.AssociatedInstanceProfile == "" {
+				return fmt.Errorf("instance %s has no associated_instance_profile, it is required with %s transport", iNickname, rexec.TransportSsm)
+			}
+		}
+	}
+
 	// Check instance presence and uniqueness: hostnames, ip addresses, security groups
 	hostnameMap := map[string]struct{}{}
 	internalIpMap := map[string]struct{}{}
@@ -326,6 +593,51 @@ func (prj *Project) validate() error {
 			bastionExternalIpInstanceNickname = iNickname
 		}
 
+		// Volume specs and encryption
+		if iDef.RootVolume != nil {
+			if err := validateEbsVolumeSpec(iDef.RootVolume.Type, iDef.RootVolume.Size, iDef.RootVolume.Iops, iDef.RootVolume.Throughput); err != nil {
+				return fmt.Errorf("instance %s root volume: %s", iNickname, err.Error())
+			}
+			if iDef.RootVolume.KmsKeyId != "" && !iDef.RootVolume.Encrypted {
+				return fmt.Errorf("instance %s root volume has kms_key_id %s, but it's not encrypted", iNickname, iDef.RootVolume.KmsKeyId)
+			}
+		}
+		for volNickname, volDef := range iDef.Volumes {
+			if volDef.Type == "" {
+				return fmt.Errorf("instance %s volume %s has empty type", iNickname, volNickname)
+			}
+			if err := validateEbsVolumeSpec(volDef.Type, volDef.Size, volDef.Iops, volDef.Throughput); err != nil {
+				return fmt.Errorf("instance %s volume %s: %s", iNickname, volNickname, err.Error())
+			}
+			if volDef.KmsKeyId != "" && !volDef.Encrypted {
+				return fmt.Errorf("instance %s volume %s has kms_key_id %s, but it's not encrypted", iNickname, volNickname, volDef.KmsKeyId)
+			}
+			if volDef.FsType != "" && volDef.FsType != "ext4" && volDef.FsType != "xfs" {
+				return fmt.Errorf("instance %s volume %s has unsupported fs_type %s, expected ext4 or xfs", iNickname, volNickname, volDef.FsType)
+			}
+			if strings.ContainsAny(volDef.MountOptions, " \t'\"") {
+				return fmt.Errorf("instance %s volume %s has invalid mount_options '%s', expected comma-separated list without spaces or quotes", iNickname, volNickname, volDef.MountOptions)
+			}
+		}
+
+		if iDef.InstanceStore != nil {
+			if !strings.HasPrefix(iDef.InstanceStore.MountPointPrefix, "/") || strings.ContainsAny(iDef.InstanceStore.MountPointPrefix, " \t'\"") {
+				return fmt.Errorf("instance %s has invalid instance store mount_point_prefix '%s', expected absolute path like /data", iNickname, iDef.InstanceStore.MountPointPrefix)
+			}
+			if iDef.InstanceStore.FsType != "" && iDef.InstanceStore.FsType != "ext4" && iDef.InstanceStore.FsType != "xfs" {
+				return fmt.Errorf("instance %s has unsupported instance store fs_type %s, expected ext4 or xfs", iNickname, iDef.InstanceStore.FsType)
+			}
+			if strings.ContainsAny(iDef.InstanceStore.MountOptions, " \t'\"") {
+				return fmt.Errorf("instance %s has invalid instance store mount_options '%s', expected comma-separated list without spaces or quotes", iNickname, iDef.InstanceStore.MountOptions)
+			}
+			if iDef.InstanceStore.Permissions == 0 {
+				return fmt.Errorf("instance %s has empty instance store permissions", iNickname)
+			}
+			if iDef.InstanceStore.Owner != "" && !instanceStoreOwnerRegex.MatchString(iDef.InstanceStore.Owner) {
+				return fmt.Errorf("instance %s has invalid instance store owner '%s', expected user or user:group name", iNickname, iDef.InstanceStore.Owner)
+			}
+		}
+
 		// Security groups
 		if iDef.SecurityGroupName == "" {
 			return fmt.Errorf("instance %s has empty security group name", iNickname)
@@ -360,15 +672,49 @@ func (prj *Project) validate() error {
 	if err := rexec.HarvestAllEmbeddedFilesPaths("", scriptsMap); err != nil {
 		return err
 	}
+	externalScriptsMap := map[string]bool{}
+	for i, scriptDir := range prj.ScriptDirs {
+		if slices.Contains(prj.ScriptDirs[:i], scriptDir) {
+			return fmt.Errorf("script dir %s is listed more than once", scriptDir)
+		}
+		if err := rexec.HarvestExternalScriptPaths(scriptDir, externalScriptsMap); err != nil {
+			return err
+		}
+	}
 	missingScriptsMap := map[string]struct{}{}
-	for _, iDef := range prj.Instances {
-		allInstanceScripts := append(append(append(iDef.Service.Cmd.Install, iDef.Service.Cmd.Config...), iDef.Service.Cmd.Start...), iDef.Service.Cmd.Stop...)
+	for iNickname, iDef := range prj.Instances {
+		allInstanceScripts := iDef.allScripts()
+		for envVarName := range iDef.Service.Env {
+			if !rexec.IsValidEnvVarName(envVarName) {
+				return fmt.Errorf("instance %s has invalid env variable name '%s', expected letters, digits and underscores", iNickname, envVarName)
+			}
+		}
+		for scriptPath, timeout := range iDef.Service.Cmd.Timeouts {
+			if timeout <= 0 {
+				return fmt.Errorf("instance %s has invalid timeout %d for script %s, expected positive number of seconds", iNickname, timeout, scriptPath)
+			}
+			if !slices.Contains(allInstanceScripts, scriptPath) {
+				return fmt.Errorf("instance %s has timeout for script %s, but does not use this script", iNickname, scriptPath)
+			}
+		}
+		for _, scriptPath := range iDef.Service.Cmd.StrictStderr {
+			if !slices.Contains(allInstanceScripts, scriptPath) {
+				return fmt.Errorf("instance %s has strict_stderr for script %s, but does not use this script", iNickname, scriptPath)
+			}
+		}
 		for _, scriptPath := range allInstanceScripts {
-			if _, ok := scriptsMap[scriptPath]; !ok {
+			_, isEmbedded := scriptsMap[scriptPath]
+			_, isExternal := externalScriptsMap[scriptPath]
+			if !isEmbedded && !isExternal {
 				missingScriptsMap[scriptPath] = struct{}{}
-			} else {
+			}
+			// An embedded script overridden by a script dir counts as used
+			if isEmbedded {
 				scriptsMap[scriptPath] = true
 			}
+			if isExternal {
+				externalScriptsMap[scriptPath] = true
+			}
 		}
 	}
 
@@ -380,7 +726,7 @@ func (prj *Project) validate() error {
 			missingScripts[i] = scriptPath
 			i++
 		}
-		return fmt.Errorf("cannot find embedded script(s): %s", strings.Join(missingScripts, ","))
+		return fmt.Errorf("cannot find script(s) in script_dirs or embedded scripts: %s", strings.Join(missingScripts, ","))
 	}
 
 	// Vice versa: verify all existing scripts are used
@@ -396,6 +742,18 @@ func (prj *Project) validate() error {
 		return fmt.Errorf("the following embedded scripts are not used in this project: %s", strings.Join(unusedScripts, ","))
 	}
 
+	// Script dirs may be shared by projects that use different services, so this is not an error
+	unusedExternalScripts := make([]string, 0)
+	for scriptPath, isUsed := range externalScriptsMap {
+		if !isUsed {
+			unusedExternalScripts = append(unusedExternalScripts, scriptPath)
+		}
+	}
+	if len(unusedExternalScripts) > 0 {
+		sort.Strings(unusedExternalScripts)
+		prj.loadWarnings = append(prj.loadWarnings, fmt.Sprintf("the following scripts in script_dirs are not used in this project: %s", strings.Join(unusedExternalScripts, ",")))
+	}
+
 	return nil
 }
 
@@ -473,10 +831,16 @@ func LoadProject(prjFile string) (*Project, error) {
 
 	project.InitDefaults()
 
+	project.resolveScriptDirs(filepath.Dir(prjFullPath))
+
 	if err := project.validate(); err != nil {
 		return nil, fmt.Errorf("cannot load project file %s: %s", prjFullPath, err.Error())
 	}
 
+	if err := project.renderScriptTemplates(); err != nil {
+		return nil, fmt.Errorf("cannot load project file %s: %s", prjFullPath, err.Error())
+	}
+
 	return &project, nil
 }
 
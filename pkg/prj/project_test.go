@@ -0,0 +1,52 @@
+package prj
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateEbsVolumeSpec(t *testing.T) {
+	cases := []struct {
+		name        string
+		volType     string
+		size        int
+		iops        int
+		throughput  int
+		expectedErr string
+	}{
+		{"gp3 defaults", "gp3", 100, 0, 0, ""},
+		{"gp3 provisioned", "gp3", 100, 4000, 1000, ""},
+		{"gp3 throughput within baseline iops", "gp3", 100, 0, 750, ""},
+		{"gp3 iops too low", "gp3", 100, 2000, 0, "out of range 3000-16000"},
+		{"gp3 iops too high", "gp3", 100, 20000, 0, "out of range 3000-16000"},
+		{"gp3 throughput too high", "gp3", 100, 16000, 2000, "out of range 125-1000"},
+		{"gp3 throughput needs iops", "gp3", 100, 3000, 1000, "requires at least 4000 iops"},
+		{"gp3 iops per GiB", "gp3", 10, 6000, 0, "exceed 500 iops per GiB"},
+		{"io1 ok", "io1", 100, 5000, 0, ""},
+		{"io1 missing iops", "io1", 100, 0, 0, "requires iops"},
+		{"io1 iops per GiB", "io1", 100, 6000, 0, "exceed 50 iops per GiB"},
+		{"io2 allows more iops per GiB", "io2", 100, 64000, 0, ""},
+		{"io2 iops too high", "io2", 1000, 300000, 0, "exceed 256000"},
+		{"io2 throughput", "io2", 100, 5000, 500, "does not support throughput"},
+		{"gp2 ok", "gp2", 100, 0, 0, ""},
+		{"gp2 iops", "gp2", 100, 3000, 0, "does not support iops"},
+		{"root volume type from image", "", 100, 0, 0, ""},
+		{"root volume type from image with throughput", "", 100, 0, 200, "does not support iops"},
+		{"negative size", "gp3", -1, 0, 0, "negative size"},
+		{"unknown type", "gp4", 100, 0, 0, "unknown volume type gp4"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateEbsVolumeSpec(c.volType, c.size, c.iops, c.throughput)
+			if c.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.expectedErr) {
+				t.Fatalf("expected error with '%s', got %v", c.expectedErr, err)
+			}
+		})
+	}
+}
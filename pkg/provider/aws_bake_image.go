@@ -0,0 +1,275 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/capillariesio/capillaries-deploy/pkg/cld"
+	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+// Baked images are shared across deployments, so they are named after purpose and architecture, not after deployment
+func bakedImageName(purpose prj.InstancePurpose, arch string) string {
+	return fmt.Sprintf("capideploy-baked-%s-%s", purpose.ShortName(), arch)
+}
+
+// First (by nickname) instance of this purpose provides image, flavor, keypair and install scripts for the builder
+func bakeTemplateNickname(project *prj.Project, purpose prj.InstancePurpose) (string, error) {
+	nicknames := sortedNicknamesByPurpose(project.Instances, purpose)
+	if len(nicknames) == 0 {
+		return "", fmt.Errorf("cannot bake image for %s, project has no instances of this purpose", purpose)
+	}
+	return nicknames[0], nil
+}
+
+// Builder runs in the private subnet: it needs internet access (NAT) and ssh access via bastion.
+// Use a security group of any private subnet instance, preferably the template one.
+func bakeBuilderSecurityGroupName(project *prj.Project, templateNickname string) (string, error) {
+	if project.Instances[templateNickname].SubnetName == project.Network.PrivateSubnet.Name {
+		return project.Instances[templateNickname].SecurityGroupName, nil
+	}
+	nicknames := make([]string, 0)
+	for iNickname, iDef := range project.Instances {
+		if iDef.SubnetName == project.Network.PrivateSubnet.Name {
+			nicknames = append(nicknames, iNickname)
+		}
+	}
+	if len(nicknames) == 0 {
+		return "", fmt.Errorf("cannot find security group for image builder, project has no instances in private subnet %s", project.Network.PrivateSubnet.Name)
+	}
+	sort.Strings(nicknames)
+	return project.Instances[nicknames[0]].SecurityGroupName, nil
+}
+
+// Launches a temporary instance in the private subnet, runs install scripts for the purpose, creates an image tagged
+// with purpose, architecture and install script hash, and terminates the builder
+func (p *AwsDeployProvider) BakeImage(purposeName string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+purposeName, p.DeployCtx.IsVerbose)
+
+	purpose, err := prj.ParseInstancePurpose(purposeName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	templateNickname, err := bakeTemplateNickname(p.DeployCtx.Project, purpose)
+	if err != nil {
+		return lb.Complete(err)
+	}
+	iDef := p.DeployCtx.Project.Instances[templateNickname]
+
+	if len(iDef.Service.Cmd.Install) == 0 {
+		return lb.Complete(fmt.Errorf("cannot bake image for %s, instance %s has no install scripts", purpose, templateNickname))
+	}
+
+	scriptHash, err := rexec.EmbeddedScriptsHash(iDef.Service.Cmd.Install, p.DeployCtx.Project.ScriptExecPolicy(iDef))
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	arch, err := cldaws.GetImageArchitecture(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, iDef.ImageId)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	instanceType, err := cldaws.GetInstanceType(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, iDef.FlavorName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	subnetId, err := cldaws.GetSubnetIdByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, p.DeployCtx.Project.Network.PrivateSubnet.Name)
+	if err != nil {
+		return lb.Complete(err)
+	}
+	if subnetId == "" {
+		return lb.Complete(fmt.Errorf("cannot bake image for %s, subnet %s does not exist yet, did you run create_networking?", purpose, p.DeployCtx.Project.Network.PrivateSubnet.Name))
+	}
+
+	sgName, err := bakeBuilderSecurityGroupName(p.DeployCtx.Project, templateNickname)
+	if err != nil {
+		return lb.Complete(err)
+	}
+	sgId, err := cldaws.GetSecurityGroupIdByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, sgName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+	if sgId == "" {
+		return lb.Complete(fmt.Errorf("cannot bake image for %s, security group %s does not exist yet, did you run create_security_groups?", purpose, sgName))
+	}
+
+	builderName := fmt.Sprintf("%s-bake-%s", p.DeployCtx.Project.DeploymentName, purpose.ShortName())
+	foundBuilderId, foundBuilderState, err := cldaws.GetInstanceIdAndStateByHostName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, builderName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+	if foundBuilderId != "" && foundBuilderState != types.InstanceStateNameTerminated {
+		return lb.Complete(fmt.Errorf("cannot bake image for %s, builder instance %s(%s) is already there, state %s; delete it if it's a leftover", purpose, builderName, foundBuilderId, foundBuilderState))
+	}
+
+	builderId, err := cldaws.CreateInstance(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb,
+		instanceType,
+		iDef.ImageId,
+		builderName,
+		"",
+		sgId,
+		iDef.RootKeyName,
+		subnetId,
+		nil,
+		p.DeployCtx.Project.Timeouts.CreateInstance)
+	var imageId string
+	if err == nil {
+		imageId, err = bakeImageOnBuilder(p, lb, iDef, builderId, builderName, purpose, arch, scriptHash)
+	}
+
+	// Builder goes away no matter what, even if it did not come up in time or the command was cancelled
+	if builderId != "" {
+		deleteCtx, cancelDeleteCtx := context.WithTimeout(context.Background(), time.Duration(p.DeployCtx.Project.Timeouts.DeleteInstance)*time.Second)
+		deleteErr := cldaws.DeleteInstance(p.DeployCtx.Aws.Ec2Client, deleteCtx, lb, builderId, p.DeployCtx.Project.Timeouts.DeleteInstance)
+		cancelDeleteCtx()
+		if deleteErr != nil {
+			lb.AddWarning(fmt.Sprintf("cannot delete builder instance %s(%s), delete it manually: %s", builderName, builderId, deleteErr.Error()))
+			if err == nil {
+				err = deleteErr
+			}
+		}
+	}
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	lb.AddAlways(fmt.Sprintf("baked image %s(%s) for %s, arch %s, install script hash %s", bakedImageName(purpose, arch), imageId, purpose, arch, scriptHash))
+
+	return lb.Complete(nil)
+}
+
+func bakeImageOnBuilder(p *AwsDeployProvider, lb *l.LogBuilder, iDef *prj.InstanceDef, builderId string, builderName string, purpose prj.InstancePurpose, arch string, scriptHash string) (string, error) {
+	if iDef.AssociatedInstanceProfile != "" {
+		// Install scripts may need S3 access
+		err := cldaws.AssociateInstanceProfile(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, builderId, iDef.AssociatedInstanceProfile)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	builderIp, err := cldaws.GetInstancePrivateIpById(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, builderId)
+	if err != nil {
+		return "", err
+	}
+
+	// Builder ip address is dynamic, it may have been used by a previous builder
+	err = refreshKnownHosts(p, lb, builderId, []string{builderIp})
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := forgetKnownHosts(p, lb, []string{builderIp}); err != nil {
+			lb.Add(err.Error())
+		}
+	}()
+
+	logMsg, err := pingOneHost(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, builderIp, p.DeployCtx.IsVerbose, 50)
+	lb.Add(string(logMsg))
+	if err != nil {
+		return "", err
+	}
+
+	logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, builderIp, iDef.Service.Cmd.Install, iDef.Service.Env, p.DeployCtx.Project.ScriptExecPolicy(iDef), p.DeployCtx.IsVerbose)
+	lb.Add(string(logMsg))
+	if err != nil {
+		return "", err
+	}
+
+	err = cldaws.StopInstance(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, builderId, p.DeployCtx.Project.Timeouts.StopInstance)
+	if err != nil {
+		return "", err
+	}
+
+	// No deployment name/operator tags: the image outlives the deployment, deployment_delete and reap_expired should not touch it
+	imageTags := map[string]string{
+		cldaws.BakedImagePurposeTagName:    string(purpose),
+		cldaws.BakedImageArchTagName:       arch,
+		cldaws.BakedImageScriptHashTagName: scriptHash,
+		cld.DeploymentOwnerTagName:         p.DeployCtx.Tags[cld.DeploymentOwnerTagName],
+		cld.DeploymentCreatedAtTagName:     p.DeployCtx.Tags[cld.DeploymentCreatedAtTagName]}
+
+	imageName := bakedImageName(purpose, arch)
+	imageId, err := cldaws.CreateImageFromInstance(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, imageTags, lb,
+		imageName,
+		fmt.Sprintf("%s-%s-%s", imageName, scriptHash[:12], time.Now().UTC().Format("20060102T150405Z")),
+		builderId,
+		false,
+		p.DeployCtx.Project.Timeouts.CreateImage)
+	if err != nil {
+		return "", err
+	}
+
+	_, blockDeviceMappings, err := cldaws.GetImageInfoById(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageId)
+	if err != nil {
+		return "", err
+	}
+
+	for _, mapping := range blockDeviceMappings {
+		if mapping.Ebs != nil {
+			if mapping.Ebs.SnapshotId != nil && *mapping.Ebs.SnapshotId != "" {
+				err = cldaws.TagResource(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, *mapping.Ebs.SnapshotId, imageName, imageTags)
+				if err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+
+	lb.Add(fmt.Sprintf("created image %s(%s) from builder %s(%s)", imageName, imageId, builderName, builderId))
+
+	return imageId, nil
+}
+
+// For instances with use_baked_image, returns the latest baked image built with current install scripts
+// for the instance purpose and the architecture of its image_id. Stale images (built with other scripts) are not used.
+func resolveBakedImageId(p *AwsDeployProvider, lb *l.LogBuilder, iNickname string, imageId string) (string, error) {
+	iDef := p.DeployCtx.Project.Instances[iNickname]
+	if !iDef.UseBakedImage {
+		return imageId, nil
+	}
+
+	purpose := prj.InstancePurpose(iDef.Purpose)
+	scriptHash, err := rexec.EmbeddedScriptsHash(iDef.Service.Cmd.Install, p.DeployCtx.Project.ScriptExecPolicy(iDef))
+	if err != nil {
+		return "", err
+	}
+
+	arch, err := cldaws.GetImageArchitecture(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageId)
+	if err != nil {
+		return "", err
+	}
+
+	images, err := cldaws.GetImagesByTags(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, map[string]string{
+		cldaws.BakedImagePurposeTagName: string(purpose),
+		cldaws.BakedImageArchTagName:    arch})
+	if err != nil {
+		return "", err
+	}
+
+	staleHashes := make([]string, 0)
+	for _, image := range images {
+		if image.State != types.ImageStateAvailable {
+			continue
+		}
+		if image.Tags[cldaws.BakedImageScriptHashTagName] == scriptHash {
+			lb.Add(fmt.Sprintf("using baked image %s for %s", image.Id, iNickname))
+			return image.Id, nil
+		}
+		staleHashes = append(staleHashes, image.Tags[cldaws.BakedImageScriptHashTagName])
+	}
+
+	if len(staleHashes) > 0 {
+		return "", fmt.Errorf("baked images for %s (%s) are stale: install script hash is %s, images have %s; run bake_image %s", iNickname, arch, scriptHash, strings.Join(staleHashes, ","), purpose.ShortName())
+	}
+	return "", fmt.Errorf("no baked image for %s (%s), run bake_image %s", iNickname, arch, purpose.ShortName())
+}
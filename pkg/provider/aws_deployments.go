@@ -1,6 +1,12 @@
 package provider
 
 import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	taggingTypes "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi/types"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld"
@@ -41,3 +47,154 @@ func (p *AwsDeployProvider) listDeploymentResources() ([]*cld.Resource, l.LogMsg
 	logMsg, _ := lb.Complete(nil)
 	return resources, logMsg, nil
 }
+
+// Dependencies go first, same order deployment_delete uses
+var reapResourceTypeOrder = []string{"image", "snapshot", "instance", "volume", "natgateway", "elastic-ip", "internet-gateway", "subnet", "route-table", "security-group", "vpc"}
+
+type deploymentExpiration struct {
+	Owner     string
+	ExpiresAt time.Time
+	// False if at least one resource was created without ttl: such deployment is never reaped
+	IsExpiring bool
+	Resources  []*cld.Resource
+}
+
+func reapResource(p *AwsDeployProvider, lb *l.LogBuilder, res *cld.Resource) error {
+	ec2Client := p.DeployCtx.Aws.Ec2Client
+	goCtx := p.DeployCtx.GoCtx
+	switch res.Type {
+	case "image":
+		return cldaws.DeregisterImage(ec2Client, goCtx, lb, res.Id)
+	case "snapshot":
+		return cldaws.DeleteSnapshot(ec2Client, goCtx, lb, res.Id)
+	case "instance":
+		return cldaws.DeleteInstance(ec2Client, goCtx, lb, res.Id, p.DeployCtx.Project.Timeouts.DeleteInstance)
+	case "volume":
+		// Terminated instances release their volumes, but not immediately
+		if err := cldaws.WaitForVolumeDetached(ec2Client, goCtx, lb, res.Id, p.DeployCtx.Project.Timeouts.DetachVolume); err != nil {
+			return err
+		}
+		return cldaws.DeleteVolume(ec2Client, goCtx, lb, res.Id)
+	case "natgateway":
+		return cldaws.DeleteNatGateway(ec2Client, goCtx, lb, res.Id, p.DeployCtx.Project.Timeouts.DeleteNatGateway)
+	case "elastic-ip":
+		return cldaws.ReleaseFloatingIpByAllocationId(ec2Client, goCtx, lb, res.Id)
+	case "internet-gateway":
+		attachedVpcId, _, err := cldaws.GetInternetGatewayVpcAttachmentById(ec2Client, goCtx, lb, res.Id)
+		if err != nil {
+			return err
+		}
+		if attachedVpcId != "" {
+			if err := cldaws.DetachInternetGatewayFromVpc(ec2Client, goCtx, lb, res.Id, attachedVpcId); err != nil {
+				return err
+			}
+		}
+		return cldaws.DeleteInternetGateway(ec2Client, goCtx, lb, res.Id)
+	case "subnet":
+		return cldaws.DeleteSubnet(ec2Client, goCtx, lb, res.Id)
+	case "route-table":
+		return cldaws.DeleteRouteTable(ec2Client, goCtx, lb, res.Id)
+	case "security-group":
+		return cldaws.DeleteSecurityGroup(ec2Client, goCtx, lb, res.Id)
+	case "vpc":
+		return cldaws.DeleteVpc(ec2Client, goCtx, lb, res.Id)
+	default:
+		return fmt.Errorf("cannot reap resource %s, unsupported type %s", res.String(), res.Type)
+	}
+}
+
+func reapDeployment(p *AwsDeployProvider, lb *l.LogBuilder, resources []*cld.Resource) error {
+	// Do not start deleting things if some of them cannot be deleted anyways
+	for _, res := range resources {
+		if !slices.Contains(reapResourceTypeOrder, res.Type) {
+			return fmt.Errorf("cannot reap resource %s, unsupported type %s", res.String(), res.Type)
+		}
+	}
+	for _, resType := range reapResourceTypeOrder {
+		for _, res := range resources {
+			if res.Type != resType {
+				continue
+			}
+			if err := reapResource(p, lb, res); err != nil {
+				return err
+			}
+			lb.AddAlways(fmt.Sprintf("reaped %s", res.String()))
+		}
+	}
+	return nil
+}
+
+// Finds all capideploy deployments by tags, reports their owners and expiration, and deletes expired ones
+// unless reportOnly is set. Does not need the project file: everything it needs is in the tags.
+func (p *AwsDeployProvider) ReapExpiredDeployments(reportOnly bool) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName(), p.DeployCtx.IsVerbose)
+	resources, err := cldaws.GetResourcesByTag(p.DeployCtx.Aws.TaggingClient, p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, p.DeployCtx.Aws.Config.Region,
+		[]taggingTypes.TagFilter{{Key: aws.String(cld.DeploymentOperatorTagName), Values: []string{cld.DeploymentOperatorTagValue}}}, true)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	deployments := map[string]*deploymentExpiration{}
+	for _, res := range resources {
+		// Terminated instances, deleted nat gateways etc stay visible for a while, nothing to do with them
+		if res.BilledState == cld.ResourceBilledStateTerminated || res.DeploymentName == "" {
+			continue
+		}
+		d, ok := deployments[res.DeploymentName]
+		if !ok {
+			d = &deploymentExpiration{IsExpiring: true, Resources: make([]*cld.Resource, 0)}
+			deployments[res.DeploymentName] = d
+		}
+		d.Resources = append(d.Resources, res)
+		if d.Owner == "" {
+			d.Owner = res.Owner
+		}
+		if res.ExpiresAt == "" {
+			d.IsExpiring = false
+			continue
+		}
+		expiresAt, err := time.Parse(cld.DeploymentTimestampLayout, res.ExpiresAt)
+		if err != nil {
+			lb.Add(fmt.Sprintf("resource %s has invalid %s tag %s, ignoring the deployment: %s", res.String(), cld.DeploymentExpiresAtTagName, res.ExpiresAt, err.Error()))
+			d.IsExpiring = false
+			continue
+		}
+		// Resources created later (scale_out, snapshots) extend the life of the deployment
+		if expiresAt.After(d.ExpiresAt) {
+			d.ExpiresAt = expiresAt
+		}
+	}
+
+	deploymentNames := make([]string, 0, len(deployments))
+	for deploymentName := range deployments {
+		deploymentNames = append(deploymentNames, deploymentName)
+	}
+	sort.Strings(deploymentNames)
+
+	now := time.Now().UTC()
+	failedDeployments := make([]string, 0)
+	for _, deploymentName := range deploymentNames {
+		d := deployments[deploymentName]
+		status := "active"
+		expiresAt := "never"
+		if d.IsExpiring {
+			expiresAt = d.ExpiresAt.Format(cld.DeploymentTimestampLayout)
+			if d.ExpiresAt.Before(now) {
+				status = "expired"
+			}
+		}
+		lb.AddAlways(fmt.Sprintf("%s,%s,%s,%d,%s", deploymentName, d.Owner, expiresAt, len(d.Resources), status))
+		if status != "expired" || reportOnly {
+			continue
+		}
+		if err := reapDeployment(p, lb, d.Resources); err != nil {
+			lb.AddAlways(fmt.Sprintf("cannot reap deployment %s: %s", deploymentName, err.Error()))
+			failedDeployments = append(failedDeployments, deploymentName)
+		}
+	}
+
+	if len(failedDeployments) > 0 {
+		return lb.Complete(fmt.Errorf("cannot reap expired deployments: %s", strings.Join(failedDeployments, ",")))
+	}
+	return lb.Complete(nil)
+}
@@ -42,6 +42,8 @@ StrictHostKeyChecking=no
 UserKnownHostsFile=/dev/null
 IdentityFile <private key path>
 
+Or, once instances are created, run export_ssh_config to get a deployment-scoped ssh config with entries for all instances.
+
 Also, you may find it convenient to use in your commands:
 
 export BASTION_IP=%s
@@ -0,0 +1,92 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+// Finds out how many instance store disks the running instance type has, formats and mounts them,
+// and passes mount points to service scripts as INSTANCE_STORE_MOUNTS and INSTANCE_STORE_MOUNT_<n> env variables.
+// Instance store is wiped on stop/start, so this is called before every config.
+func (p *AwsDeployProvider) InitInstanceStore(iNickname string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, p.DeployCtx.IsVerbose)
+
+	iDef := p.DeployCtx.Project.Instances[iNickname]
+	storeDef := iDef.InstanceStore
+	if storeDef == nil {
+		return lb.Complete(nil)
+	}
+
+	foundInstanceId, _, err := cldaws.GetInstanceIdAndStateByHostName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, iDef.InstName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+	if foundInstanceId == "" {
+		return lb.Complete(fmt.Errorf("cannot init instance store for %s, instance not found", iNickname))
+	}
+
+	// Use actual instance type, it may be different from the project flavor after resize_instances
+	foundInstanceType, err := cldaws.GetInstanceTypeById(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundInstanceId)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	storeInfo, err := cldaws.GetInstanceTypeInstanceStoreInfo(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundInstanceType)
+	if err != nil {
+		return lb.Complete(err)
+	}
+	if storeInfo.DiskCount == 0 {
+		return lb.Complete(fmt.Errorf("cannot init instance store for %s, instance type %s has no instance store", iNickname, foundInstanceType))
+	}
+	if !storeInfo.IsNvme {
+		return lb.Complete(fmt.Errorf("cannot init instance store for %s, instance type %s has non-NVMe instance store, not supported", iNickname, foundInstanceType))
+	}
+
+	fsType := storeDef.FsType
+	if fsType == "" {
+		fsType = "xfs"
+	}
+	mountOptions := storeDef.MountOptions
+	if mountOptions == "" {
+		mountOptions = "defaults"
+	}
+
+	mountPointsLine, er := rexec.ExecSshAndReturnLastLine(
+		p.DeployCtx.GoCtx,
+		p.DeployCtx.Project.SshConfig,
+		iDef.BestIpAddress(),
+		fmt.Sprintf(`%s
+init_instance_store %d %s %t %s %s %d %s`,
+			cldaws.InitInstanceStoreFunc,
+			storeInfo.DiskCount,
+			storeDef.MountPointPrefix,
+			storeDef.Raid0,
+			fsType,
+			mountOptions,
+			storeDef.Permissions,
+			rexec.ShellQuote(storeDef.Owner)),
+		p.DeployCtx.Project.Timeouts.RemoteCommand)
+	lb.Add(er.ToString())
+	if er.Error != nil {
+		return lb.Complete(fmt.Errorf("cannot init instance store for %s: %s", iNickname, er.Error.Error()))
+	}
+	if mountPointsLine == "" || strings.HasPrefix(mountPointsLine, "Error") {
+		return lb.Complete(fmt.Errorf("cannot init instance store for %s, returned mount points: %s", iNickname, mountPointsLine))
+	}
+
+	if iDef.Service.Env == nil {
+		iDef.Service.Env = map[string]string{}
+	}
+	iDef.Service.Env["INSTANCE_STORE_MOUNTS"] = mountPointsLine
+	for i, mountPoint := range strings.Split(mountPointsLine, ",") {
+		iDef.Service.Env[fmt.Sprintf("INSTANCE_STORE_MOUNT_%d", i)] = mountPoint
+	}
+
+	lb.Add(fmt.Sprintf("%s: %d instance store disk(s) %dGB, raid0 %t, mounted at %s", iNickname, storeInfo.DiskCount, storeInfo.DiskSizeGb, storeDef.Raid0, mountPointsLine))
+
+	return lb.Complete(nil)
+}
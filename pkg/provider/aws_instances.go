@@ -3,13 +3,17 @@ package provider
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
 	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
 )
 
 func (p *AwsDeployProvider) HarvestInstanceTypesByFlavorNames(flavorMap map[string]string) (l.LogMsg, error) {
@@ -50,6 +54,36 @@ func (p *AwsDeployProvider) VerifyKeypairs(keypairMap map[string]struct{}) (l.Lo
 	return lb.Complete(nil)
 }
 
+func (p *AwsDeployProvider) VerifyKmsKeys(kmsKeyMap map[string]struct{}) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName(), p.DeployCtx.IsVerbose)
+
+	for kmsKeyId := range kmsKeyMap {
+		err := cldaws.VerifyKmsKey(p.DeployCtx.Aws.KmsClient, p.DeployCtx.GoCtx, lb, kmsKeyId)
+		if err != nil {
+			return lb.Complete(err)
+		}
+	}
+	return lb.Complete(nil)
+}
+
+// For each instance nickname in the map, tells if the instance was created already (and not terminated)
+func (p *AwsDeployProvider) HarvestExistingInstances(existingMap map[string]bool) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName(), p.DeployCtx.IsVerbose)
+
+	for iNickname := range existingMap {
+		iDef, ok := p.DeployCtx.Project.Instances[iNickname]
+		if !ok {
+			return lb.Complete(fmt.Errorf("instance %s not found in the project", iNickname))
+		}
+		foundId, foundState, err := cldaws.GetInstanceIdAndStateByHostName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, iDef.InstName)
+		if err != nil {
+			return lb.Complete(err)
+		}
+		existingMap[iNickname] = foundId != "" && foundState != types.InstanceStateNameTerminated
+	}
+	return lb.Complete(nil)
+}
+
 func getInstanceSubnetId(p *AwsDeployProvider, lb *l.LogBuilder, iNickname string) (string, error) {
 	subnetName := p.DeployCtx.Project.Instances[iNickname].SubnetName
 
@@ -114,6 +148,24 @@ func internalCreate(p *AwsDeployProvider, lb *l.LogBuilder, iNickname string, in
 		}
 	}
 
+	if rootVolDef := p.DeployCtx.Project.Instances[iNickname].RootVolume; rootVolDef != nil {
+		rootDeviceName, err := cldaws.GetImageRootDeviceName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageId)
+		if err != nil {
+			return err
+		}
+		if blockDeviceMappings == nil {
+			// Start with image defaults, so instance store and other mappings are not lost
+			_, blockDeviceMappings, err = cldaws.GetImageInfoById(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageId)
+			if err != nil {
+				return err
+			}
+		}
+		blockDeviceMappings, err = cldaws.SetRootBlockDeviceMapping(blockDeviceMappings, rootDeviceName, int32(rootVolDef.Size), rootVolDef.Type, int32(rootVolDef.Iops), int32(rootVolDef.Throughput), rootVolDef.Encrypted, rootVolDef.KmsKeyId)
+		if err != nil {
+			return err
+		}
+	}
+
 	instanceId, err = cldaws.CreateInstance(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb,
 		instanceTypeString,
 		imageId,
@@ -135,6 +187,15 @@ func internalCreate(p *AwsDeployProvider, lb *l.LogBuilder, iNickname string, in
 		}
 	}
 
+	knownHostsIps := []string{p.DeployCtx.Project.Instances[iNickname].IpAddress}
+	if externalIpAddress != "" {
+		knownHostsIps = append(knownHostsIps, externalIpAddress)
+	}
+	err = refreshKnownHosts(p, lb, instanceId, knownHostsIps)
+	if err != nil {
+		return err
+	}
+
 	if p.DeployCtx.Project.Instances[iNickname].AssociatedInstanceProfile != "" {
 		// Associate "RoleAccessCapillariesTestbucket" instance profile
 		// (see readme, this instance profile wraps the actual role RoleAccessCapillariesTestbucket)
@@ -161,6 +222,11 @@ func (p *AwsDeployProvider) CreateInstanceAndWaitForCompletion(iNickname string,
 		return lb.Complete(err)
 	}
 
+	imageId, err = resolveBakedImageId(p, lb, iNickname, imageId)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
 	return lb.Complete(internalCreate(p, lb, iNickname, flavorId, imageId, nil, subnetId, sgId))
 }
 
@@ -225,24 +291,96 @@ func (p *AwsDeployProvider) DeleteInstance(iNickname string, ignoreAttachedVolum
 		return lb.Complete(nil)
 	}
 
-	return lb.Complete(cldaws.DeleteInstance(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundId, p.DeployCtx.Project.Timeouts.DeleteInstance))
+	err = cldaws.DeleteInstance(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundId, p.DeployCtx.Project.Timeouts.DeleteInstance)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	knownHostsIps := []string{p.DeployCtx.Project.Instances[iNickname].IpAddress}
+	if p.DeployCtx.Project.Instances[iNickname].ExternalIpAddress != "" {
+		knownHostsIps = append(knownHostsIps, p.DeployCtx.Project.Instances[iNickname].ExternalIpAddress)
+	}
+	return lb.Complete(forgetKnownHosts(p, lb, knownHostsIps))
+}
+
+var snapshotImageLabelRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// Picks an available generation: latest if selector is empty or "latest", latest created on or before the end of the day
+// if selector is a date like 2024-01-31, or the one with the exact label otherwise
+func selectSnapshotImage(images []cldaws.ImageInfo, imageName string, selector string) (*cldaws.ImageInfo, error) {
+	var selectorDayEnd *time.Time
+	if selectorDate, err := time.Parse("2006-01-02", selector); err == nil {
+		dayEnd := selectorDate.Add(24 * time.Hour)
+		selectorDayEnd = &dayEnd
+	}
+	availableLabels := make([]string, 0)
+	for i := range images {
+		if images[i].State != types.ImageStateAvailable {
+			continue
+		}
+		availableLabels = append(availableLabels, images[i].Label)
+		if selector == "" || selector == "latest" ||
+			(selectorDayEnd != nil && images[i].CreationDate.Before(*selectorDayEnd)) ||
+			images[i].Label == selector {
+			return &images[i], nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find available snapshot image %s generation '%s', available: %s", imageName, selector, strings.Join(availableLabels, ","))
+}
+
+// Deregisters the image and deletes all its snapshots
+func deleteSnapshotImageGeneration(p *AwsDeployProvider, lb *l.LogBuilder, image *cldaws.ImageInfo) error {
+	snapshotIds := make([]string, 0)
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping.Ebs != nil {
+			if mapping.Ebs.SnapshotId != nil && *mapping.Ebs.SnapshotId != "" {
+				snapshotIds = append(snapshotIds, *mapping.Ebs.SnapshotId)
+			}
+		}
+	}
+
+	err := cldaws.DeregisterImage(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, image.Id)
+	if err != nil {
+		return err
+	}
+
+	// Now we can delete the snapshots
+	for _, snapshotId := range snapshotIds {
+		err := cldaws.DeleteSnapshot(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, snapshotId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (p *AwsDeployProvider) CreateSnapshotImage(iNickname string) (l.LogMsg, error) {
+// Creates a new generation of the snapshot image labeled with snapshotLabel (UTC timestamp if empty),
+// and removes generations beyond iDef.SnapshotImageGenerations
+func (p *AwsDeployProvider) CreateSnapshotImage(iNickname string, snapshotLabel string, noReboot bool) (l.LogMsg, error) {
 	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, p.DeployCtx.IsVerbose)
 
-	imageName := p.DeployCtx.Project.Instances[iNickname].InstName
+	iDef := p.DeployCtx.Project.Instances[iNickname]
+	imageName := iDef.InstName
 
-	foundImageId, foundImageState, _, err := cldaws.GetImageInfoByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageName)
+	if snapshotLabel == "" {
+		snapshotLabel = time.Now().UTC().Format("20060102T150405Z")
+	}
+	if !snapshotImageLabelRegex.MatchString(snapshotLabel) {
+		return lb.Complete(fmt.Errorf("cannot create snapshot image %s, invalid label '%s', expected letters, digits, '.', '_' or '-'", imageName, snapshotLabel))
+	}
+
+	images, err := cldaws.GetImagesByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageName)
 	if err != nil {
 		return lb.Complete(err)
 	}
 
-	if foundImageId != "" || (foundImageState != "" && foundImageState != types.ImageStateDeregistered) {
-		return lb.Complete(fmt.Errorf("cannot create snaphost image %s, delete/deregister existing image %s first", imageName, foundImageId))
+	for _, image := range images {
+		if image.Label == snapshotLabel && image.State != types.ImageStateDeregistered {
+			return lb.Complete(fmt.Errorf("cannot create snaphost image %s, image %s with label %s already exists", imageName, image.Id, snapshotLabel))
+		}
 	}
 
-	attachedVols, err := getAttachedVolumes(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, p.DeployCtx.Project.Instances[iNickname].Volumes)
+	attachedVols, err := getAttachedVolumes(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, iDef.Volumes)
 	if err != nil {
 		return lb.Complete(err)
 	}
@@ -251,7 +389,7 @@ func (p *AwsDeployProvider) CreateSnapshotImage(iNickname string) (l.LogMsg, err
 		return lb.Complete(fmt.Errorf("cannot create snapshot image from instance %s, detach volumes first: %s", iNickname, strings.Join(attachedVols, ",")))
 	}
 
-	foundInstanceId, foundInstanceState, err := cldaws.GetInstanceIdAndStateByHostName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, p.DeployCtx.Project.Instances[iNickname].InstName)
+	foundInstanceId, foundInstanceState, err := cldaws.GetInstanceIdAndStateByHostName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, iDef.InstName)
 	if err != nil {
 		return lb.Complete(err)
 	}
@@ -265,17 +403,47 @@ func (p *AwsDeployProvider) CreateSnapshotImage(iNickname string) (l.LogMsg, err
 		return lb.Complete(fmt.Errorf("cannot create snapshot image from instance %s, instance state is %s, expected running", iNickname, foundInstanceState))
 	}
 
-	if foundInstanceState != types.InstanceStateNameStopped {
+	// No-reboot mode for instances marked safe in the project, or for all instances if requested in the command line.
+	// A stopped instance is consistent anyways.
+	noReboot = (noReboot || iDef.SnapshotNoReboot) && foundInstanceState == types.InstanceStateNameRunning
+
+	if foundInstanceState != types.InstanceStateNameStopped && !noReboot {
 		err = cldaws.StopInstance(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundInstanceId, p.DeployCtx.Project.Timeouts.StopInstance)
 		if err != nil {
 			return lb.Complete(err)
 		}
 	}
 
-	imageId, err := cldaws.CreateImageFromInstance(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb,
-		p.DeployCtx.Project.Instances[iNickname].InstName,
+	if noReboot {
+		err = freezeInstanceRootFs(p, lb, iNickname)
+		if err != nil {
+			return lb.Complete(err)
+		}
+	}
+
+	imageTags := map[string]string{
+		cldaws.ImageNicknameTagName:      iNickname,
+		cldaws.ImageSnapshotLabelTagName: snapshotLabel}
+	for k, v := range p.DeployCtx.Tags {
+		imageTags[k] = v
+	}
+
+	imageId, err := cldaws.StartCreateImageFromInstance(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, imageTags, lb,
+		imageName,
+		imageName+"-"+snapshotLabel,
 		foundInstanceId,
-		p.DeployCtx.Project.Timeouts.CreateImage)
+		noReboot)
+
+	if noReboot {
+		// Snapshots are point-in-time as of CreateImage call, no need to keep the file system frozen while they are being copied
+		thawInstanceRootFs(p, lb, iNickname)
+	}
+
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	err = cldaws.WaitForImageAvailable(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageName, imageId, p.DeployCtx.Project.Timeouts.CreateImage)
 	if err != nil {
 		return lb.Complete(err)
 	}
@@ -289,7 +457,7 @@ func (p *AwsDeployProvider) CreateSnapshotImage(iNickname string) (l.LogMsg, err
 	for _, mapping := range blockDeviceMappings {
 		if mapping.Ebs != nil {
 			if mapping.Ebs.SnapshotId != nil && *mapping.Ebs.SnapshotId != "" {
-				cldaws.TagResource(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, *mapping.Ebs.SnapshotId, p.DeployCtx.Project.Instances[iNickname].InstName, p.DeployCtx.Tags)
+				err = cldaws.TagResource(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, *mapping.Ebs.SnapshotId, imageName, imageTags)
 				if err != nil {
 					return lb.Complete(err)
 				}
@@ -297,12 +465,34 @@ func (p *AwsDeployProvider) CreateSnapshotImage(iNickname string) (l.LogMsg, err
 		}
 	}
 
+	lb.Add(fmt.Sprintf("created snapshot image %s(%s) generation %s", imageName, imageId, snapshotLabel))
+
+	if iDef.SnapshotImageGenerations == 0 {
+		return lb.Complete(nil)
+	}
+
+	images, err = cldaws.GetImagesByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	for i := iDef.SnapshotImageGenerations; i < len(images); i++ {
+		if images[i].State == types.ImageStateDeregistered {
+			continue
+		}
+		if err := deleteSnapshotImageGeneration(p, lb, &images[i]); err != nil {
+			return lb.Complete(err)
+		}
+		lb.Add(fmt.Sprintf("deleted old snapshot image %s(%s) generation %s", imageName, images[i].Id, images[i].Label))
+	}
+
 	return lb.Complete(nil)
 }
 
 // aws ec2 run-instances --region "us-east-1" --image-id ami-0bfdcfac85eb09d46 --count 1 --instance-type c7g.large --key-name $CAPIDEPLOY_AWS_SSH_ROOT_KEYPAIR_NAME --subnet-id subnet-09e2ba71bb1a5df94 --security-group-id sg-090b9d1ef7a1d1914 --private-ip-address 10.5.1.10
 // aws ec2 associate-address --instance-id i-0c4b32d20a1671b1e --public-ip 54.86.220.208
-func (p *AwsDeployProvider) CreateInstanceFromSnapshotImageAndWaitForCompletion(iNickname string, flavorId string) (l.LogMsg, error) {
+// See selectSnapshotImage for imageSelector values
+func (p *AwsDeployProvider) CreateInstanceFromSnapshotImageAndWaitForCompletion(iNickname string, flavorId string, imageSelector string) (l.LogMsg, error) {
 	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, p.DeployCtx.IsVerbose)
 
 	subnetId, err := getInstanceSubnetId(p, lb, iNickname)
@@ -316,21 +506,22 @@ func (p *AwsDeployProvider) CreateInstanceFromSnapshotImageAndWaitForCompletion(
 	}
 
 	imageName := p.DeployCtx.Project.Instances[iNickname].InstName
-	foundImageId, foundImageState, blockDeviceMappings, err := cldaws.GetImageInfoByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageName)
+	images, err := cldaws.GetImagesByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageName)
 	if err != nil {
 		return lb.Complete(err)
 	}
 
-	if foundImageId == "" {
+	if len(images) == 0 {
 		return lb.Complete(fmt.Errorf("cannot create instance for %s from snapshot image %s that is not found", iNickname, imageName))
 	}
 
-	if foundImageState != types.ImageStateAvailable {
-		return lb.Complete(fmt.Errorf("cannot create instance for %s from snapshot image %s of invalid state %s", iNickname, imageName, foundImageState))
+	image, err := selectSnapshotImage(images, imageName, imageSelector)
+	if err != nil {
+		return lb.Complete(err)
 	}
 
 	isSnapshotIdFound := false
-	for _, mapping := range blockDeviceMappings {
+	for _, mapping := range image.BlockDeviceMappings {
 		if mapping.Ebs != nil {
 			if mapping.Ebs.SnapshotId != nil && *mapping.Ebs.SnapshotId != "" {
 				isSnapshotIdFound = true
@@ -342,48 +533,451 @@ func (p *AwsDeployProvider) CreateInstanceFromSnapshotImageAndWaitForCompletion(
 		return lb.Complete(fmt.Errorf("cannot create instance from image %s/%s, image snapshot not found", iNickname, flavorId))
 	}
 
-	return lb.Complete(internalCreate(p, lb, iNickname, flavorId, foundImageId, blockDeviceMappings, subnetId, sgId))
+	lb.Add(fmt.Sprintf("creating instance %s from snapshot image %s(%s) generation %s", iNickname, imageName, image.Id, image.Label))
+
+	return lb.Complete(internalCreate(p, lb, iNickname, flavorId, image.Id, image.BlockDeviceMappings, subnetId, sgId))
 }
 
-func (p *AwsDeployProvider) DeleteSnapshotImage(iNickname string) (l.LogMsg, error) {
+// Deletes the snapshot image generation with the specified label, or all generations if the label is empty
+func (p *AwsDeployProvider) DeleteSnapshotImage(iNickname string, snapshotLabel string) (l.LogMsg, error) {
 	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, p.DeployCtx.IsVerbose)
 
 	imageName := p.DeployCtx.Project.Instances[iNickname].InstName
-	foundImageId, foundImageState, blockDeviceMappings, err := cldaws.GetImageInfoByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageName)
+	images, err := cldaws.GetImagesByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageName)
 	if err != nil {
 		return lb.Complete(err)
 	}
 
-	if foundImageId == "" {
-		return lb.Complete(nil)
+	for i := range images {
+		if snapshotLabel != "" && images[i].Label != snapshotLabel {
+			continue
+		}
+		if images[i].State == types.ImageStateDeregistered {
+			lb.Add(fmt.Sprintf("will not delete image %s for %s, already deregistred", images[i].Id, iNickname))
+			continue
+		}
+		if err := deleteSnapshotImageGeneration(p, lb, &images[i]); err != nil {
+			return lb.Complete(err)
+		}
 	}
 
-	if foundImageState == types.ImageStateDeregistered {
-		lb.Add(fmt.Sprintf("will not delete image for %s, already deregistred", iNickname))
-		return lb.Complete(nil)
+	return lb.Complete(nil)
+}
+
+// Copies the selected snapshot image generation (see selectSnapshotImage) with all its snapshots to another region,
+// so create_instances_from_snapshot_images can use it there. If kmsKeyId is specified, the copy is encrypted with it.
+func (p *AwsDeployProvider) CopySnapshotImage(iNickname string, imageSelector string, destRegion string, kmsKeyId string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, p.DeployCtx.IsVerbose)
+
+	sourceRegion := p.DeployCtx.Aws.Config.Region
+	if destRegion == sourceRegion {
+		return lb.Complete(fmt.Errorf("cannot copy snapshot image for %s, destination region %s is the same as source region", iNickname, destRegion))
+	}
+
+	imageName := p.DeployCtx.Project.Instances[iNickname].InstName
+	images, err := cldaws.GetImagesByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	image, err := selectSnapshotImage(images, imageName, imageSelector)
+	if err != nil {
+		return lb.Complete(err)
 	}
 
-	snapshotId := ""
+	destEc2Client := ec2.NewFromConfig(p.DeployCtx.Aws.Config, func(o *ec2.Options) { o.Region = destRegion })
+
+	destImages, err := cldaws.GetImagesByName(destEc2Client, p.DeployCtx.GoCtx, lb, imageName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+	for _, destImage := range destImages {
+		if destImage.Label == image.Label && destImage.State != types.ImageStateDeregistered {
+			lb.Add(fmt.Sprintf("will not copy snapshot image %s generation %s to %s, already there: %s", imageName, image.Label, destRegion, destImage.Id))
+			return lb.Complete(nil)
+		}
+	}
+
+	if kmsKeyId != "" {
+		destKmsClient := kms.NewFromConfig(p.DeployCtx.Aws.Config, func(o *kms.Options) { o.Region = destRegion })
+		if err := cldaws.VerifyKmsKey(destKmsClient, p.DeployCtx.GoCtx, lb, kmsKeyId); err != nil {
+			return lb.Complete(err)
+		}
+	}
+
+	destImageId, err := cldaws.CopyImage(destEc2Client, p.DeployCtx.GoCtx, lb, sourceRegion, image.Id, imageName+"-"+image.Label, kmsKeyId, p.DeployCtx.Project.Timeouts.CreateImage)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	// Image tags are copied, but snapshot tags are not
+	_, blockDeviceMappings, err := cldaws.GetImageInfoById(destEc2Client, p.DeployCtx.GoCtx, lb, destImageId)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	snapshotTags := map[string]string{
+		cldaws.ImageNicknameTagName:      iNickname,
+		cldaws.ImageSnapshotLabelTagName: image.Label}
+	for k, v := range p.DeployCtx.Tags {
+		snapshotTags[k] = v
+	}
 	for _, mapping := range blockDeviceMappings {
 		if mapping.Ebs != nil {
 			if mapping.Ebs.SnapshotId != nil && *mapping.Ebs.SnapshotId != "" {
-				snapshotId = *mapping.Ebs.SnapshotId
+				err = cldaws.TagResource(destEc2Client, p.DeployCtx.GoCtx, lb, *mapping.Ebs.SnapshotId, imageName, snapshotTags)
+				if err != nil {
+					return lb.Complete(err)
+				}
 			}
 		}
 	}
 
-	err = cldaws.DeregisterImage(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundImageId)
+	lb.Add(fmt.Sprintf("copied snapshot image %s(%s) generation %s to %s(%s)", imageName, image.Id, image.Label, destRegion, destImageId))
+
+	return lb.Complete(nil)
+}
+
+// Gives another account permission to launch the selected snapshot image generation and to create volumes from its snapshots.
+// Snapshots encrypted with the AWS managed key cannot be shared; for customer managed keys, the key policy must allow the account.
+func (p *AwsDeployProvider) ShareSnapshotImage(iNickname string, imageSelector string, accountId string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, p.DeployCtx.IsVerbose)
+
+	imageName := p.DeployCtx.Project.Instances[iNickname].InstName
+	images, err := cldaws.GetImagesByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, imageName)
 	if err != nil {
 		return lb.Complete(err)
 	}
 
-	// Now we can delete the snapshot
-	if snapshotId != "" {
-		err := cldaws.DeleteSnapshot(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, snapshotId)
+	image, err := selectSnapshotImage(images, imageName, imageSelector)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	// Check all snapshots before sharing anything
+	snapshotIds := make([]string, 0)
+	kmsKeyIds := map[string]struct{}{}
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping.Ebs != nil {
+			if mapping.Ebs.SnapshotId != nil && *mapping.Ebs.SnapshotId != "" {
+				kmsKeyId, err := cldaws.GetSnapshotKmsKeyId(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, *mapping.Ebs.SnapshotId)
+				if err != nil {
+					return lb.Complete(err)
+				}
+				if kmsKeyId != "" {
+					isAwsManaged, err := cldaws.IsAwsManagedKmsKey(p.DeployCtx.Aws.KmsClient, p.DeployCtx.GoCtx, lb, kmsKeyId)
+					if err != nil {
+						return lb.Complete(err)
+					}
+					if isAwsManaged {
+						return lb.Complete(fmt.Errorf("cannot share snapshot image %s(%s), snapshot %s is encrypted with AWS managed key %s, use a customer managed key", imageName, image.Id, *mapping.Ebs.SnapshotId, kmsKeyId))
+					}
+					kmsKeyIds[kmsKeyId] = struct{}{}
+				}
+				snapshotIds = append(snapshotIds, *mapping.Ebs.SnapshotId)
+			}
+		}
+	}
+
+	for _, snapshotId := range snapshotIds {
+		if err := cldaws.ShareSnapshot(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, snapshotId, accountId); err != nil {
+			return lb.Complete(err)
+		}
+	}
+
+	if err := cldaws.ShareImage(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, image.Id, accountId); err != nil {
+		return lb.Complete(err)
+	}
+
+	lb.AddAlways(fmt.Sprintf("shared snapshot image %s(%s) generation %s with account %s", imageName, image.Id, image.Label, accountId))
+	for kmsKeyId := range kmsKeyIds {
+		lb.AddAlways(fmt.Sprintf("make sure kms key %s policy allows account %s to use it (kms:Decrypt, kms:DescribeKey, kms:CreateGrant, kms:ReEncrypt*)", kmsKeyId, accountId))
+	}
+
+	return lb.Complete(nil)
+}
+
+// Stops services and the instance, changes instance type, starts it again and waits until it's healthy.
+// Supposed to be called for one instance at a time, so the rest of the cluster keeps working.
+// Instance store does not survive the stop: a Cassandra node with data there comes back empty and takes over
+// its own token ranges (replace_address), streaming the data from replicas, which requires replication factor > 1.
+func (p *AwsDeployProvider) ResizeInstance(iNickname string, flavorId string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, p.DeployCtx.IsVerbose)
+
+	iDef := p.DeployCtx.Project.Instances[iNickname]
+
+	// Before stopping anything: without other nodes there is nowhere to restore the data from
+	isCassReplacingItself := iDef.Purpose == string(prj.InstancePurposeCassandra) && iDef.InstanceStore != nil
+	if isCassReplacingItself {
+		if _, err := cassReplaceNodeEnvVars(p, iNickname); err != nil {
+			return lb.Complete(fmt.Errorf("cannot resize cassandra node %s, its data is on instance store and will be lost: %s", iNickname, err.Error()))
+		}
+	}
+
+	foundInstanceId, foundInstanceState, err := cldaws.GetInstanceIdAndStateByHostName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, iDef.InstName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	if foundInstanceId == "" {
+		return lb.Complete(fmt.Errorf("cannot resize instance %s, instance not found", iNickname))
+	}
+
+	if foundInstanceState != types.InstanceStateNameRunning &&
+		foundInstanceState != types.InstanceStateNameStopped {
+		return lb.Complete(fmt.Errorf("cannot resize instance %s, instance state is %s, expected running or stopped", iNickname, foundInstanceState))
+	}
+
+	foundInstanceType, err := cldaws.GetInstanceTypeById(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundInstanceId)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	if foundInstanceType == flavorId {
+		lb.Add(fmt.Sprintf("will not resize instance %s, it's already %s", iNickname, flavorId))
+		return lb.Complete(nil)
+	}
+
+	if foundInstanceState == types.InstanceStateNameRunning {
+		logMsg, err := rexec.ExecEmbeddedScriptsOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Stop, iDef.Service.Env, p.DeployCtx.Project.ScriptExecPolicy(iDef), p.DeployCtx.IsVerbose)
+		lb.Add(string(logMsg))
+		if err != nil {
+			return lb.Complete(err)
+		}
+	}
+
+	// Volumes are re-attached and re-mounted after the start, same way deployment_create_images/deployment_restore_instances do it
+	for volNickname := range iDef.Volumes {
+		logMsg, err := p.DetachVolume(iNickname, volNickname)
+		lb.Add(string(logMsg))
+		if err != nil {
+			return lb.Complete(err)
+		}
+	}
+
+	if foundInstanceState != types.InstanceStateNameStopped {
+		err = cldaws.StopInstance(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundInstanceId, p.DeployCtx.Project.Timeouts.StopInstance)
+		if err != nil {
+			return lb.Complete(err)
+		}
+	}
+
+	err = cldaws.ModifyInstanceType(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundInstanceId, flavorId)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	err = cldaws.StartInstance(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundInstanceId, p.DeployCtx.Project.Timeouts.StartInstance)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	logMsg, err := pingOneHost(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), p.DeployCtx.IsVerbose, 50)
+	lb.Add(string(logMsg))
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	for volNickname := range iDef.Volumes {
+		logMsg, err := p.AttachVolume(iNickname, volNickname)
+		lb.Add(string(logMsg))
+		if err != nil {
+			return lb.Complete(err)
+		}
+	}
+
+	// Instance store is gone after the stop
+	logMsg, err = p.InitInstanceStore(iNickname)
+	lb.Add(string(logMsg))
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	if isCassReplacingItself {
+		// Cassandra may have started on boot without its data dirs: stop it, re-create data dirs and
+		// start it as a replacement of itself (same as replace_instance), no start with the empty store before that.
+		// Env is built after InitInstanceStore, it has the new mount points.
+		cassReplaceEnvVars, err := cassReplaceNodeEnvVars(p, iNickname)
+		if err != nil {
+			return lb.Complete(err)
+		}
+		logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Stop, iDef.Service.Env, p.DeployCtx.Project.ScriptExecPolicy(iDef), p.DeployCtx.IsVerbose)
+		lb.Add(string(logMsg))
+		if err != nil {
+			return lb.Complete(err)
+		}
+		// Config starts Cassandra
+		logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Config, cassReplaceEnvVars, p.DeployCtx.Project.ScriptExecPolicy(iDef), p.DeployCtx.IsVerbose)
+		lb.Add(string(logMsg))
+		if err != nil {
+			return lb.Complete(err)
+		}
+	} else {
+		logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Start, iDef.Service.Env, p.DeployCtx.Project.ScriptExecPolicy(iDef), p.DeployCtx.IsVerbose)
+		lb.Add(string(logMsg))
 		if err != nil {
 			return lb.Complete(err)
 		}
 	}
 
+	if iDef.Purpose == string(prj.InstancePurposeCassandra) {
+		// Do not move on to the next node until this one is UN, streaming the data may take a while
+		return lb.Complete(waitForCassNodesJoined(p, lb, p.DeployCtx.Project.Instances))
+	}
+
+	// Do not move on to the next instance until this one is healthy
+	logMsg, err = rexec.ExecCommandOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), servicesHealthCheckCmd, p.DeployCtx.Project.Timeouts.RemoteCommand, p.DeployCtx.IsVerbose)
+	lb.Add(string(logMsg))
+	if err != nil {
+		return lb.Complete(fmt.Errorf("instance %s is not healthy after resize: %s", iNickname, err.Error()))
+	}
+
 	return lb.Complete(nil)
 }
+
+// Config env for a Cassandra node with empty data that takes over the token ranges of the node at its own address.
+// A seed node cannot replace itself, so the surviving nodes are seeds; the token comes from the node being replaced.
+func cassReplaceNodeEnvVars(p *AwsDeployProvider, iNickname string) (map[string]string, error) {
+	iDef := p.DeployCtx.Project.Instances[iNickname]
+	seedIps := make([]string, 0)
+	for _, otherNickname := range sortedNicknamesByPurpose(p.DeployCtx.Project.Instances, prj.InstancePurposeCassandra) {
+		if otherNickname != iNickname {
+			seedIps = append(seedIps, p.DeployCtx.Project.Instances[otherNickname].IpAddress)
+		}
+	}
+	if len(seedIps) == 0 {
+		return nil, fmt.Errorf("no other cassandra nodes to use as seeds")
+	}
+	envVars := map[string]string{}
+	for k, v := range iDef.Service.Env {
+		envVars[k] = v
+	}
+	envVars["CASSANDRA_SEEDS"] = strings.Join(seedIps, ",")
+	envVars["INITIAL_TOKEN"] = ""
+	envVars["CASSANDRA_REPLACE_ADDRESS"] = iDef.IpAddress
+	return envVars, nil
+}
+
+// Waits for systemd to finish starting units, fails if any of them failed
+const servicesHealthCheckCmd string = `systemctl is-system-running --wait > /dev/null
+failedUnits=$(systemctl list-units --state=failed --no-legend --plain)
+if [ -n "$failedUnits" ]; then
+  echo "failed units: $failedUnits" >&2
+  exit 1
+fi`
+
+// Terminates a broken instance and creates a fresh one with the same ip address and volumes, then installs, configures and starts services.
+// A Cassandra node is started with replace_address_first_boot, so it takes over the token ranges of the node it replaces.
+func (p *AwsDeployProvider) ReplaceInstance(iNickname string, flavorId string, imageId string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, p.DeployCtx.IsVerbose)
+
+	iDef := p.DeployCtx.Project.Instances[iNickname]
+
+	// Before terminating anything: a missing or stale baked image should not leave us without an instance
+	imageId, err := resolveBakedImageId(p, lb, iNickname, imageId)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	// The old instance is most likely unreachable, so do not bother stopping services and unmounting:
+	// AWS detaches volumes from a terminated instance
+	logMsg, err := p.DeleteInstance(iNickname, true)
+	lb.Add(string(logMsg))
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	for _, volDef := range iDef.Volumes {
+		foundVolIdByName, err := cldaws.GetVolumeIdByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, volDef.Name)
+		if err != nil {
+			return lb.Complete(err)
+		}
+		if foundVolIdByName == "" {
+			return lb.Complete(fmt.Errorf("cannot replace instance %s, volume %s not found", iNickname, volDef.Name))
+		}
+		err = cldaws.WaitForVolumeDetached(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundVolIdByName, p.DeployCtx.Project.Timeouts.DetachVolume)
+		if err != nil {
+			return lb.Complete(err)
+		}
+	}
+
+	subnetId, err := getInstanceSubnetId(p, lb, iNickname)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	sgId, err := getInstanceSecurityGroupId(p, lb, iNickname)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	err = internalCreate(p, lb, iNickname, flavorId, imageId, nil, subnetId, sgId)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	logMsg, err = pingOneHost(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), p.DeployCtx.IsVerbose, 50)
+	lb.Add(string(logMsg))
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	for volNickname := range iDef.Volumes {
+		logMsg, err := p.AttachVolume(iNickname, volNickname)
+		lb.Add(string(logMsg))
+		if err != nil {
+			return lb.Complete(err)
+		}
+	}
+
+	if iDef.UseBakedImage {
+		lb.Add(fmt.Sprintf("%s uses baked image, skipping install", iNickname))
+	} else {
+		logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Install, iDef.Service.Env, p.DeployCtx.Project.ScriptExecPolicy(iDef), p.DeployCtx.IsVerbose)
+		lb.Add(string(logMsg))
+		if err != nil {
+			return lb.Complete(err)
+		}
+	}
+
+	// After install: instance store owner (like cassandra) may be created by install scripts
+	logMsg, err = p.InitInstanceStore(iNickname)
+	lb.Add(string(logMsg))
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	if iDef.Purpose == string(prj.InstancePurposeCassandra) {
+		// Same as deployment_create: install starts Cassandra with default settings, stop it before config
+		logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Stop, iDef.Service.Env, p.DeployCtx.Project.ScriptExecPolicy(iDef), p.DeployCtx.IsVerbose)
+		lb.Add(string(logMsg))
+		if err != nil {
+			return lb.Complete(err)
+		}
+
+		envVars, err := cassReplaceNodeEnvVars(p, iNickname)
+		if err != nil {
+			return lb.Complete(fmt.Errorf("cannot replace cassandra node %s: %s", iNickname, err.Error()))
+		}
+
+		// Config starts Cassandra
+		logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Config, envVars, p.DeployCtx.Project.ScriptExecPolicy(iDef), p.DeployCtx.IsVerbose)
+		lb.Add(string(logMsg))
+		if err != nil {
+			return lb.Complete(err)
+		}
+
+		// Streaming the data may take a while
+		return lb.Complete(waitForCassNodesJoined(p, lb, p.DeployCtx.Project.Instances))
+	}
+
+	logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Config, iDef.Service.Env, p.DeployCtx.Project.ScriptExecPolicy(iDef), p.DeployCtx.IsVerbose)
+	lb.Add(string(logMsg))
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Start, iDef.Service.Env, p.DeployCtx.Project.ScriptExecPolicy(iDef), p.DeployCtx.IsVerbose)
+	lb.Add(string(logMsg))
+	return lb.Complete(err)
+}
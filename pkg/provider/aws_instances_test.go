@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+)
+
+func TestSelectSnapshotImage(t *testing.T) {
+	// Most recent first, like GetImagesByName returns them
+	images := []cldaws.ImageInfo{
+		{Id: "ami-pending", Label: "20240203T100000Z", State: types.ImageStatePending, CreationDate: time.Date(2024, 2, 3, 10, 0, 0, 0, time.UTC)},
+		{Id: "ami-feb2", Label: "before-upgrade", State: types.ImageStateAvailable, CreationDate: time.Date(2024, 2, 2, 23, 59, 0, 0, time.UTC)},
+		{Id: "ami-feb1", Label: "20240201T080000Z", State: types.ImageStateAvailable, CreationDate: time.Date(2024, 2, 1, 8, 0, 0, 0, time.UTC)},
+		{Id: "ami-jan", Label: "20240115T120000Z", State: types.ImageStateAvailable, CreationDate: time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)},
+	}
+
+	cases := []struct {
+		name        string
+		selector    string
+		expectedId  string
+		expectedErr string
+	}{
+		{"empty means latest available", "", "ami-feb2", ""},
+		{"latest skips pending", "latest", "ami-feb2", ""},
+		{"date includes the whole day", "2024-02-02", "ami-feb2", ""},
+		{"date picks latest on or before", "2024-02-01", "ami-feb1", ""},
+		{"date between generations", "2024-01-31", "ami-jan", ""},
+		{"date before all generations", "2024-01-01", "", "cannot find available snapshot image"},
+		{"exact label", "20240201T080000Z", "ami-feb1", ""},
+		{"custom label", "before-upgrade", "ami-feb2", ""},
+		{"pending label", "20240203T100000Z", "", "available: before-upgrade,20240201T080000Z,20240115T120000Z"},
+		{"unknown label", "no-such-label", "", "generation 'no-such-label'"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			image, err := selectSnapshotImage(images, "test-image", c.selector)
+			if c.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.expectedErr) {
+					t.Fatalf("expected error with '%s', got %v", c.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if image.Id != c.expectedId {
+				t.Fatalf("expected %s, got %s", c.expectedId, image.Id)
+			}
+		})
+	}
+
+	if _, err := selectSnapshotImage(nil, "test-image", "latest"); err == nil {
+		t.Fatalf("expected error for no generations")
+	}
+}
@@ -0,0 +1,42 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+// Host at these addresses is gone or replaced: drop its keys from the deployment known_hosts
+func forgetKnownHosts(p *AwsDeployProvider, lb *l.LogBuilder, ipAddresses []string) error {
+	for _, ipAddress := range ipAddresses {
+		if err := rexec.ForgetKnownHost(p.DeployCtx.Project.SshConfig, ipAddress); err != nil {
+			return err
+		}
+		if p.DeployCtx.Project.SshConfig.KnownHostsFilePath() != "" {
+			lb.Add(fmt.Sprintf("removed %s from %s", ipAddress, p.DeployCtx.Project.SshConfig.KnownHostsPath))
+		}
+	}
+	return nil
+}
+
+// A new instance may reuse addresses of a terminated one: forget old keys, so the new host is trusted on first use,
+// or, with host_keys_from_console_output, take the new keys from the instance console output
+func refreshKnownHosts(p *AwsDeployProvider, lb *l.LogBuilder, instanceId string, ipAddresses []string) error {
+	if !p.DeployCtx.Project.SshConfig.HostKeysFromConsoleOutput {
+		return forgetKnownHosts(p, lb, ipAddresses)
+	}
+
+	hostKeys, err := cldaws.GetInstanceSshHostKeysFromConsoleOutput(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, instanceId, p.DeployCtx.Project.Timeouts.ConsoleOutput)
+	if err != nil {
+		return err
+	}
+	for _, ipAddress := range ipAddresses {
+		if err := rexec.SetKnownHostKeys(p.DeployCtx.Project.SshConfig, ipAddress, hostKeys); err != nil {
+			return err
+		}
+		lb.Add(fmt.Sprintf("added %d host keys for %s(%s) from console output to %s", len(hostKeys), ipAddress, instanceId, p.DeployCtx.Project.SshConfig.KnownHostsPath))
+	}
+	return nil
+}
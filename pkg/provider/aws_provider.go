@@ -3,6 +3,7 @@ package provider
 import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld"
 )
@@ -13,6 +14,7 @@ type AwsCtx struct {
 	Config        aws.Config
 	Ec2Client     *ec2.Client
 	TaggingClient *resourcegroupstaggingapi.Client
+	KmsClient     *kms.Client
 }
 
 // Everything below is generic. This type will support DeployProvider (public) and deployProviderImpl (internal)
@@ -0,0 +1,36 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+// Root file system stays frozen at most this long even if capideploy does not come back to thaw it
+const noRebootFreezeSeconds int = 30
+
+// Flushes and freezes root file system, so the no-reboot image is consistent as of CreateImage call.
+// A detached watchdog thaws it after noRebootFreezeSeconds no matter what: new ssh logins may block on a frozen root.
+func freezeInstanceRootFs(p *AwsDeployProvider, lb *l.LogBuilder, iNickname string) error {
+	iDef := p.DeployCtx.Project.Instances[iNickname]
+	er := rexec.ExecSsh(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), fmt.Sprintf(`sudo sync
+sudo setsid sh -c 'sleep %d; fsfreeze --unfreeze / > /dev/null 2>&1' > /dev/null 2>&1 < /dev/null &
+sudo fsfreeze --freeze / 2>&1`, noRebootFreezeSeconds), map[string]string{}, p.DeployCtx.Project.Timeouts.RemoteCommand)
+	lb.Add(er.ToString())
+	if er.Error != nil {
+		return fmt.Errorf("cannot freeze root file system on %s before no-reboot snapshot image: %s", iNickname, er.Error.Error())
+	}
+	return nil
+}
+
+// Best effort: if it fails, the watchdog started by freezeInstanceRootFs thaws the file system anyways
+func thawInstanceRootFs(p *AwsDeployProvider, lb *l.LogBuilder, iNickname string) {
+	iDef := p.DeployCtx.Project.Instances[iNickname]
+	// Thaw must not outlive the watchdog
+	er := rexec.ExecSsh(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), "sudo fsfreeze --unfreeze / > /dev/null 2>&1 || true", map[string]string{}, noRebootFreezeSeconds)
+	lb.Add(er.ToString())
+	if er.Error != nil {
+		lb.AddAlways(fmt.Sprintf("cannot thaw root file system on %s, it will be thawed in %ds: %s", iNickname, noRebootFreezeSeconds, er.Error.Error()))
+	}
+}
@@ -0,0 +1,28 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+// SSM addresses instances by id, capideploy addresses them by ip. Lookup by address, not by project nickname:
+// bake_image builders are not in the project.
+func newSsmInstanceIdResolver(ec2Client *ec2.Client) rexec.SsmInstanceIdResolver {
+	return func(goCtx context.Context, ipAddress string) (string, error) {
+		// Errors are reported by the command that needed the id, AWS call details are not
+		lb := l.NewLogBuilder(l.CurFuncName()+":"+ipAddress, false)
+		instanceId, err := cldaws.GetInstanceIdByIpAddress(ec2Client, goCtx, lb, ipAddress)
+		if err != nil {
+			return "", err
+		}
+		if instanceId == "" {
+			return "", fmt.Errorf("no running instance with ip address %s", ipAddress)
+		}
+		return instanceId, nil
+	}
+}
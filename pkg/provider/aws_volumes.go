@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld/cldaws"
@@ -26,7 +27,7 @@ func (p *AwsDeployProvider) CreateVolume(iNickname string, volNickname string) (
 		return lb.Complete(nil)
 	}
 
-	_, err = cldaws.CreateVolume(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, volDef.Name, volDef.AvailabilityZone, int32(volDef.Size), volDef.Type)
+	_, err = cldaws.CreateVolume(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, volDef.Name, volDef.AvailabilityZone, int32(volDef.Size), volDef.Type, int32(volDef.Iops), int32(volDef.Throughput), "", volDef.Encrypted, volDef.KmsKeyId)
 	if err != nil {
 		return lb.Complete(err)
 	}
@@ -55,21 +56,11 @@ func volNicknameToAwsSuggestedDeviceName(volumes map[string]*prj.VolumeDef, volN
 	return "invalid-device-for-vol-" + volNickname
 }
 
-// Still used in micros
+// Still used in micros: Xen instances (t2, m4) name volumes /dev/xvdf etc
 func awsFinalDeviceNameOld(suggestedDeviceName string) string {
 	return strings.ReplaceAll(suggestedDeviceName, "/dev/sd", "/dev/xvd")
 }
 
-func awsFinalDeviceNameNitro(suggestedDeviceName string) string {
-	// See what lsblk shows for your case.
-	// This is very hacky, but I didn't spend time to do it the right way
-	deviceNameReplacer := strings.NewReplacer(
-		"/dev/sdf", "/dev/nvme1n1",
-		"/dev/sdg", "/dev/nvme2n1",
-		"/dev/sdh", "/dev/nvme3n1")
-	return deviceNameReplacer.Replace(suggestedDeviceName)
-}
-
 func (p *AwsDeployProvider) AttachVolume(iNickname string, volNickname string) (l.LogMsg, error) {
 	lb := l.NewLogBuilder(l.CurFuncName(), p.DeployCtx.IsVerbose)
 
@@ -109,28 +100,32 @@ func (p *AwsDeployProvider) AttachVolume(iNickname string, volNickname string) (
 		}
 	}
 
-	// Mount: xvd/nvme naming magic required, sdf/sdg/etc are not accepted here
-
-	// Older vol device naming vs Nitro
-	var finalDeviceNameToMount string
-	if strings.HasPrefix(p.DeployCtx.Project.Instances[iNickname].FlavorName, "t2.") ||
-		strings.HasPrefix(p.DeployCtx.Project.Instances[iNickname].FlavorName, "m4.") {
-		// /dev/sdf->/dev/xvdf etc
-		finalDeviceNameToMount = awsFinalDeviceNameOld(suggestedDevice)
-	} else {
-		// /dev/sdf->/dev/nvme1n1 etc
-		finalDeviceNameToMount = awsFinalDeviceNameNitro(suggestedDevice)
-	}
+	// Mount: sdf/sdg/etc are not accepted here, find the actual block device by volume id (NVMe serial) or by Xen name
 
 	deviceBlockId, er := rexec.ExecSshAndReturnLastLine(
+		p.DeployCtx.GoCtx,
 		p.DeployCtx.Project.SshConfig,
 		p.DeployCtx.Project.Instances[iNickname].BestIpAddress(),
-		fmt.Sprintf("%s\ninit_volume_attachment %s %s %d '%s'",
+		fmt.Sprintf(`%s
+%s
+deviceName=$(find_ebs_volume_device %s %s)
+if [ "$deviceName" = "" ]; then
+  lsblk -o NAME,SERIAL,SIZE,MOUNTPOINT
+  echo Error, cannot find block device for volume %s
+  exit 1
+fi
+init_volume_attachment $deviceName %s %d '%s' '%s' '%s'`,
+			cldaws.FindEbsVolumeDeviceFunc,
 			cldaws.InitVolumeAttachmentFunc,
-			finalDeviceNameToMount,
+			foundVolIdByName,
+			awsFinalDeviceNameOld(suggestedDevice),
+			foundVolIdByName,
 			volDef.MountPoint,
 			volDef.Permissions,
-			volDef.Owner))
+			volDef.Owner,
+			volDef.FsType,
+			volDef.MountOptions),
+		p.DeployCtx.Project.Timeouts.RemoteCommand)
 	lb.Add(er.ToString())
 	if er.Error != nil {
 		return lb.Complete(fmt.Errorf("cannot mount volume %s to instance %s: %s", volNickname, iNickname, er.Error.Error()))
@@ -171,9 +166,11 @@ func (p *AwsDeployProvider) DetachVolume(iNickname string, volNickname string) (
 	// Unmount
 
 	er := rexec.ExecSsh(
+		p.DeployCtx.GoCtx,
 		p.DeployCtx.Project.SshConfig,
 		p.DeployCtx.Project.Instances[iNickname].BestIpAddress(),
-		fmt.Sprintf("sudo umount -d %s", volDef.MountPoint), map[string]string{})
+		fmt.Sprintf("sudo umount -d %s", volDef.MountPoint), map[string]string{},
+		p.DeployCtx.Project.Timeouts.RemoteCommand)
 	lb.Add(er.ToString())
 	if er.Error != nil {
 		return lb.Complete(fmt.Errorf("cannot umount volume %s on instance %s: %s", volNickname, iNickname, er.Error.Error()))
@@ -205,3 +202,188 @@ func (p *AwsDeployProvider) DeleteVolume(iNickname string, volNickname string) (
 
 	return lb.Complete(cldaws.DeleteVolume(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundVolIdByName))
 }
+
+// Snapshots the volume and removes snapshots beyond volDef.BackupGenerations
+func (p *AwsDeployProvider) BackupVolume(iNickname string, volNickname string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname+":"+volNickname, p.DeployCtx.IsVerbose)
+
+	volDef := p.DeployCtx.Project.Instances[iNickname].Volumes[volNickname]
+
+	foundVolIdByName, err := cldaws.GetVolumeIdByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, volDef.Name)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	if foundVolIdByName == "" {
+		return lb.Complete(fmt.Errorf("cannot backup volume %s, volume not found", volDef.Name))
+	}
+
+	foundDevice, _, err := cldaws.GetVolumeAttachedDeviceById(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundVolIdByName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	if foundDevice != "" {
+		// Snapshot is crash-consistent, at least flush what we can
+		er := rexec.ExecSsh(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, p.DeployCtx.Project.Instances[iNickname].BestIpAddress(), "sync", map[string]string{}, p.DeployCtx.Project.Timeouts.RemoteCommand)
+		lb.Add(er.ToString())
+		if er.Error != nil {
+			return lb.Complete(fmt.Errorf("cannot sync volume %s on instance %s: %s", volNickname, iNickname, er.Error.Error()))
+		}
+	}
+
+	snapshotLabel := time.Now().UTC().Format("20060102T150405Z")
+	snapshotTags := map[string]string{
+		cldaws.VolumeNameTagName:          volDef.Name,
+		cldaws.VolumeSnapshotLabelTagName: snapshotLabel}
+	for k, v := range p.DeployCtx.Tags {
+		snapshotTags[k] = v
+	}
+
+	_, err = cldaws.CreateVolumeSnapshot(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, snapshotTags, lb, volDef.Name+"_"+snapshotLabel, foundVolIdByName, p.DeployCtx.Project.Timeouts.CreateSnapshot)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	if volDef.BackupGenerations == 0 {
+		return lb.Complete(nil)
+	}
+
+	snapshots, err := cldaws.GetVolumeSnapshotsByVolumeName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, volDef.Name)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	for i := volDef.BackupGenerations; i < len(snapshots); i++ {
+		if err := cldaws.DeleteSnapshot(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, snapshots[i].Id); err != nil {
+			return lb.Complete(err)
+		}
+		lb.Add(fmt.Sprintf("deleted old snapshot %s(%s) of volume %s", snapshots[i].Label, snapshots[i].Id, volDef.Name))
+	}
+
+	return lb.Complete(nil)
+}
+
+// Creates the volume from the snapshot with the specified label, or from the latest one if the label is empty.
+// The volume must not exist: run detach_volumes and delete_volumes first.
+func (p *AwsDeployProvider) RestoreVolume(iNickname string, volNickname string, snapshotLabel string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname+":"+volNickname, p.DeployCtx.IsVerbose)
+
+	volDef := p.DeployCtx.Project.Instances[iNickname].Volumes[volNickname]
+
+	foundVolIdByName, err := cldaws.GetVolumeIdByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, volDef.Name)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	if foundVolIdByName != "" {
+		return lb.Complete(fmt.Errorf("cannot restore volume %s, it already exists (%s), detach and delete it first", volDef.Name, foundVolIdByName))
+	}
+
+	snapshots, err := cldaws.GetVolumeSnapshotsByVolumeName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, volDef.Name)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	var snapshotToRestore *cldaws.VolumeSnapshotInfo
+	for i := range snapshots {
+		if snapshots[i].State == types.SnapshotStateCompleted && (snapshotLabel == "" || snapshots[i].Label == snapshotLabel) {
+			snapshotToRestore = &snapshots[i]
+			break
+		}
+	}
+
+	if snapshotToRestore == nil {
+		availableLabels := make([]string, len(snapshots))
+		for i, snapshot := range snapshots {
+			availableLabels[i] = fmt.Sprintf("%s(%s)", snapshot.Label, snapshot.State)
+		}
+		return lb.Complete(fmt.Errorf("cannot restore volume %s, no completed snapshot with label '%s' found, available: %s", volDef.Name, snapshotLabel, strings.Join(availableLabels, ",")))
+	}
+
+	lb.Add(fmt.Sprintf("restoring volume %s from snapshot %s(%s)", volDef.Name, snapshotToRestore.Label, snapshotToRestore.Id))
+
+	volId, err := cldaws.CreateVolume(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, p.DeployCtx.Tags, lb, volDef.Name, volDef.AvailabilityZone, int32(volDef.Size), volDef.Type, int32(volDef.Iops), int32(volDef.Throughput), snapshotToRestore.Id, volDef.Encrypted, volDef.KmsKeyId)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	return lb.Complete(cldaws.WaitForVolumeAvailable(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, volId, p.DeployCtx.Project.Timeouts.CreateVolume))
+}
+
+// Grows the volume to volDef.Size and, if it's attached, grows its filesystem. Shrinking is not supported by AWS.
+func (p *AwsDeployProvider) ResizeVolume(iNickname string, volNickname string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname+":"+volNickname, p.DeployCtx.IsVerbose)
+
+	volDef := p.DeployCtx.Project.Instances[iNickname].Volumes[volNickname]
+
+	foundVolIdByName, err := cldaws.GetVolumeIdByName(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, volDef.Name)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	if foundVolIdByName == "" {
+		return lb.Complete(fmt.Errorf("cannot resize volume %s, volume not found", volDef.Name))
+	}
+
+	liveSize, err := cldaws.GetVolumeSizeById(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundVolIdByName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	if int32(volDef.Size) < liveSize {
+		return lb.Complete(fmt.Errorf("cannot resize volume %s from %dGB to %dGB, shrinking is not supported", volDef.Name, liveSize, volDef.Size))
+	}
+
+	if int32(volDef.Size) > liveSize {
+		err = cldaws.ModifyVolumeSize(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundVolIdByName, int32(volDef.Size), p.DeployCtx.Project.Timeouts.ModifyVolume)
+		if err != nil {
+			return lb.Complete(err)
+		}
+	} else {
+		// Maybe the previous attempt resized the volume, but failed to grow the filesystem
+		lb.Add(fmt.Sprintf("volume %s is already %dGB", volDef.Name, liveSize))
+	}
+
+	foundDevice, _, err := cldaws.GetVolumeAttachedDeviceById(p.DeployCtx.Aws.Ec2Client, p.DeployCtx.GoCtx, lb, foundVolIdByName)
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	if foundDevice == "" {
+		lb.Add(fmt.Sprintf("volume %s not attached, filesystem will be used as is on attach", volDef.Name))
+		return lb.Complete(nil)
+	}
+
+	suggestedDevice := volNicknameToAwsSuggestedDeviceName(p.DeployCtx.Project.Instances[iNickname].Volumes, volNickname)
+
+	lastLine, er := rexec.ExecSshAndReturnLastLine(
+		p.DeployCtx.GoCtx,
+		p.DeployCtx.Project.SshConfig,
+		p.DeployCtx.Project.Instances[iNickname].BestIpAddress(),
+		fmt.Sprintf(`%s
+%s
+deviceName=$(find_ebs_volume_device %s %s)
+if [ "$deviceName" = "" ]; then
+  echo Error, cannot find block device for volume %s
+  exit 1
+fi
+grow_volume_filesystem $deviceName %s`,
+			cldaws.FindEbsVolumeDeviceFunc,
+			cldaws.GrowVolumeFilesystemFunc,
+			foundVolIdByName,
+			awsFinalDeviceNameOld(suggestedDevice),
+			foundVolIdByName,
+			volDef.MountPoint),
+		p.DeployCtx.Project.Timeouts.RemoteCommand)
+	lb.Add(er.ToString())
+	if er.Error != nil {
+		return lb.Complete(fmt.Errorf("cannot grow filesystem of volume %s on instance %s: %s", volNickname, iNickname, er.Error.Error()))
+	}
+
+	if strings.HasPrefix(lastLine, "Error") {
+		return lb.Complete(fmt.Errorf("cannot grow filesystem of volume %s on instance %s: %s", volNickname, iNickname, lastLine))
+	}
+
+	return lb.Complete(nil)
+}
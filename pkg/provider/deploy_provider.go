@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -13,7 +14,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/capillariesio/capillaries-deploy/pkg/cld"
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
@@ -52,6 +55,21 @@ const (
 	CmdCreateInstancesFromSnapshotImages string = "create_instances_from_snapshot_images"
 	CmdDeleteSnapshotImages              string = "delete_snapshot_images"
 	CmdCheckCassStatus                   string = "check_cassandra_status"
+	CmdResizeInstances                   string = "resize_instances"
+	CmdScaleOut                          string = "scale_out"
+	CmdReplaceInstance                   string = "replace_instance"
+	CmdReapExpired                       string = "reap_expired"
+	CmdBackupVolumes                     string = "backup_volumes"
+	CmdRestoreVolumes                    string = "restore_volumes"
+	CmdResizeVolumes                     string = "resize_volumes"
+	CmdCopySnapshotImages                string = "copy_snapshot_images"
+	CmdShareSnapshotImages               string = "share_snapshot_images"
+	CmdBakeImage                         string = "bake_image"
+	CmdSsh                               string = "ssh"
+	CmdForward                           string = "forward"
+	CmdExec                              string = "exec"
+	CmdExportSshConfig                   string = "export_ssh_config"
+	CmdExportInventory                   string = "export_inventory"
 )
 
 type StopOnFailType int
@@ -66,6 +84,19 @@ type ExecArgs struct {
 	Verbosity             bool
 	NumberOfRepetitions   int
 	ShowProjectDetails    bool
+	ReportOnly            bool
+	SnapshotLabel         string // Snapshot image generation
+	VolumeSnapshotLabel   string
+	Region                string
+	Account               string
+	KmsKeyId              string
+	NoReboot              bool
+	StreamOutput          bool
+	ForwardLocalPort      int
+	ExecCommand           string
+	ExecScriptFile        string
+	OutputPath            string
+	InventoryFormat       string
 }
 
 type CombinedCmdCall struct {
@@ -129,7 +160,24 @@ func IsCmdRequiresNicknames(cmd string) bool {
 		cmd == CmdPingInstances ||
 		cmd == CmdCreateSnapshotImages ||
 		cmd == CmdCreateInstancesFromSnapshotImages ||
-		cmd == CmdDeleteSnapshotImages
+		cmd == CmdDeleteSnapshotImages ||
+		cmd == CmdCopySnapshotImages ||
+		cmd == CmdShareSnapshotImages ||
+		cmd == CmdResizeInstances ||
+		cmd == CmdScaleOut ||
+		cmd == CmdReplaceInstance ||
+		cmd == CmdBackupVolumes ||
+		cmd == CmdRestoreVolumes ||
+		cmd == CmdResizeVolumes ||
+		cmd == CmdBakeImage ||
+		cmd == CmdSsh ||
+		cmd == CmdForward ||
+		cmd == CmdExec
+}
+
+// Commands that work across deployments, they find everything they need by tags
+func IsCmdRequiresProject(cmd string) bool {
+	return cmd != CmdReapExpired
 }
 
 type DeployCtx struct {
@@ -167,6 +215,11 @@ func genericListDeploymentResources(p deployProviderImpl, cOut chan<- string, cE
 }
 
 func genericExecCmdWithNoResult(p deployProviderImpl, cmd string, nicknames string, execArgs *ExecArgs, cOut chan<- string, cErr chan<- string) error {
+	if execArgs.StreamOutput {
+		deployCtx := p.getDeployCtx()
+		deployCtx.GoCtx = rexec.WithOutputStream(deployCtx.GoCtx, &rexec.OutputStream{OutChan: cOut, ErrChan: cErr, HostName: deployCtx.Project.NicknameByIpAddress})
+	}
+
 	if combinedCmdCallSeq, ok := combinedCmdCallSeqMap[cmd]; ok {
 		for _, combinedCmdCallSeq := range combinedCmdCallSeq {
 			err := execSimpleParallelCmd(p, combinedCmdCallSeq.Cmd, combinedCmdCallSeq.Nicknames, execArgs, cOut, cErr)
@@ -175,11 +228,185 @@ func genericExecCmdWithNoResult(p deployProviderImpl, cmd string, nicknames stri
 			}
 		}
 		return nil
+	} else if cmd == CmdScaleOut {
+		return execScaleOut(p, nicknames, execArgs, cOut, cErr)
+	} else if cmd == CmdSsh {
+		return execInteractiveShell(p, nicknames, cOut, cErr)
+	} else if cmd == CmdForward {
+		return execForward(p, nicknames, execArgs.ForwardLocalPort, cOut, cErr)
+	} else if cmd == CmdExec {
+		return execCommandOnInstances(p, nicknames, execArgs, cOut, cErr)
+	} else if cmd == CmdExportSshConfig {
+		return execExportSshConfig(p, execArgs, cOut, cErr)
+	} else if cmd == CmdExportInventory {
+		return execExportInventory(p, execArgs, cOut, cErr)
+	} else if cmd == CmdReapExpired {
+		cmdStartTs := time.Now()
+		logMsg, err := p.ReapExpiredDeployments(execArgs.ReportOnly)
+		cOut <- string(logMsg)
+		if err != nil {
+			cErr <- err.Error()
+			cOut <- fmt.Sprintf("%s %sERROR%s, elapsed %.3fs", cmd, l.LogColorRed, l.LogColorReset, time.Since(cmdStartTs).Seconds())
+			return err
+		}
+		cOut <- fmt.Sprintf("%s %sOK%s, elapsed %.3fs", cmd, l.LogColorGreen, l.LogColorReset, time.Since(cmdStartTs).Seconds())
+		return nil
+	} else if cmd == CmdReplaceInstance {
+		if err := execSimpleParallelCmd(p, cmd, nicknames, execArgs, cOut, cErr); err != nil {
+			return err
+		}
+		// Make sure the replaced node (or its replacement) did not break the cluster
+		if len(sortedNicknamesByPurpose(p.getDeployCtx().Project.Instances, prj.InstancePurposeCassandra)) > 0 {
+			return execSimpleParallelCmd(p, CmdCheckCassStatus, "", execArgs, cOut, cErr)
+		}
+		return nil
 	} else {
 		return execSimpleParallelCmd(p, cmd, nicknames, execArgs, cOut, cErr)
 	}
 }
 
+// Customer-managed KMS keys used by root disks and/or data volumes of these instances
+func harvestKmsKeys(instances map[string]*prj.InstanceDef, rootVolumes bool, dataVolumes bool) map[string]struct{} {
+	kmsKeyMap := map[string]struct{}{}
+	for _, iDef := range instances {
+		if rootVolumes && iDef.RootVolume != nil && iDef.RootVolume.KmsKeyId != "" {
+			kmsKeyMap[iDef.RootVolume.KmsKeyId] = struct{}{}
+		}
+		if dataVolumes {
+			for _, volDef := range iDef.Volumes {
+				if volDef.KmsKeyId != "" {
+					kmsKeyMap[volDef.KmsKeyId] = struct{}{}
+				}
+			}
+		}
+	}
+	return kmsKeyMap
+}
+
+func sortedNicknamesByPurpose(instances map[string]*prj.InstanceDef, purposes ...prj.InstancePurpose) []string {
+	result := make([]string, 0)
+	for iNickname, iDef := range instances {
+		for _, purpose := range purposes {
+			if iDef.Purpose == string(purpose) {
+				result = append(result, iNickname)
+				break
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Creates selected instances that do not exist yet, bootstraps new Cassandra nodes one by one,
+// cleans up old Cassandra nodes and re-configures everything that keeps a list of Cassandra hosts.
+// The project file is expected to describe the cluster after the scale-out.
+func execScaleOut(p deployProviderImpl, nicknames string, execArgs *ExecArgs, cOut chan<- string, cErr chan<- string) error {
+	cmdStartTs := time.Now()
+
+	if len(nicknames) == 0 {
+		err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
+		cErr <- err.Error()
+		return err
+	}
+
+	project := p.getDeployCtx().Project
+
+	instances, err := filterByNickname(nicknames, project.Instances, "instance")
+	if err != nil {
+		cErr <- err.Error()
+		return err
+	}
+
+	existingMap := map[string]bool{}
+	for iNickname := range project.Instances {
+		existingMap[iNickname] = false
+	}
+	logMsg, err := p.HarvestExistingInstances(existingMap)
+	cOut <- string(logMsg)
+	if err != nil {
+		cErr <- err.Error()
+		return err
+	}
+
+	newInstances := map[string]*prj.InstanceDef{}
+	for iNickname, iDef := range instances {
+		if !existingMap[iNickname] {
+			newInstances[iNickname] = iDef
+		}
+	}
+	if len(newInstances) == 0 {
+		cOut <- fmt.Sprintf("%s: all selected instances already exist, nothing to scale out", CmdScaleOut)
+		return nil
+	}
+
+	oldCassInstances := map[string]*prj.InstanceDef{}
+	for iNickname, iDef := range project.Instances {
+		if existingMap[iNickname] {
+			oldCassInstances[iNickname] = iDef
+		}
+	}
+	oldCassNicknames := sortedNicknamesByPurpose(oldCassInstances, prj.InstancePurposeCassandra)
+	newCassNicknames := sortedNicknamesByPurpose(newInstances, prj.InstancePurposeCassandra)
+	if len(newCassNicknames) > 0 && len(oldCassNicknames) == 0 {
+		err := fmt.Errorf("cannot scale out cassandra cluster, no existing cassandra nodes found; use %s for a new deployment", CmdDeploymentCreate)
+		cErr <- err.Error()
+		return err
+	}
+
+	newNicknames := make([]string, 0, len(newInstances))
+	for iNickname := range newInstances {
+		newNicknames = append(newNicknames, iNickname)
+	}
+	sort.Strings(newNicknames)
+	strNewNicknames := strings.Join(newNicknames, ",")
+	cOut <- fmt.Sprintf("%s: new instances %s", CmdScaleOut, strNewNicknames)
+
+	for _, cmd := range []string{CmdCreateVolumes, CmdCreateInstances, CmdPingInstances, CmdAttachVolumes, CmdInstallServices} {
+		if err := execSimpleParallelCmd(p, cmd, strNewNicknames, execArgs, cOut, cErr); err != nil {
+			return err
+		}
+	}
+
+	if len(newCassNicknames) > 0 {
+		strNewCassNicknames := strings.Join(newCassNicknames, ",")
+		if err := execSimpleParallelCmd(p, CmdStopServices, strNewCassNicknames, execArgs, cOut, cErr); err != nil {
+			return err
+		}
+
+		// One node at a time: Cassandra does not allow bootstrapping more than one node simultaneously
+		clusterNicknames := oldCassNicknames
+		for _, iNickname := range newCassNicknames {
+			logMsg, err := p.BootstrapCassNode(iNickname, clusterNicknames)
+			cOut <- string(logMsg)
+			if err != nil {
+				cErr <- err.Error()
+				return err
+			}
+			clusterNicknames = append(clusterNicknames, iNickname)
+		}
+
+		for _, iNickname := range oldCassNicknames {
+			logMsg, err := p.CleanupCassNode(iNickname)
+			cOut <- string(logMsg)
+			if err != nil {
+				cErr <- err.Error()
+				return err
+			}
+		}
+	}
+
+	// Daemons, webapi (bastion) and Prometheus have Cassandra hosts in their config
+	reconfigNicknames := sortedNicknamesByPurpose(project.Instances, prj.InstancePurposeBastion, prj.InstancePurposeDaemon, prj.InstancePurposePrometheus)
+	if len(reconfigNicknames) > 0 {
+		if err := execSimpleParallelCmd(p, CmdConfigServices, strings.Join(reconfigNicknames, ","), execArgs, cOut, cErr); err != nil {
+			return err
+		}
+	}
+
+	cOut <- fmt.Sprintf("%s %sOK%s, elapsed %.3fs", CmdScaleOut, l.LogColorGreen, l.LogColorReset, time.Since(cmdStartTs).Seconds())
+	return nil
+}
+
 type AssumeRoleConfig struct {
 	// AWS members:
 	RoleArn    string `json:"role_arn"`
@@ -202,6 +429,7 @@ func DeployProviderFactory(project *prj.Project, goCtx context.Context, assumeRo
 			return nil, err
 		}
 
+		ownerArn := *callerIdentityOutBefore.Arn
 		if assumeRoleCfg != nil && assumeRoleCfg.RoleArn != "" {
 			creds := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), assumeRoleCfg.RoleArn,
 				func(o *stscreds.AssumeRoleOptions) {
@@ -223,23 +451,52 @@ func DeployProviderFactory(project *prj.Project, goCtx context.Context, assumeRo
 				cErr <- err.Error()
 				return nil, err
 			}
+			ownerArn = *callerIdentityOutAfter.Arn
 			cOut <- fmt.Sprintf("Caller identity (role assumed): %s", *callerIdentityOutAfter.Arn)
 		} else {
 			cOut <- fmt.Sprintf("Caller identity (no role assumed): %s", *callerIdentityOutBefore.Arn)
 		}
 
+		// Restoring in another region: availability zones from the project are not valid there
+		if project.ApplyRegionOverride(cfg.Region) {
+			cOut <- fmt.Sprintf("Using region_overrides for %s", cfg.Region)
+		}
+
+		// Every resource created in this run gets the same owner/created/expires tags, so reap_expired can find forgotten deployments
+		createdAt := time.Now().UTC()
+		tags := map[string]string{
+			cld.DeploymentNameTagName:      project.DeploymentName,
+			cld.DeploymentOperatorTagName:  cld.DeploymentOperatorTagValue,
+			cld.DeploymentOwnerTagName:     ownerArn,
+			cld.DeploymentCreatedAtTagName: createdAt.Format(cld.DeploymentTimestampLayout)}
+		if project.Ttl != "" {
+			ttl, err := time.ParseDuration(project.Ttl)
+			if err != nil {
+				err = fmt.Errorf("cannot parse project ttl %s: %s", project.Ttl, err.Error())
+				cErr <- err.Error()
+				return nil, err
+			}
+			tags[cld.DeploymentExpiresAtTagName] = createdAt.Add(ttl).Format(cld.DeploymentTimestampLayout)
+		}
+
+		awsCtx := &AwsCtx{
+			Config:        cfg,
+			Ec2Client:     ec2.NewFromConfig(cfg),
+			TaggingClient: resourcegroupstaggingapi.NewFromConfig(cfg),
+			KmsClient:     kms.NewFromConfig(cfg),
+		}
+
+		if project.SshConfig != nil && project.SshConfig.Transport == rexec.TransportSsm {
+			project.SshConfig.SetTransport(rexec.NewSsmTransport(ssm.NewFromConfig(cfg), project.SshConfig.User, newSsmInstanceIdResolver(awsCtx.Ec2Client)))
+		}
+
 		return &AwsDeployProvider{
 			DeployCtx: &DeployCtx{
 				Project:   project,
 				GoCtx:     goCtx,
 				IsVerbose: isVerbose,
-				Tags: map[string]string{
-					cld.DeploymentNameTagName:     project.DeploymentName,
-					cld.DeploymentOperatorTagName: cld.DeploymentOperatorTagValue},
-				Aws: &AwsCtx{
-					Ec2Client:     ec2.NewFromConfig(cfg),
-					TaggingClient: resourcegroupstaggingapi.NewFromConfig(cfg),
-				},
+				Tags:      tags,
+				Aws:       awsCtx,
 			},
 		}, nil
 	}
@@ -250,7 +507,10 @@ const MaxWorkerThreads int = 50
 
 type SingleThreadCmdHandler func() (l.LogMsg, error)
 
-func pingOneHost(sshConfig *rexec.SshConfigDef, ipAddress string, verbosity bool, numberOfRepetitions int) (l.LogMsg, error) {
+// "id" should return right away, if it does not, the host is not ready
+const pingTimeoutSeconds int = 30
+
+func pingOneHost(goCtx context.Context, sshConfig *rexec.SshConfigDef, ipAddress string, verbosity bool, numberOfRepetitions int) (l.LogMsg, error) {
 	var err error
 	var logMsg l.LogMsg
 
@@ -262,14 +522,18 @@ func pingOneHost(sshConfig *rexec.SshConfigDef, ipAddress string, verbosity bool
 	lb := l.NewLogBuilder(l.CurFuncName()+" "+ipAddress, verbosity)
 
 	for {
-		logMsg, err = rexec.ExecCommandOnInstance(sshConfig, ipAddress, "id", verbosity)
+		logMsg, err = rexec.ExecCommandOnInstance(goCtx, sshConfig, ipAddress, "id", pingTimeoutSeconds, verbosity)
 		lb.Add(string(logMsg))
 		repetitions--
 		if err == nil || repetitions == 0 {
 			break
 		}
 		lb.Add(err.Error())
-		time.Sleep(5 * time.Second)
+		select {
+		case <-goCtx.Done():
+			return lb.Complete(fmt.Errorf("cancelled while pinging %s: %s", ipAddress, goCtx.Err().Error()))
+		case <-time.After(5 * time.Second):
+		}
 	}
 
 	return lb.Complete(err)
@@ -343,7 +607,9 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 		cmd == CmdDeleteInstances ||
 		cmd == CmdCreateSnapshotImages ||
 		cmd == CmdCreateInstancesFromSnapshotImages ||
-		cmd == CmdDeleteSnapshotImages {
+		cmd == CmdDeleteSnapshotImages ||
+		cmd == CmdCopySnapshotImages ||
+		cmd == CmdShareSnapshotImages {
 		if len(nicknames) == 0 {
 			err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
 			cErr <- err.Error()
@@ -399,9 +665,12 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 				return err
 			}
 
-			cOut <- "Creating instances, consider clearing known_hosts to avoid ssh complaints:"
-			for _, i := range instances {
-				cOut <- fmt.Sprintf("ssh-keygen -f ~/.ssh/known_hosts -R %s;", i.BestIpAddress())
+			// Make sure root disk encryption keys are usable
+			logMsg, err = deployProvider.VerifyKmsKeys(harvestKmsKeys(instances, true, false))
+			cOut <- string(logMsg)
+			if err != nil {
+				cErr <- err.Error()
+				return err
 			}
 		}
 
@@ -444,11 +713,23 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 				}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname)
 			}
 		case CmdCreateSnapshotImages:
+			// No-reboot images need ssh access to freeze file systems
+			for _, instDef := range instances {
+				if execArgs.NoReboot || instDef.SnapshotNoReboot {
+					logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
+					cOut <- string(logMsgBastionIp)
+					if err != nil {
+						cErr <- err.Error()
+						return err
+					}
+					break
+				}
+			}
 			for iNickname := range instances {
 				<-throttle.C
 				sem <- 1
 				go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string) {
-					logMsg, err := deployProvider.CreateSnapshotImage(iNickname)
+					logMsg, err := deployProvider.CreateSnapshotImage(iNickname, execArgs.SnapshotLabel, execArgs.NoReboot)
 					logChan <- string(logMsg)
 					errChan <- err
 					<-sem
@@ -460,7 +741,8 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 				sem <- 1
 				go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string) {
 					logMsg, err := deployProvider.CreateInstanceFromSnapshotImageAndWaitForCompletion(iNickname,
-						usedFlavors[deployProvider.getDeployCtx().Project.Instances[iNickname].FlavorName])
+						usedFlavors[deployProvider.getDeployCtx().Project.Instances[iNickname].FlavorName],
+						execArgs.SnapshotLabel)
 					logChan <- string(logMsg)
 					errChan <- err
 					<-sem
@@ -471,7 +753,39 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 				<-throttle.C
 				sem <- 1
 				go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string) {
-					logMsg, err := deployProvider.DeleteSnapshotImage(iNickname)
+					logMsg, err := deployProvider.DeleteSnapshotImage(iNickname, execArgs.SnapshotLabel)
+					logChan <- string(logMsg)
+					errChan <- err
+					<-sem
+				}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname)
+			}
+		case CmdCopySnapshotImages:
+			if execArgs.Region == "" {
+				err := fmt.Errorf("cannot copy snapshot images, specify destination region")
+				cErr <- err.Error()
+				return err
+			}
+			for iNickname := range instances {
+				<-throttle.C
+				sem <- 1
+				go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string) {
+					logMsg, err := deployProvider.CopySnapshotImage(iNickname, execArgs.SnapshotLabel, execArgs.Region, execArgs.KmsKeyId)
+					logChan <- string(logMsg)
+					errChan <- err
+					<-sem
+				}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname)
+			}
+		case CmdShareSnapshotImages:
+			if execArgs.Account == "" {
+				err := fmt.Errorf("cannot share snapshot images, specify account id")
+				cErr <- err.Error()
+				return err
+			}
+			for iNickname := range instances {
+				<-throttle.C
+				sem <- 1
+				go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string) {
+					logMsg, err := deployProvider.ShareSnapshotImage(iNickname, execArgs.SnapshotLabel, execArgs.Account)
 					logChan <- string(logMsg)
 					errChan <- err
 					<-sem
@@ -482,6 +796,144 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 			cErr <- err.Error()
 			return err
 		}
+	} else if cmd == CmdResizeInstances {
+		if len(nicknames) == 0 {
+			err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
+			cErr <- err.Error()
+			return err
+		}
+
+		instances, err := filterByNickname(nicknames, deployProvider.getDeployCtx().Project.Instances, "instance")
+		if err != nil {
+			cErr <- err.Error()
+			return err
+		}
+
+		logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
+		cOut <- string(logMsgBastionIp)
+		if err != nil {
+			cErr <- err.Error()
+			return err
+		}
+
+		usedFlavors := map[string]string{}
+		for _, instDef := range instances {
+			usedFlavors[instDef.FlavorName] = ""
+		}
+		logMsg, err := deployProvider.HarvestInstanceTypesByFlavorNames(usedFlavors)
+		cOut <- string(logMsg)
+		if err != nil {
+			cErr <- err.Error()
+			return err
+		}
+
+		// Rolling: one instance at a time, in predictable order, stop on the first failure
+		sortedNicknames := make([]string, 0, len(instances))
+		for iNickname := range instances {
+			sortedNicknames = append(sortedNicknames, iNickname)
+		}
+		sort.Strings(sortedNicknames)
+
+		errorsExpected = 1
+		errChan = make(chan error, errorsExpected)
+		sem <- 1
+		go func() {
+			for _, iNickname := range sortedNicknames {
+				logMsg, err := deployProvider.ResizeInstance(iNickname, usedFlavors[instances[iNickname].FlavorName])
+				cOut <- string(logMsg)
+				if err != nil {
+					errChan <- err
+					<-sem
+					return
+				}
+			}
+			errChan <- nil
+			<-sem
+		}()
+	} else if cmd == CmdReplaceInstance {
+		if len(nicknames) == 0 || strings.Contains(nicknames, ",") || strings.Contains(nicknames, "*") {
+			err := fmt.Errorf("expected exactly one instance to replace, got '%s'", nicknames)
+			cErr <- err.Error()
+			return err
+		}
+
+		instDef, ok := deployProvider.getDeployCtx().Project.Instances[nicknames]
+		if !ok {
+			err := fmt.Errorf("definition for instance '%s' not found", nicknames)
+			cErr <- err.Error()
+			return err
+		}
+
+		logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
+		cOut <- string(logMsgBastionIp)
+		if err != nil {
+			cErr <- err.Error()
+			return err
+		}
+
+		// Make sure image/flavor/keypair are there before terminating anything
+		usedFlavors := map[string]string{instDef.FlavorName: ""}
+		logMsg, err := deployProvider.HarvestInstanceTypesByFlavorNames(usedFlavors)
+		cOut <- string(logMsg)
+		if err != nil {
+			cErr <- err.Error()
+			return err
+		}
+
+		logMsg, err = deployProvider.HarvestImageIds(map[string]bool{instDef.ImageId: false})
+		cOut <- string(logMsg)
+		if err != nil {
+			cErr <- err.Error()
+			return err
+		}
+
+		logMsg, err = deployProvider.VerifyKeypairs(map[string]struct{}{instDef.RootKeyName: {}})
+		cOut <- string(logMsg)
+		if err != nil {
+			cErr <- err.Error()
+			return err
+		}
+
+		logMsg, err = deployProvider.VerifyKmsKeys(harvestKmsKeys(map[string]*prj.InstanceDef{nicknames: instDef}, true, false))
+		cOut <- string(logMsg)
+		if err != nil {
+			cErr <- err.Error()
+			return err
+		}
+
+		errorsExpected = 1
+		errChan = make(chan error, errorsExpected)
+		sem <- 1
+		go func() {
+			logMsg, err := deployProvider.ReplaceInstance(nicknames, usedFlavors[instDef.FlavorName], instDef.ImageId)
+			cOut <- string(logMsg)
+			errChan <- err
+			<-sem
+		}()
+	} else if cmd == CmdBakeImage {
+		if len(nicknames) == 0 || strings.Contains(nicknames, ",") || strings.Contains(nicknames, "*") {
+			err := fmt.Errorf("expected exactly one instance purpose to bake image for, got '%s'", nicknames)
+			cErr <- err.Error()
+			return err
+		}
+
+		// Builder is in the private subnet, ssh goes through bastion
+		logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
+		cOut <- string(logMsgBastionIp)
+		if err != nil {
+			cErr <- err.Error()
+			return err
+		}
+
+		errorsExpected = 1
+		errChan = make(chan error, errorsExpected)
+		sem <- 1
+		go func() {
+			logMsg, err := deployProvider.BakeImage(nicknames)
+			cOut <- string(logMsg)
+			errChan <- err
+			<-sem
+		}()
 	} else if cmd == CmdPingInstances ||
 		cmd == CmdInstallServices ||
 		cmd == CmdConfigServices ||
@@ -508,33 +960,41 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 
 		errorsExpected = len(instances)
 		errChan = make(chan error, len(instances))
-		for _, iDef := range instances {
+		for iNickname, iDef := range instances {
 			<-throttle.C
 			sem <- 1
-			go func(prj *prj.Project, logChan chan<- string, errChan chan<- error, iDef *prj.InstanceDef) {
+			go func(prj *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string, iDef *prj.InstanceDef) {
 				var logMsg l.LogMsg
 				var err error
 				switch cmd {
 				case CmdPingInstances:
-					logMsg, err = pingOneHost(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), execArgs.Verbosity, execArgs.NumberOfRepetitions)
+					logMsg, err = pingOneHost(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), execArgs.Verbosity, execArgs.NumberOfRepetitions)
 
 				case CmdInstallServices:
 					// Make sure ping passes
-					logMsg, err = pingOneHost(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), execArgs.Verbosity, 5)
+					logMsg, err = pingOneHost(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), execArgs.Verbosity, 5)
 
-					// If ping passed, it's ok to move on
+					// If ping passed, it's ok to move on; baked images have everything installed already
 					if err == nil {
-						logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Install, iDef.Service.Env, execArgs.Verbosity)
+						if iDef.UseBakedImage {
+							logMsg = l.LogMsg(fmt.Sprintf("%s uses baked image, skipping install", iNickname))
+						} else {
+							logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Install, iDef.Service.Env, deployProvider.getDeployCtx().Project.ScriptExecPolicy(iDef), execArgs.Verbosity)
+						}
 					}
 
 				case CmdConfigServices:
-					logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Config, iDef.Service.Env, execArgs.Verbosity)
+					// Instance store mount points go to service env variables
+					logMsg, err = deployProvider.InitInstanceStore(iNickname)
+					if err == nil {
+						logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Config, iDef.Service.Env, deployProvider.getDeployCtx().Project.ScriptExecPolicy(iDef), execArgs.Verbosity)
+					}
 
 				case CmdStartServices:
-					logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Start, iDef.Service.Env, execArgs.Verbosity)
+					logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Start, iDef.Service.Env, deployProvider.getDeployCtx().Project.ScriptExecPolicy(iDef), execArgs.Verbosity)
 
 				case CmdStopServices:
-					logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Stop, iDef.Service.Env, execArgs.Verbosity)
+					logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(deployProvider.getDeployCtx().GoCtx, deployProvider.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Stop, iDef.Service.Env, deployProvider.getDeployCtx().Project.ScriptExecPolicy(iDef), execArgs.Verbosity)
 
 				default:
 					err = fmt.Errorf("unknown service command:%s", cmd)
@@ -543,10 +1003,10 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 				logChan <- string(logMsg)
 				errChan <- err
 				<-sem
-			}(deployProvider.getDeployCtx().Project, cOut, errChan, iDef)
+			}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname, iDef)
 		}
 
-	} else if cmd == CmdCreateVolumes || cmd == CmdAttachVolumes || cmd == CmdDetachVolumes || cmd == CmdDeleteVolumes {
+	} else if cmd == CmdCreateVolumes || cmd == CmdAttachVolumes || cmd == CmdDetachVolumes || cmd == CmdDeleteVolumes || cmd == CmdBackupVolumes || cmd == CmdRestoreVolumes || cmd == CmdResizeVolumes {
 		if len(nicknames) == 0 {
 			err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
 			cErr <- err.Error()
@@ -559,6 +1019,25 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 			return err
 		}
 
+		// Once for all volumes: backup and resize talk to instances
+		if cmd == CmdBackupVolumes || cmd == CmdResizeVolumes {
+			logMsgBastionIp, err := deployProvider.PopulateInstanceExternalAddressByName()
+			cOut <- string(logMsgBastionIp)
+			if err != nil {
+				cErr <- err.Error()
+				return err
+			}
+		}
+
+		if cmd == CmdCreateVolumes || cmd == CmdRestoreVolumes {
+			logMsg, err := deployProvider.VerifyKmsKeys(harvestKmsKeys(instances, false, true))
+			cOut <- string(logMsg)
+			if err != nil {
+				cErr <- err.Error()
+				return err
+			}
+		}
+
 		volCount := 0
 		for _, iDef := range instances {
 			volCount += len(iDef.Volumes)
@@ -614,6 +1093,27 @@ func execSimpleParallelCmd(deployProvider deployProviderImpl, cmd string, nickna
 						errChan <- err
 						<-sem
 					}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname, volNickname)
+				case CmdBackupVolumes:
+					go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string, volNickname string) {
+						logMsg, err := deployProvider.BackupVolume(iNickname, volNickname)
+						logChan <- string(logMsg)
+						errChan <- err
+						<-sem
+					}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname, volNickname)
+				case CmdResizeVolumes:
+					go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string, volNickname string) {
+						logMsg, err := deployProvider.ResizeVolume(iNickname, volNickname)
+						logChan <- string(logMsg)
+						errChan <- err
+						<-sem
+					}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname, volNickname)
+				case CmdRestoreVolumes:
+					go func(project *prj.Project, logChan chan<- string, errChan chan<- error, iNickname string, volNickname string) {
+						logMsg, err := deployProvider.RestoreVolume(iNickname, volNickname, execArgs.VolumeSnapshotLabel)
+						logChan <- string(logMsg)
+						errChan <- err
+						<-sem
+					}(deployProvider.getDeployCtx().Project, cOut, errChan, iNickname, volNickname)
 				default:
 					err := fmt.Errorf("unknown cmd %s", cmd)
 					cErr <- err.Error()
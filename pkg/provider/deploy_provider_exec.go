@@ -0,0 +1,134 @@
+package provider
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+type instanceExecResult struct {
+	iNickname string
+	ipAddress string
+	er        rexec.ExecResult
+}
+
+// All output of one host in one piece, so parallel hosts do not interleave
+func (r *instanceExecResult) toOutputBlock() string {
+	sb := strings.Builder{}
+	status := fmt.Sprintf("%sexit %d%s", l.LogColorGreen, r.er.ExitStatus, l.LogColorReset)
+	if r.er.Error != nil {
+		status = fmt.Sprintf("%s%s%s", l.LogColorRed, r.er.Error.Error(), l.LogColorReset)
+	}
+	sb.WriteString(fmt.Sprintf("=== %s (%s): %s, elapsed %.3fs\n", r.iNickname, r.ipAddress, status, r.er.Elapsed))
+	if r.er.Stdout != "" {
+		sb.WriteString(strings.TrimRight(r.er.Stdout, "\n") + "\n")
+	}
+	if r.er.Stderr != "" {
+		sb.WriteString("--- stderr:\n")
+		sb.WriteString(strings.TrimRight(r.er.Stderr, "\n") + "\n")
+	}
+	return sb.String()
+}
+
+func execResultsSummary(results []*instanceExecResult) string {
+	sort.Slice(results, func(i, j int) bool { return results[i].iNickname < results[j].iNickname })
+	sb := strings.Builder{}
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tIP\tEXIT\tELAPSED\tERROR")
+	for _, r := range results {
+		exitStatus := "-"
+		if r.er.ExitStatus >= 0 {
+			exitStatus = fmt.Sprintf("%d", r.er.ExitStatus)
+		}
+		errString := ""
+		if r.er.Error != nil {
+			errString = strings.SplitN(r.er.Error.Error(), "\n", 2)[0]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.3fs\t%s\n", r.iNickname, r.ipAddress, exitStatus, r.er.Elapsed, errString)
+	}
+	w.Flush()
+	return sb.String()
+}
+
+// One-off command or local script file on a group of instances, in parallel. Output is grouped per instance,
+// followed by the table of exit codes. Fails if the command fails on any instance.
+func execCommandOnInstances(p deployProviderImpl, nicknames string, execArgs *ExecArgs, cOut chan<- string, cErr chan<- string) error {
+	cmdStartTs := time.Now()
+
+	if len(nicknames) == 0 {
+		err := fmt.Errorf("not enough args, expected comma-separated list of instances or '*'")
+		cErr <- err.Error()
+		return err
+	}
+
+	if (execArgs.ExecCommand == "") == (execArgs.ExecScriptFile == "") {
+		err := fmt.Errorf("expected either a command after -- or a local script file in -script, but not both")
+		cErr <- err.Error()
+		return err
+	}
+	remoteCmd := execArgs.ExecCommand
+	if execArgs.ExecScriptFile != "" {
+		scriptBytes, err := os.ReadFile(execArgs.ExecScriptFile)
+		if err != nil {
+			err = fmt.Errorf("cannot read script file %s: %s", execArgs.ExecScriptFile, err.Error())
+			cErr <- err.Error()
+			return err
+		}
+		remoteCmd = string(scriptBytes)
+	}
+
+	instances, err := filterByNickname(nicknames, p.getDeployCtx().Project.Instances, "instance")
+	if err != nil {
+		cErr <- err.Error()
+		return err
+	}
+
+	logMsgBastionIp, err := p.PopulateInstanceExternalAddressByName()
+	cOut <- string(logMsgBastionIp)
+	if err != nil {
+		cErr <- err.Error()
+		return err
+	}
+
+	throttle := time.NewTicker(time.Second)
+	defer throttle.Stop()
+	var sem = make(chan int, MaxWorkerThreads)
+	resultChan := make(chan *instanceExecResult, len(instances))
+	for iNickname, iDef := range instances {
+		<-throttle.C
+		sem <- 1
+		go func(iNickname string, ipAddress string) {
+			er := rexec.ExecSsh(p.getDeployCtx().GoCtx, p.getDeployCtx().Project.SshConfig, ipAddress, remoteCmd, map[string]string{}, p.getDeployCtx().Project.Timeouts.RemoteCommand)
+			resultChan <- &instanceExecResult{iNickname, ipAddress, er}
+			<-sem
+		}(iNickname, iDef.BestIpAddress())
+	}
+
+	results := make([]*instanceExecResult, 0, len(instances))
+	failedCount := 0
+	for len(results) < len(instances) {
+		r := <-resultChan
+		cOut <- r.toOutputBlock()
+		if r.er.Error != nil {
+			failedCount++
+		}
+		results = append(results, r)
+	}
+
+	cOut <- execResultsSummary(results)
+
+	if failedCount > 0 {
+		err := fmt.Errorf("command failed on %d of %d instances", failedCount, len(instances))
+		cErr <- err.Error()
+		cOut <- fmt.Sprintf("%s %sERROR%s, elapsed %.3fs", CmdExec, l.LogColorRed, l.LogColorReset, time.Since(cmdStartTs).Seconds())
+		return err
+	}
+	cOut <- fmt.Sprintf("%s %sOK%s, elapsed %.3fs", CmdExec, l.LogColorGreen, l.LogColorReset, time.Since(cmdStartTs).Seconds())
+	return nil
+}
@@ -0,0 +1,271 @@
+package provider
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/l"
+	"github.com/capillariesio/capillaries-deploy/pkg/prj"
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+const (
+	InventoryFormatIni  string = "ini"
+	InventoryFormatYaml string = "yaml"
+)
+
+// Instances without purpose go to this inventory group
+const inventoryGroupOther string = "other"
+
+func sortedInstanceNicknames(instances map[string]*prj.InstanceDef) []string {
+	nicknames := make([]string, 0, len(instances))
+	for iNickname := range instances {
+		nicknames = append(nicknames, iNickname)
+	}
+	sort.Strings(nicknames)
+	return nicknames
+}
+
+func bastionNickname(project *prj.Project) (string, error) {
+	for _, iNickname := range sortedInstanceNicknames(project.Instances) {
+		if project.Instances[iNickname].ExternalIpAddressName == project.SshConfig.BastionExternalIpAddressName {
+			return iNickname, nil
+		}
+	}
+	return "", fmt.Errorf("none of the instances uses bastion external ip address %s", project.SshConfig.BastionExternalIpAddressName)
+}
+
+func isEmbeddedPrivateKey(privateKeyOrPath string) bool {
+	return strings.Contains(privateKeyOrPath, "-----BEGIN")
+}
+
+// Capideploy known_hosts is reused, so ssh and capideploy trust the same host keys
+func sshHostKeyOptions(sshConfig *rexec.SshConfigDef) (string, string) {
+	knownHostsPath := sshConfig.KnownHostsFilePath()
+	if knownHostsPath == "" {
+		return "/dev/null", "no"
+	}
+	if sshConfig.HostKeysFromConsoleOutput {
+		return knownHostsPath, "yes"
+	}
+	return knownHostsPath, "accept-new"
+}
+
+func quoteSshConfigValue(v string) string {
+	if strings.ContainsAny(v, " \t") {
+		return `"` + v + `"`
+	}
+	return v
+}
+
+// OpenSSH client config with one Host entry per instance nickname, internal instances go through bastion with ProxyJump
+func buildSshConfig(project *prj.Project) (string, error) {
+	bastionNickname, err := bastionNickname(project)
+	if err != nil {
+		return "", err
+	}
+	knownHostsPath, strictHostKeyChecking := sshHostKeyOptions(project.SshConfig)
+
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("# Generated by capideploy %s for deployment %s at %s, bastion %s\n",
+		CmdExportSshConfig, project.DeploymentName, time.Now().UTC().Format(time.RFC3339), project.SshConfig.BastionExternalIp))
+	for _, iNickname := range sortedInstanceNicknames(project.Instances) {
+		iDef := project.Instances[iNickname]
+		sb.WriteString(fmt.Sprintf("\nHost %s\n", iNickname))
+		sb.WriteString(fmt.Sprintf("  HostName %s\n", iDef.BestIpAddress()))
+		sb.WriteString(fmt.Sprintf("  User %s\n", project.SshConfig.User))
+		sb.WriteString(fmt.Sprintf("  Port %d\n", project.SshConfig.Port))
+		if isEmbeddedPrivateKey(project.SshConfig.PrivateKeyOrPath) {
+			sb.WriteString("  # Private key is embedded in the project, add it to ssh-agent\n")
+		} else {
+			sb.WriteString(fmt.Sprintf("  IdentityFile %s\n", quoteSshConfigValue(rexec.ExpandHomePath(project.SshConfig.PrivateKeyOrPath))))
+			sb.WriteString("  IdentitiesOnly yes\n")
+		}
+		sb.WriteString(fmt.Sprintf("  UserKnownHostsFile %s\n", quoteSshConfigValue(knownHostsPath)))
+		sb.WriteString(fmt.Sprintf("  StrictHostKeyChecking %s\n", strictHostKeyChecking))
+		if iDef.ExternalIpAddressName == "" {
+			sb.WriteString(fmt.Sprintf("  ProxyJump %s\n", bastionNickname))
+		}
+	}
+	return sb.String(), nil
+}
+
+type inventoryHost struct {
+	nickname  string
+	ipAddress string
+	proxied   bool
+}
+
+// Purpose short name -> hosts, sorted by nickname
+func inventoryGroups(project *prj.Project) ([]string, map[string][]inventoryHost) {
+	groups := map[string][]inventoryHost{}
+	for _, iNickname := range sortedInstanceNicknames(project.Instances) {
+		iDef := project.Instances[iNickname]
+		groupName := inventoryGroupOther
+		if iDef.Purpose != "" {
+			groupName = prj.InstancePurpose(iDef.Purpose).ShortName()
+		}
+		groups[groupName] = append(groups[groupName], inventoryHost{iNickname, iDef.BestIpAddress(), iDef.ExternalIpAddressName == ""})
+	}
+	groupNames := make([]string, 0, len(groups))
+	for groupName := range groups {
+		groupNames = append(groupNames, groupName)
+	}
+	sort.Strings(groupNames)
+	return groupNames, groups
+}
+
+// Ansible passes these to ssh as is. ProxyCommand instead of ProxyJump: the jump connection needs the key and known_hosts too.
+func inventorySshCommonArgs(project *prj.Project, proxied bool) string {
+	knownHostsPath, strictHostKeyChecking := sshHostKeyOptions(project.SshConfig)
+	hostKeyArgs := fmt.Sprintf("-o UserKnownHostsFile=%s -o StrictHostKeyChecking=%s", knownHostsPath, strictHostKeyChecking)
+	if !proxied {
+		return hostKeyArgs
+	}
+	identityArg := ""
+	if !isEmbeddedPrivateKey(project.SshConfig.PrivateKeyOrPath) {
+		identityArg = fmt.Sprintf("-i %s ", rexec.ExpandHomePath(project.SshConfig.PrivateKeyOrPath))
+	}
+	return fmt.Sprintf(`%s -o ProxyCommand="ssh -W %%h:%%p %s%s -p %d %s@%s"`,
+		hostKeyArgs, identityArg, hostKeyArgs, project.SshConfig.Port, project.SshConfig.User, project.SshConfig.BastionExternalIp)
+}
+
+func buildInventoryIni(project *prj.Project) string {
+	groupNames, groups := inventoryGroups(project)
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("# Generated by capideploy %s for deployment %s at %s\n",
+		CmdExportInventory, project.DeploymentName, time.Now().UTC().Format(time.RFC3339)))
+	for _, groupName := range groupNames {
+		sb.WriteString(fmt.Sprintf("\n[%s]\n", groupName))
+		for _, host := range groups[groupName] {
+			sb.WriteString(fmt.Sprintf("%s ansible_host=%s ansible_ssh_common_args='%s'\n", host.nickname, host.ipAddress, inventorySshCommonArgs(project, host.proxied)))
+		}
+	}
+	sb.WriteString("\n[all:vars]\n")
+	sb.WriteString(fmt.Sprintf("ansible_user=%s\n", project.SshConfig.User))
+	sb.WriteString(fmt.Sprintf("ansible_port=%d\n", project.SshConfig.Port))
+	if !isEmbeddedPrivateKey(project.SshConfig.PrivateKeyOrPath) {
+		sb.WriteString(fmt.Sprintf("ansible_ssh_private_key_file=%s\n", rexec.ExpandHomePath(project.SshConfig.PrivateKeyOrPath)))
+	}
+	return sb.String()
+}
+
+// YAML single-quoted scalar: only the quote itself needs escaping
+func yamlQuote(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+}
+
+func buildInventoryYaml(project *prj.Project) string {
+	groupNames, groups := inventoryGroups(project)
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("# Generated by capideploy %s for deployment %s at %s\n",
+		CmdExportInventory, project.DeploymentName, time.Now().UTC().Format(time.RFC3339)))
+	sb.WriteString("all:\n")
+	sb.WriteString("  vars:\n")
+	sb.WriteString(fmt.Sprintf("    ansible_user: %s\n", yamlQuote(project.SshConfig.User)))
+	sb.WriteString(fmt.Sprintf("    ansible_port: %d\n", project.SshConfig.Port))
+	if !isEmbeddedPrivateKey(project.SshConfig.PrivateKeyOrPath) {
+		sb.WriteString(fmt.Sprintf("    ansible_ssh_private_key_file: %s\n", yamlQuote(rexec.ExpandHomePath(project.SshConfig.PrivateKeyOrPath))))
+	}
+	sb.WriteString("  children:\n")
+	for _, groupName := range groupNames {
+		sb.WriteString(fmt.Sprintf("    %s:\n", groupName))
+		sb.WriteString("      hosts:\n")
+		for _, host := range groups[groupName] {
+			sb.WriteString(fmt.Sprintf("        %s:\n", host.nickname))
+			sb.WriteString(fmt.Sprintf("          ansible_host: %s\n", yamlQuote(host.ipAddress)))
+			sb.WriteString(fmt.Sprintf("          ansible_ssh_common_args: %s\n", yamlQuote(inventorySshCommonArgs(project, host.proxied))))
+		}
+	}
+	return sb.String()
+}
+
+func writeExportFile(outputPath string, content string) error {
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0700); err != nil {
+		return fmt.Errorf("cannot create directory for %s: %s", outputPath, err.Error())
+	}
+	if err := os.WriteFile(outputPath, []byte(content), 0600); err != nil {
+		return fmt.Errorf("cannot write %s: %s", outputPath, err.Error())
+	}
+	return nil
+}
+
+// Deployment-scoped ssh config, to be included from ~/.ssh/config
+func execExportSshConfig(p deployProviderImpl, execArgs *ExecArgs, cOut chan<- string, cErr chan<- string) error {
+	cmdStartTs := time.Now()
+	project := p.getDeployCtx().Project
+
+	logMsgBastionIp, err := p.PopulateInstanceExternalAddressByName()
+	cOut <- string(logMsgBastionIp)
+	if err != nil {
+		cErr <- err.Error()
+		return err
+	}
+
+	sshConfigContent, err := buildSshConfig(project)
+	if err != nil {
+		cErr <- err.Error()
+		return err
+	}
+
+	outputPath := execArgs.OutputPath
+	if outputPath == "" {
+		outputPath = fmt.Sprintf("~/.capideploy/%s_ssh_config", project.DeploymentName)
+	}
+	outputPath = rexec.ExpandHomePath(outputPath)
+	if err := writeExportFile(outputPath, sshConfigContent); err != nil {
+		cErr <- err.Error()
+		return err
+	}
+
+	cOut <- fmt.Sprintf("ssh config written to %s, add this line to the top of ~/.ssh/config to use it:\nInclude %s", outputPath, outputPath)
+	cOut <- fmt.Sprintf("%s %sOK%s, elapsed %.3fs", CmdExportSshConfig, l.LogColorGreen, l.LogColorReset, time.Since(cmdStartTs).Seconds())
+	return nil
+}
+
+// Ansible inventory grouped by instance purpose, to stdout or to a file
+func execExportInventory(p deployProviderImpl, execArgs *ExecArgs, cOut chan<- string, cErr chan<- string) error {
+	project := p.getDeployCtx().Project
+
+	format := execArgs.InventoryFormat
+	if format == "" {
+		format = InventoryFormatIni
+	}
+	if format != InventoryFormatIni && format != InventoryFormatYaml {
+		err := fmt.Errorf("unknown inventory format %s, expected %s or %s", format, InventoryFormatIni, InventoryFormatYaml)
+		cErr <- err.Error()
+		return err
+	}
+
+	logMsgBastionIp, err := p.PopulateInstanceExternalAddressByName()
+	if err != nil {
+		cOut <- string(logMsgBastionIp)
+		cErr <- err.Error()
+		return err
+	}
+
+	var inventoryContent string
+	if format == InventoryFormatYaml {
+		inventoryContent = buildInventoryYaml(project)
+	} else {
+		inventoryContent = buildInventoryIni(project)
+	}
+
+	// Without output file, stdout has the inventory only, so it can be redirected
+	if execArgs.OutputPath == "" {
+		cOut <- inventoryContent
+		return nil
+	}
+
+	outputPath := rexec.ExpandHomePath(execArgs.OutputPath)
+	if err := writeExportFile(outputPath, inventoryContent); err != nil {
+		cErr <- err.Error()
+		return err
+	}
+	cOut <- fmt.Sprintf("inventory written to %s", outputPath)
+	return nil
+}
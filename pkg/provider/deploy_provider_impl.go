@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/capillariesio/capillaries-deploy/pkg/cld"
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
@@ -24,17 +25,31 @@ type deployProviderImpl interface {
 	HarvestInstanceTypesByFlavorNames(flavorMap map[string]string) (l.LogMsg, error)
 	HarvestImageIds(imageMap map[string]bool) (l.LogMsg, error)
 	VerifyKeypairs(keypairMap map[string]struct{}) (l.LogMsg, error)
+	VerifyKmsKeys(kmsKeyMap map[string]struct{}) (l.LogMsg, error)
 	CreateInstanceAndWaitForCompletion(iNickname string, flavorId string, imageId string) (l.LogMsg, error)
 	DeleteInstance(iNickname string, ignoreAttachedVolumes bool) (l.LogMsg, error)
-	CreateSnapshotImage(iNickname string) (l.LogMsg, error)
-	CreateInstanceFromSnapshotImageAndWaitForCompletion(iNickname string, flavorId string) (l.LogMsg, error)
-	DeleteSnapshotImage(iNickname string) (l.LogMsg, error)
+	CreateSnapshotImage(iNickname string, snapshotLabel string, noReboot bool) (l.LogMsg, error)
+	CreateInstanceFromSnapshotImageAndWaitForCompletion(iNickname string, flavorId string, imageSelector string) (l.LogMsg, error)
+	DeleteSnapshotImage(iNickname string, snapshotLabel string) (l.LogMsg, error)
+	CopySnapshotImage(iNickname string, imageSelector string, destRegion string, kmsKeyId string) (l.LogMsg, error)
+	ShareSnapshotImage(iNickname string, imageSelector string, accountId string) (l.LogMsg, error)
 	CreateVolume(iNickname string, volNickname string) (l.LogMsg, error)
 	AttachVolume(iNickname string, volNickname string) (l.LogMsg, error)
+	InitInstanceStore(iNickname string) (l.LogMsg, error)
 	DetachVolume(iNickname string, volNickname string) (l.LogMsg, error)
 	DeleteVolume(iNickname string, volNickname string) (l.LogMsg, error)
+	BackupVolume(iNickname string, volNickname string) (l.LogMsg, error)
+	RestoreVolume(iNickname string, volNickname string, snapshotLabel string) (l.LogMsg, error)
+	ResizeVolume(iNickname string, volNickname string) (l.LogMsg, error)
 	PopulateInstanceExternalAddressByName() (l.LogMsg, error)
 	CheckCassStatus() (l.LogMsg, error)
+	ResizeInstance(iNickname string, flavorId string) (l.LogMsg, error)
+	HarvestExistingInstances(existingMap map[string]bool) (l.LogMsg, error)
+	BootstrapCassNode(iNickname string, clusterNicknames []string) (l.LogMsg, error)
+	CleanupCassNode(iNickname string) (l.LogMsg, error)
+	ReplaceInstance(iNickname string, flavorId string, imageId string) (l.LogMsg, error)
+	BakeImage(purposeName string) (l.LogMsg, error)
+	ReapExpiredDeployments(reportOnly bool) (l.LogMsg, error)
 }
 
 func isAllNodesJoined(strOut string, instances map[string]*prj.InstanceDef) error {
@@ -54,13 +69,13 @@ func isAllNodesJoined(strOut string, instances map[string]*prj.InstanceDef) erro
 	return nil
 }
 
-func (p *AwsDeployProvider) CheckCassStatus() (l.LogMsg, error) {
-	for _, iDef := range p.DeployCtx.Project.Instances {
+func checkCassNodesJoined(p *AwsDeployProvider, nodes map[string]*prj.InstanceDef) (l.LogMsg, error) {
+	for _, iDef := range nodes {
 		if iDef.Purpose == string(prj.InstancePurposeCassandra) {
-			logMsg, err := rexec.ExecCommandOnInstance(p.DeployCtx.Project.SshConfig, iDef.IpAddress, "nodetool describecluster;nodetool status", true)
+			logMsg, err := rexec.ExecCommandOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.IpAddress, "nodetool describecluster;nodetool status", p.DeployCtx.Project.Timeouts.RemoteCommand, true)
 			if err == nil {
 				// All Cassandra nodes must have "UN  $cassNodeIp"
-				err = isAllNodesJoined(string(logMsg), p.DeployCtx.Project.Instances)
+				err = isAllNodesJoined(string(logMsg), nodes)
 			}
 			if p.DeployCtx.IsVerbose {
 				return logMsg, err
@@ -72,3 +87,82 @@ func (p *AwsDeployProvider) CheckCassStatus() (l.LogMsg, error) {
 
 	return "", fmt.Errorf("cannot find even a single cassandra node")
 }
+
+func (p *AwsDeployProvider) CheckCassStatus() (l.LogMsg, error) {
+	return checkCassNodesJoined(p, p.DeployCtx.Project.Instances)
+}
+
+func waitForCassNodesJoined(p *AwsDeployProvider, lb *l.LogBuilder, nodes map[string]*prj.InstanceDef) error {
+	startWaitTs := time.Now()
+	for {
+		logMsg, err := checkCassNodesJoined(p, nodes)
+		lb.Add(string(logMsg))
+		if err == nil {
+			return nil
+		}
+		lb.Add(err.Error())
+		if time.Since(startWaitTs).Seconds() > float64(p.DeployCtx.Project.Timeouts.CassandraJoin) {
+			return fmt.Errorf("giving up after waiting for cassandra nodes to join the cluster: %s", err.Error())
+		}
+		select {
+		case <-p.DeployCtx.GoCtx.Done():
+			return fmt.Errorf("cancelled while waiting for cassandra nodes to join the cluster: %s", p.DeployCtx.GoCtx.Err().Error())
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// Configures and starts a new node that is not a seed, so Cassandra bootstraps it: streams its token range from existing nodes.
+// Waits until the new node and all nodes in clusterNicknames show UN.
+func (p *AwsDeployProvider) BootstrapCassNode(iNickname string, clusterNicknames []string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, p.DeployCtx.IsVerbose)
+
+	iDef := p.DeployCtx.Project.Instances[iNickname]
+
+	nodes := map[string]*prj.InstanceDef{iNickname: iDef}
+	seedIps := make([]string, 0, len(clusterNicknames))
+	for _, clusterNickname := range clusterNicknames {
+		clusterDef, ok := p.DeployCtx.Project.Instances[clusterNickname]
+		if !ok || clusterDef.Purpose != string(prj.InstancePurposeCassandra) {
+			return lb.Complete(fmt.Errorf("cannot bootstrap %s, %s is not a cassandra node", iNickname, clusterNickname))
+		}
+		nodes[clusterNickname] = clusterDef
+		seedIps = append(seedIps, clusterDef.IpAddress)
+	}
+	if len(seedIps) == 0 {
+		return lb.Complete(fmt.Errorf("cannot bootstrap %s, no existing cassandra nodes to use as seeds", iNickname))
+	}
+
+	// Instance store mount points go to service env variables, config needs them for data dirs
+	logMsg, err := p.InitInstanceStore(iNickname)
+	lb.Add(string(logMsg))
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	// Project env has seeds and initial tokens for the whole (new) cluster: the new node would consider itself a seed
+	// and skip bootstrapping, and its token may clash with an existing node. Use existing nodes as seeds and let Cassandra pick the token.
+	envVars := map[string]string{}
+	for k, v := range iDef.Service.Env {
+		envVars[k] = v
+	}
+	envVars["CASSANDRA_SEEDS"] = strings.Join(seedIps, ",")
+	envVars["INITIAL_TOKEN"] = ""
+
+	logMsg, err = rexec.ExecEmbeddedScriptsOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, iDef.BestIpAddress(), iDef.Service.Cmd.Config, envVars, p.DeployCtx.Project.ScriptExecPolicy(iDef), p.DeployCtx.IsVerbose)
+	lb.Add(string(logMsg))
+	if err != nil {
+		return lb.Complete(err)
+	}
+
+	return lb.Complete(waitForCassNodesJoined(p, lb, nodes))
+}
+
+// Removes data that no longer belongs to the node after new nodes joined the cluster
+func (p *AwsDeployProvider) CleanupCassNode(iNickname string) (l.LogMsg, error) {
+	lb := l.NewLogBuilder(l.CurFuncName()+":"+iNickname, p.DeployCtx.IsVerbose)
+
+	logMsg, err := rexec.ExecCommandOnInstance(p.DeployCtx.GoCtx, p.DeployCtx.Project.SshConfig, p.DeployCtx.Project.Instances[iNickname].IpAddress, "nodetool cleanup", p.DeployCtx.Project.Timeouts.RemoteCommand, p.DeployCtx.IsVerbose)
+	lb.Add(string(logMsg))
+	return lb.Complete(err)
+}
@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/capillariesio/capillaries-deploy/pkg/rexec"
+)
+
+// Interactive shell, like ssh -J bastion instance, but with the project key and known_hosts
+func execInteractiveShell(p deployProviderImpl, iNickname string, cOut chan<- string, cErr chan<- string) error {
+	iDef, ok := p.getDeployCtx().Project.Instances[iNickname]
+	if !ok {
+		err := fmt.Errorf("instance %s not found in the project", iNickname)
+		cErr <- err.Error()
+		return err
+	}
+
+	logMsgBastionIp, err := p.PopulateInstanceExternalAddressByName()
+	cOut <- string(logMsgBastionIp)
+	if err != nil {
+		cErr <- err.Error()
+		return err
+	}
+
+	if err := rexec.RunInteractiveShell(p.getDeployCtx().GoCtx, p.getDeployCtx().Project.SshConfig, iDef.BestIpAddress()); err != nil {
+		cErr <- err.Error()
+		return err
+	}
+	return nil
+}
+
+// Local port forwarding, like ssh -L, until Ctrl+C. The port is dialed from the instance itself at its internal ip address,
+// so services listening on all interfaces or on the internal address are reachable.
+func execForward(p deployProviderImpl, nicknameAndPort string, localPort int, cOut chan<- string, cErr chan<- string) error {
+	nicknameAndPortParts := strings.Split(nicknameAndPort, ":")
+	if len(nicknameAndPortParts) != 2 {
+		err := fmt.Errorf("expected <instance>:<port>, got '%s'", nicknameAndPort)
+		cErr <- err.Error()
+		return err
+	}
+	iNickname := nicknameAndPortParts[0]
+	remotePort, err := strconv.Atoi(nicknameAndPortParts[1])
+	if err != nil || remotePort <= 0 || remotePort > 65535 {
+		err := fmt.Errorf("invalid port in '%s'", nicknameAndPort)
+		cErr <- err.Error()
+		return err
+	}
+	if localPort == 0 {
+		localPort = remotePort
+	}
+	if localPort < 0 || localPort > 65535 {
+		err := fmt.Errorf("invalid local port %d", localPort)
+		cErr <- err.Error()
+		return err
+	}
+
+	iDef, ok := p.getDeployCtx().Project.Instances[iNickname]
+	if !ok {
+		err := fmt.Errorf("instance %s not found in the project", iNickname)
+		cErr <- err.Error()
+		return err
+	}
+
+	logMsgBastionIp, err := p.PopulateInstanceExternalAddressByName()
+	cOut <- string(logMsgBastionIp)
+	if err != nil {
+		cErr <- err.Error()
+		return err
+	}
+
+	remoteAddress := fmt.Sprintf("%s:%d", iDef.IpAddress, remotePort)
+	portForwarder, err := rexec.NewPortForwarder(p.getDeployCtx().Project.SshConfig, iDef.BestIpAddress(), remoteAddress, localPort)
+	if err != nil {
+		cErr <- err.Error()
+		return err
+	}
+
+	cOut <- fmt.Sprintf("forwarding localhost:%d to %s %s, Ctrl+C to stop", localPort, iNickname, remoteAddress)
+	if err := portForwarder.Serve(p.getDeployCtx().GoCtx, cErr); err != nil {
+		cErr <- err.Error()
+		return err
+	}
+	return nil
+}
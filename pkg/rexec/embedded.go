@@ -1,9 +1,11 @@
 package rexec
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"io/fs"
+	"slices"
 
 	"github.com/capillariesio/capillaries-deploy/pkg/l"
 )
@@ -11,7 +13,43 @@ import (
 //go:embed scripts/*
 var embeddedScriptsFs embed.FS
 
-func ExecEmbeddedScriptsOnInstance(sshConfig *SshConfigDef, ipAddress string, embeddedScriptPaths []string, envVars map[string]string, isVerbose bool) (l.LogMsg, error) {
+// How scripts of an instance are executed. Timeouts are in seconds, zero means no timeout.
+// A script fails when its exit code is not zero; scripts listed in StrictStderr also fail when they write to stderr.
+// Template scripts run as rendered for this instance at project load, other scripts come from ScriptDirs or the embedded set.
+type ScriptExecPolicy struct {
+	DefaultTimeout  int
+	Timeouts        map[string]int
+	StrictStderr    []string
+	RenderedScripts map[string]string
+	ScriptDirs      []string
+}
+
+func (policy ScriptExecPolicy) TimeoutForScript(embeddedScriptPath string) int {
+	if timeout, ok := policy.Timeouts[embeddedScriptPath]; ok {
+		return timeout
+	}
+	return policy.DefaultTimeout
+}
+
+func (policy ScriptExecPolicy) IsStrictStderr(embeddedScriptPath string) bool {
+	return slices.Contains(policy.StrictStderr, embeddedScriptPath)
+}
+
+func (policy ScriptExecPolicy) scriptBody(embeddedScriptPath string) (string, error) {
+	if rendered, ok := policy.RenderedScripts[embeddedScriptPath]; ok {
+		return rendered, nil
+	}
+	if IsScriptTemplate(embeddedScriptPath) {
+		return "", fmt.Errorf("script template %s was not rendered for this instance", embeddedScriptPath)
+	}
+	cmdBytes, err := readScript(policy.ScriptDirs, embeddedScriptPath)
+	if err != nil {
+		return "", err
+	}
+	return string(cmdBytes), nil
+}
+
+func ExecEmbeddedScriptsOnInstance(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string, embeddedScriptPaths []string, envVars map[string]string, policy ScriptExecPolicy, isVerbose bool) (l.LogMsg, error) {
 	lb := l.NewLogBuilder(fmt.Sprintf("ExecEmbeddedScriptsOnInstance: %s on %s", embeddedScriptPaths, ipAddress), isVerbose)
 
 	if len(embeddedScriptPaths) == 0 {
@@ -19,7 +57,14 @@ func ExecEmbeddedScriptsOnInstance(sshConfig *SshConfigDef, ipAddress string, em
 		return lb.Complete(nil)
 	}
 	for _, embeddedScriptPath := range embeddedScriptPaths {
-		if err := execEmbeddedScriptOnInstance(sshConfig, lb, ipAddress, embeddedScriptPath, []string{}, envVars, isVerbose); err != nil {
+		cmd, err := policy.scriptBody(embeddedScriptPath)
+		if err != nil {
+			return lb.Complete(err)
+		}
+		if scriptDir := ScriptSourceDir(policy.ScriptDirs, embeddedScriptPath); scriptDir != "" {
+			lb.Add(fmt.Sprintf("%s from %s", embeddedScriptPath, scriptDir))
+		}
+		if err := execEmbeddedScriptOnInstance(goCtx, sshConfig, lb, ipAddress, embeddedScriptPath, cmd, envVars, policy.TimeoutForScript(embeddedScriptPath), policy.IsStrictStderr(embeddedScriptPath), isVerbose); err != nil {
 			return lb.Complete(err)
 		}
 	}
@@ -38,15 +83,17 @@ func HarvestAllEmbeddedFilesPaths(curDirPath string, harvestedPathsMap map[strin
 	})
 }
 
-func execEmbeddedScriptOnInstance(sshConfig *SshConfigDef, lb *l.LogBuilder, ipAddress string, embeddedScriptPath string, params []string, envVars map[string]string, isVerbose bool) error {
-	cmdBytes, err := embeddedScriptsFs.ReadFile(embeddedScriptPath)
-	if err != nil {
-		return err
-	}
-	er := ExecSsh(sshConfig, ipAddress, string(cmdBytes), envVars)
+func execEmbeddedScriptOnInstance(goCtx context.Context, sshConfig *SshConfigDef, lb *l.LogBuilder, ipAddress string, embeddedScriptPath string, cmd string, envVars map[string]string, timeoutSeconds int, strictStderr bool, isVerbose bool) error {
+	er := ExecSsh(withOutputStreamLabel(goCtx, embeddedScriptPath), sshConfig, ipAddress, cmd, envVars, timeoutSeconds)
 	lb.Add(er.ToString())
 	if er.Error != nil {
 		return fmt.Errorf("cannot execute script %s on %s: %s", embeddedScriptPath, ipAddress, er.Error.Error())
 	}
+	if er.Stderr != "" {
+		if strictStderr {
+			return fmt.Errorf("script %s on %s exited with 0 but wrote to stderr: %s", embeddedScriptPath, ipAddress, er.Stderr)
+		}
+		lb.AddWarning(fmt.Sprintf("script %s on %s wrote to stderr: %s", embeddedScriptPath, ipAddress, er.Stderr))
+	}
 	return nil
 }
@@ -0,0 +1,24 @@
+package rexec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Hash of script paths and the bodies that would run, in the order they are executed: scripts from
+// script dirs override embedded ones, templates are hashed as rendered. Used to tell if a baked image is stale.
+func EmbeddedScriptsHash(embeddedScriptPaths []string, policy ScriptExecPolicy) (string, error) {
+	h := sha256.New()
+	for _, embeddedScriptPath := range embeddedScriptPaths {
+		cmdBody, err := policy.scriptBody(embeddedScriptPath)
+		if err != nil {
+			return "", fmt.Errorf("cannot read script %s: %s", embeddedScriptPath, err.Error())
+		}
+		h.Write([]byte(embeddedScriptPath))
+		h.Write([]byte{0})
+		h.Write([]byte(cmdBody))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -2,7 +2,9 @@ package rexec
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"time"
@@ -12,11 +14,12 @@ import (
 )
 
 type ExecResult struct {
-	Cmd     string
-	Stdout  string
-	Stderr  string
-	Elapsed float64
-	Error   error
+	Cmd        string
+	Stdout     string
+	Stderr     string
+	ExitStatus int // -1 if the command did not complete: no connection, timeout, cancellation
+	Elapsed    float64
+	Error      error
 }
 
 func (er *ExecResult) ToString() string {
@@ -32,11 +35,12 @@ stdout:
 %s
 stderr:
 %s
+exit status:%d
 error:
 %s
 remote cmd elapsed:%0.3f
 -----------------------
-`, er.Cmd, er.Stdout, er.Stderr, errString, er.Elapsed)
+`, er.Cmd, er.Stdout, er.Stderr, er.ExitStatus, errString, er.Elapsed)
 }
 
 type SshConfigDef struct {
@@ -45,6 +49,10 @@ type SshConfigDef struct {
 	Port                         int    `json:"port"`
 	User                         string `json:"user"`
 	PrivateKeyOrPath             string `json:"private_key_or_path"`
+	KnownHostsPath               string `json:"known_hosts_path"`              // Deployment-scoped, trust on first use; "none" turns host key validation off
+	HostKeysFromConsoleOutput    bool   `json:"host_keys_from_console_output"` // Take expected host keys from EC2 console output on instance creation, reject unknown hosts
+	Transport                    string `json:"transport,omitempty"`           // ssh (default) or ssm
+	transport                    Transport
 }
 
 type TunneledSshClient struct {
@@ -71,9 +79,13 @@ func (tsc *TunneledSshClient) Close() {
 
 // Our jumphost implementation
 func NewTunneledSshClient(sshConfig *SshConfigDef, ipAddress string) (*TunneledSshClient, error) {
+	if err := sshConfig.checkSshAvailable(); err != nil {
+		return nil, err
+	}
 	bastionSshClientConfig, err := NewSshClientConfig(
 		sshConfig.User,
-		sshConfig.PrivateKeyOrPath)
+		sshConfig.PrivateKeyOrPath,
+		sshConfig.hostKeyCallback())
 	if err != nil {
 		return nil, err
 	}
@@ -104,7 +116,8 @@ func NewTunneledSshClient(sshConfig *SshConfigDef, ipAddress string) (*TunneledS
 
 		tunneledSshClientConfig, err := NewSshClientConfig(
 			sshConfig.User,
-			sshConfig.PrivateKeyOrPath)
+			sshConfig.PrivateKeyOrPath,
+			sshConfig.hostKeyCallback())
 		if err != nil {
 			return nil, err
 		}
@@ -121,61 +134,74 @@ func NewTunneledSshClient(sshConfig *SshConfigDef, ipAddress string) (*TunneledS
 	return &tsc, nil
 }
 
-func ExecSsh(sshConfig *SshConfigDef, ipAddress string, cmd string, envVars map[string]string) ExecResult {
+// Runs the command over the project transport (ssh unless configured otherwise).
+// Zero timeoutSeconds means no timeout, the command still stops when goCtx is cancelled
+func ExecSsh(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string, cmd string, envVars map[string]string, timeoutSeconds int) ExecResult {
 	cmdBuilder := strings.Builder{}
-	for k, v := range envVars {
-		if strings.Contains(v, " ") {
-			cmdBuilder.WriteString(fmt.Sprintf("%s='%s'\n", k, v))
-		} else {
-			cmdBuilder.WriteString(fmt.Sprintf("%s=%s\n", k, v))
-		}
-	}
+	cmdBuilder.WriteString(envVarsPrefix(envVars))
 	cmdBuilder.WriteString(cmd)
 
-	tsc, err := NewTunneledSshClient(sshConfig, ipAddress)
-	if err != nil {
-		return ExecResult{cmdBuilder.String(), "", "", 0, err}
-	}
-	defer tsc.Close()
-
-	session, err := tsc.SshClient.NewSession()
-	if err != nil {
-		return ExecResult{cmdBuilder.String(), "", "", 0, fmt.Errorf("cannot create session for %s: %s", ipAddress, err.Error())}
+	if goCtx.Err() != nil {
+		return ExecResult{cmdBuilder.String(), "", "", -1, 0, fmt.Errorf("cancelled before running on %s: %s", ipAddress, goCtx.Err().Error())}
 	}
-	defer session.Close()
 
 	var stdout, stderr bytes.Buffer
-	session.Stdout = &stdout
-	session.Stderr = &stderr
+	var stdoutWriter, stderrWriter io.Writer = &stdout, &stderr
+
+	var stdoutStream, stderrStream *lineStreamWriter
+	if stream := outputStreamFromCtx(goCtx); stream != nil {
+		prefix := outputStreamPrefix(goCtx, stream, ipAddress, cmd)
+		stdoutStream = newLineStreamWriter(&stdout, prefix, stream.OutChan)
+		stderrStream = newLineStreamWriter(&stderr, prefix, stream.ErrChan)
+		stdoutWriter, stderrWriter = stdoutStream, stderrStream
+	}
 
-	// TODO: it would be nice to have an execution timeout
+	runCtx := goCtx
+	if timeoutSeconds > 0 {
+		var cancelRunCtx context.CancelFunc
+		runCtx, cancelRunCtx = context.WithTimeout(goCtx, time.Duration(timeoutSeconds)*time.Second)
+		defer cancelRunCtx()
+	}
 
 	runStartTime := time.Now()
-	err = session.Run(cmdBuilder.String())
-	elapsed := time.Since(runStartTime).Seconds()
-	if err == nil {
-		if len(stderr.String()) > 0 {
-			err = fmt.Errorf("%s", stderr.String())
-		}
-	} else {
-		if len(stderr.String()) > 0 {
-			// Add first string of stderr to the error
-			s := strings.Split(stderr.String(), "\n")
-			err = fmt.Errorf("%s;%s", err.Error(), s[0])
+	exitStatus, err := sshConfig.getTransport().Run(runCtx, ipAddress, cmdBuilder.String(), stdoutWriter, stderrWriter)
+	if runCtx.Err() != nil {
+		exitStatus = -1
+		if goCtx.Err() != nil {
+			err = fmt.Errorf("cancelled: %s", goCtx.Err().Error())
+		} else {
+			err = fmt.Errorf("timeout after %ds", timeoutSeconds)
 		}
 	}
+	elapsed := time.Since(runStartTime).Seconds()
+
+	if stdoutStream != nil {
+		stdoutStream.Flush()
+		stderrStream.Flush()
+	}
 
-	er := ExecResult{cmd, stdout.String(), stderr.String(), elapsed, err}
+	// Failure is decided by the exit code: apt, mkfs and others write progress and warnings to stderr.
+	// Callers that need a clean stderr check ExecResult.Stderr themselves.
+	if err != nil && len(stderr.String()) > 0 {
+		// Add first string of stderr to the error
+		s := strings.Split(stderr.String(), "\n")
+		err = fmt.Errorf("%s;%s", err.Error(), s[0])
+	}
+
+	er := ExecResult{cmd, stdout.String(), stderr.String(), exitStatus, elapsed, err}
 	return er
 }
 
-func ExecCommandOnInstance(sshConfig *SshConfigDef, ipAddress string, cmd string, isVerbose bool) (l.LogMsg, error) {
+func ExecCommandOnInstance(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string, cmd string, timeoutSeconds int, isVerbose bool) (l.LogMsg, error) {
 	lb := l.NewLogBuilder(fmt.Sprintf("ExecCommandOnInstance: %s - %s", ipAddress, cmd), isVerbose)
-	er := ExecSsh(sshConfig, ipAddress, cmd, map[string]string{})
+	er := ExecSsh(goCtx, sshConfig, ipAddress, cmd, map[string]string{}, timeoutSeconds)
 	lb.Add(er.ToString())
 	if er.Error != nil {
 		return lb.Complete(er.Error)
 	}
+	if er.Stderr != "" {
+		lb.AddWarning(fmt.Sprintf("%s wrote to stderr: %s", ipAddress, er.Stderr))
+	}
 	return lb.Complete(nil)
 }
 
@@ -197,8 +223,8 @@ func ExecSshForClient(sshClient *ssh.Client, cmd string) (string, string, error)
 }
 
 // Used on volume attachment
-func ExecSshAndReturnLastLine(sshConfig *SshConfigDef, ipAddress string, cmd string) (string, ExecResult) {
-	er := ExecSsh(sshConfig, ipAddress, cmd, map[string]string{})
+func ExecSshAndReturnLastLine(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string, cmd string, timeoutSeconds int) (string, ExecResult) {
+	er := ExecSsh(goCtx, sshConfig, ipAddress, cmd, map[string]string{}, timeoutSeconds)
 	if er.Error != nil {
 		return "", er
 	}
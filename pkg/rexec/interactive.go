@@ -0,0 +1,213 @@
+package rexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// Local terminal size is polled, not signalled: SIGWINCH does not exist everywhere
+const terminalSizePollInterval time.Duration = 500 * time.Millisecond
+
+// Interactive shell on the instance, tunneled through bastion if needed, attached to the local terminal.
+// Without a local terminal (stdin is a pipe), the remote shell runs without PTY, and cancelling goCtx closes the session.
+// In raw terminal mode Ctrl+C goes to the remote shell.
+func RunInteractiveShell(goCtx context.Context, sshConfig *SshConfigDef, ipAddress string) error {
+	tsc, err := NewTunneledSshClient(sshConfig, ipAddress)
+	if err != nil {
+		return err
+	}
+	defer tsc.Close()
+
+	session, err := tsc.SshClient.NewSession()
+	if err != nil {
+		return fmt.Errorf("cannot create session for %s: %s", ipAddress, err.Error())
+	}
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	stdinFd := int(os.Stdin.Fd())
+	stdoutFd := int(os.Stdout.Fd())
+	sessionDone := make(chan struct{})
+	defer close(sessionDone)
+	if term.IsTerminal(stdinFd) {
+		oldState, err := term.MakeRaw(stdinFd)
+		if err != nil {
+			return fmt.Errorf("cannot put local terminal into raw mode: %s", err.Error())
+		}
+		defer term.Restore(stdinFd, oldState)
+
+		width, height, err := term.GetSize(stdoutFd)
+		if err != nil {
+			width, height = 80, 24
+		}
+		termType := os.Getenv("TERM")
+		if termType == "" {
+			termType = "xterm-256color"
+		}
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err := session.RequestPty(termType, height, width, modes); err != nil {
+			return fmt.Errorf("cannot request pty on %s: %s", ipAddress, err.Error())
+		}
+
+		go func() {
+			ticker := time.NewTicker(terminalSizePollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-sessionDone:
+					return
+				case <-ticker.C:
+					newWidth, newHeight, err := term.GetSize(stdoutFd)
+					if err == nil && (newWidth != width || newHeight != height) {
+						width, height = newWidth, newHeight
+						_ = session.WindowChange(height, width)
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		select {
+		case <-goCtx.Done():
+			session.Close()
+		case <-sessionDone:
+		}
+	}()
+
+	if err := session.Shell(); err != nil {
+		return fmt.Errorf("cannot start shell on %s: %s", ipAddress, err.Error())
+	}
+	if err := session.Wait(); err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("remote shell on %s exited with status %d", ipAddress, exitErr.ExitStatus())
+		}
+		return fmt.Errorf("remote shell on %s failed: %s", ipAddress, err.Error())
+	}
+	return nil
+}
+
+// Local port forwarding: connections to localhost:LocalPort go to RemoteAddress as seen from the instance at ipAddress
+type PortForwarder struct {
+	sshConfig     *SshConfigDef
+	ipAddress     string
+	RemoteAddress string
+	LocalPort     int
+	listener      net.Listener
+	mx            sync.Mutex
+	tsc           *TunneledSshClient
+}
+
+func NewPortForwarder(sshConfig *SshConfigDef, ipAddress string, remoteAddress string, localPort int) (*PortForwarder, error) {
+	tsc, err := NewTunneledSshClient(sshConfig, ipAddress)
+	if err != nil {
+		return nil, err
+	}
+	localUrl := fmt.Sprintf("127.0.0.1:%d", localPort)
+	listener, err := net.Listen("tcp", localUrl)
+	if err != nil {
+		tsc.Close()
+		return nil, fmt.Errorf("cannot listen on %s: %s", localUrl, err.Error())
+	}
+	return &PortForwarder{
+		sshConfig:     sshConfig,
+		ipAddress:     ipAddress,
+		RemoteAddress: remoteAddress,
+		LocalPort:     localPort,
+		listener:      listener,
+		tsc:           tsc}, nil
+}
+
+// Dead client (instance rebooted, bastion connection dropped) is replaced on the next local connection
+func (pf *PortForwarder) dialRemote() (net.Conn, error) {
+	pf.mx.Lock()
+	defer pf.mx.Unlock()
+	if pf.tsc != nil {
+		remoteConn, err := pf.tsc.SshClient.Dial("tcp", pf.RemoteAddress)
+		if err == nil {
+			return remoteConn, nil
+		}
+		pf.tsc.Close()
+		pf.tsc = nil
+	}
+	tsc, err := NewTunneledSshClient(pf.sshConfig, pf.ipAddress)
+	if err != nil {
+		return nil, err
+	}
+	pf.tsc = tsc
+	remoteConn, err := pf.tsc.SshClient.Dial("tcp", pf.RemoteAddress)
+	if err != nil {
+		return nil, fmt.Errorf("cannot dial %s from %s: %s", pf.RemoteAddress, pf.ipAddress, err.Error())
+	}
+	return remoteConn, nil
+}
+
+func pipeConns(localConn net.Conn, remoteConn net.Conn) {
+	defer localConn.Close()
+	defer remoteConn.Close()
+	copyDone := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(remoteConn, localConn)
+		copyDone <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(localConn, remoteConn)
+		copyDone <- struct{}{}
+	}()
+	// One side is done: close both, so the other copy returns too
+	<-copyDone
+}
+
+// Accepts local connections until goCtx is cancelled. Failed remote dials are reported to cErr, forwarding goes on.
+func (pf *PortForwarder) Serve(goCtx context.Context, cErr chan<- string) error {
+	go func() {
+		<-goCtx.Done()
+		pf.listener.Close()
+	}()
+	defer pf.close()
+
+	for {
+		localConn, err := pf.listener.Accept()
+		if err != nil {
+			if goCtx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("cannot accept connection on %s: %s", pf.listener.Addr().String(), err.Error())
+		}
+		go func() {
+			remoteConn, err := pf.dialRemote()
+			if err != nil {
+				localConn.Close()
+				cErr <- err.Error()
+				return
+			}
+			pipeConns(localConn, remoteConn)
+		}()
+	}
+}
+
+func (pf *PortForwarder) close() {
+	pf.mx.Lock()
+	defer pf.mx.Unlock()
+	if pf.tsc != nil {
+		pf.tsc.Close()
+		pf.tsc = nil
+	}
+}
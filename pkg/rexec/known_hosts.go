@@ -0,0 +1,195 @@
+package rexec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// All goroutines of a command share one known_hosts file
+var knownHostsMx sync.Mutex
+
+// known_hosts_path value that turns host key validation off
+const NoKnownHostsPath string = "none"
+
+// Expanded path of the known_hosts file, empty when host key validation is off
+func (sshConfig *SshConfigDef) KnownHostsFilePath() string {
+	if sshConfig.KnownHostsPath == NoKnownHostsPath {
+		return ""
+	}
+	return ExpandHomePath(sshConfig.KnownHostsPath)
+}
+
+func ExpandHomePath(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		homeDir, _ := os.UserHomeDir()
+		return filepath.Join(homeDir, path[2:])
+	}
+	return path
+}
+
+func ensureKnownHostsFile(knownHostsPath string) error {
+	if err := os.MkdirAll(filepath.Dir(knownHostsPath), 0700); err != nil {
+		return fmt.Errorf("cannot create directory for known_hosts file %s: %s", knownHostsPath, err.Error())
+	}
+	f, err := os.OpenFile(knownHostsPath, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create known_hosts file %s: %s", knownHostsPath, err.Error())
+	}
+	return f.Close()
+}
+
+func appendKnownHostsLines(knownHostsPath string, lines []string) error {
+	f, err := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open known_hosts file %s: %s", knownHostsPath, err.Error())
+	}
+	defer f.Close()
+	for _, line := range lines {
+		if _, err := f.WriteString(line + "\n"); err != nil {
+			return fmt.Errorf("cannot write to known_hosts file %s: %s", knownHostsPath, err.Error())
+		}
+	}
+	return nil
+}
+
+// Trust on first use: an unknown host is added to the deployment known_hosts file, a known host must present the same key.
+// Without allowFirstUse, unknown hosts are rejected: their keys are expected to be added by SetKnownHostKeys.
+func newTofuHostKeyCallback(knownHostsPath string, allowFirstUse bool) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMx.Lock()
+		defer knownHostsMx.Unlock()
+
+		if err := ensureKnownHostsFile(knownHostsPath); err != nil {
+			return err
+		}
+		hostKeyCallback, err := knownhosts.New(knownHostsPath)
+		if err != nil {
+			return fmt.Errorf("cannot read known_hosts file %s: %s", knownHostsPath, err.Error())
+		}
+		err = hostKeyCallback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) == 0 {
+			if !allowFirstUse {
+				return fmt.Errorf("host %s is not in %s; with host_keys_from_console_output, keys are collected when capideploy creates the instance", hostname, knownHostsPath)
+			}
+			return appendKnownHostsLines(knownHostsPath, []string{knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)})
+		}
+		return fmt.Errorf("host key mismatch for %s: got %s %s, %s has a different one at line %d; if the host was re-created outside of capideploy, remove it from there",
+			hostname, key.Type(), ssh.FingerprintSHA256(key), knownHostsPath, keyErr.Want[0].Line)
+	}
+}
+
+func isKnownHostsLineForAddress(line string, normalizedAddress string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+		return false
+	}
+	hostsField := fields[0]
+	if strings.HasPrefix(hostsField, "@") && len(fields) >= 3 {
+		// @cert-authority, @revoked
+		hostsField = fields[1]
+	}
+	for _, host := range strings.Split(hostsField, ",") {
+		if host == normalizedAddress {
+			return true
+		}
+	}
+	return false
+}
+
+func forgetKnownHostUnsafe(knownHostsPath string, normalizedAddress string) error {
+	f, err := os.Open(knownHostsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot open known_hosts file %s: %s", knownHostsPath, err.Error())
+	}
+	keptLines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if !isKnownHostsLineForAddress(scanner.Text(), normalizedAddress) {
+			keptLines = append(keptLines, scanner.Text())
+		}
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cannot read known_hosts file %s: %s", knownHostsPath, err.Error())
+	}
+
+	content := strings.Join(keptLines, "\n")
+	if len(keptLines) > 0 {
+		content += "\n"
+	}
+	if err := os.WriteFile(knownHostsPath, []byte(content), 0600); err != nil {
+		return fmt.Errorf("cannot write known_hosts file %s: %s", knownHostsPath, err.Error())
+	}
+	return nil
+}
+
+func (sshConfig *SshConfigDef) hostKeyCallback() ssh.HostKeyCallback {
+	knownHostsPath := sshConfig.KnownHostsFilePath()
+	if knownHostsPath == "" {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			// No host validation
+			return nil
+		}
+	}
+	return newTofuHostKeyCallback(knownHostsPath, !sshConfig.HostKeysFromConsoleOutput)
+}
+
+// Called when the host at this address is replaced: next connection trusts the new key on first use.
+// Pooled connection to the old host is dropped too.
+func ForgetKnownHost(sshConfig *SshConfigDef, ipAddress string) error {
+	defaultSshPool.Evict(sshConfig, ipAddress)
+	knownHostsPath := sshConfig.KnownHostsFilePath()
+	if knownHostsPath == "" {
+		return nil
+	}
+	knownHostsMx.Lock()
+	defer knownHostsMx.Unlock()
+	return forgetKnownHostUnsafe(knownHostsPath, knownhosts.Normalize(fmt.Sprintf("%s:%d", ipAddress, sshConfig.Port)))
+}
+
+// Replaces known keys for this address with the keys obtained elsewhere (like EC2 console output), in authorized_keys format
+func SetKnownHostKeys(sshConfig *SshConfigDef, ipAddress string, authorizedKeys []string) error {
+	knownHostsPath := sshConfig.KnownHostsFilePath()
+	if knownHostsPath == "" {
+		return fmt.Errorf("cannot set known host keys for %s, known_hosts_path is %s", ipAddress, NoKnownHostsPath)
+	}
+	normalizedAddress := knownhosts.Normalize(fmt.Sprintf("%s:%d", ipAddress, sshConfig.Port))
+	lines := make([]string, len(authorizedKeys))
+	for i, authorizedKey := range authorizedKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+		if err != nil {
+			return fmt.Errorf("cannot parse host key %s for %s: %s", authorizedKey, ipAddress, err.Error())
+		}
+		lines[i] = knownhosts.Line([]string{normalizedAddress}, key)
+	}
+
+	knownHostsMx.Lock()
+	defer knownHostsMx.Unlock()
+	if err := ensureKnownHostsFile(knownHostsPath); err != nil {
+		return err
+	}
+	if err := forgetKnownHostUnsafe(knownHostsPath, normalizedAddress); err != nil {
+		return err
+	}
+	return appendKnownHostsLines(knownHostsPath, lines)
+}
@@ -0,0 +1,144 @@
+package rexec
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testHostAddr(ipAddress string) (string, net.Addr) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ipAddress), Port: 22}
+	return addr.String(), addr
+}
+
+func TestTofuHostKeyCallback(t *testing.T) {
+	knownHostsPath := filepath.Join(t.TempDir(), "sub", "dep_known_hosts")
+	key1 := newTestHostKey(t)
+	key2 := newTestHostKey(t)
+	hostname, remote := testHostAddr("10.5.0.11")
+
+	cases := []struct {
+		name          string
+		allowFirstUse bool
+		key           ssh.PublicKey
+		expectedErr   string
+	}{
+		{"unknown host rejected without first use", false, key1, "is not in"},
+		{"unknown host trusted on first use", true, key1, ""},
+		{"known host, same key", false, key1, ""},
+		{"known host, same key, first use allowed", true, key1, ""},
+		{"known host, different key", true, key2, "host key mismatch"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := newTofuHostKeyCallback(knownHostsPath, c.allowFirstUse)(hostname, remote, c.key)
+			if c.expectedErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.expectedErr) {
+				t.Fatalf("expected error with '%s', got %v", c.expectedErr, err)
+			}
+		})
+	}
+
+	content, err := os.ReadFile(knownHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(content), "\n") != 1 {
+		t.Fatalf("expected exactly one key in known_hosts, got:\n%s", content)
+	}
+}
+
+func TestSetAndForgetKnownHost(t *testing.T) {
+	sshConfig := &SshConfigDef{Port: 22, KnownHostsPath: filepath.Join(t.TempDir(), "dep_known_hosts"), HostKeysFromConsoleOutput: true}
+	knownHostsPath := sshConfig.KnownHostsFilePath()
+	key1 := newTestHostKey(t)
+	key2 := newTestHostKey(t)
+	key3 := newTestHostKey(t)
+	otherKey := newTestHostKey(t)
+
+	// Console output has several keys per host, setting them again replaces old ones
+	if err := SetKnownHostKeys(sshConfig, "10.5.0.11", []string{string(ssh.MarshalAuthorizedKey(key1)), string(ssh.MarshalAuthorizedKey(key2))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetKnownHostKeys(sshConfig, "10.5.0.12", []string{string(ssh.MarshalAuthorizedKey(otherKey))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetKnownHostKeys(sshConfig, "10.5.0.11", []string{string(ssh.MarshalAuthorizedKey(key3))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetKnownHostKeys(sshConfig, "10.5.0.11", []string{"not a key"}); err == nil {
+		t.Fatalf("expected error for a malformed key")
+	}
+
+	hostname11, remote11 := testHostAddr("10.5.0.11")
+	hostname12, remote12 := testHostAddr("10.5.0.12")
+	cases := []struct {
+		name     string
+		hostname string
+		remote   net.Addr
+		key      ssh.PublicKey
+		isValid  bool
+	}{
+		{"replaced key", hostname11, remote11, key1, false},
+		{"current key", hostname11, remote11, key3, true},
+		{"other host kept", hostname12, remote12, otherKey, true},
+		{"other host, wrong key", hostname12, remote12, key3, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := sshConfig.hostKeyCallback()(c.hostname, c.remote, c.key)
+			if c.isValid && err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !c.isValid && err == nil {
+				t.Fatalf("expected key to be rejected")
+			}
+		})
+	}
+
+	if err := ForgetKnownHost(sshConfig, "10.5.0.11"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(knownHostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "10.5.0.11") || !strings.Contains(string(content), "10.5.0.12") {
+		t.Fatalf("expected only 10.5.0.12 to stay in known_hosts, got:\n%s", content)
+	}
+
+	// Validation off
+	sshConfig = &SshConfigDef{Port: 22, KnownHostsPath: NoKnownHostsPath}
+	if err := sshConfig.hostKeyCallback()(hostname11, remote11, key1); err != nil {
+		t.Fatalf("expected any key to be accepted, got %s", err.Error())
+	}
+	if err := ForgetKnownHost(sshConfig, "10.5.0.11"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetKnownHostKeys(sshConfig, "10.5.0.11", []string{string(ssh.MarshalAuthorizedKey(key1))}); err == nil {
+		t.Fatalf("expected error setting keys with known_hosts_path %s", NoKnownHostsPath)
+	}
+}
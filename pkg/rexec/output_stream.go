@@ -0,0 +1,100 @@
+package rexec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Live forwarding of remote stdout/stderr, line by line, while the full output is still captured in ExecResult
+type OutputStream struct {
+	OutChan  chan<- string
+	ErrChan  chan<- string
+	HostName func(ipAddress string) string // Nickname lookup for line prefixes, ip address is used if empty
+}
+
+type outputStreamCtxKey struct{}
+type outputStreamLabelCtxKey struct{}
+
+// Commands executed with the returned context forward their output to the stream
+func WithOutputStream(goCtx context.Context, stream *OutputStream) context.Context {
+	return context.WithValue(goCtx, outputStreamCtxKey{}, stream)
+}
+
+func outputStreamFromCtx(goCtx context.Context) *OutputStream {
+	stream, _ := goCtx.Value(outputStreamCtxKey{}).(*OutputStream)
+	return stream
+}
+
+// Script name for line prefixes
+func withOutputStreamLabel(goCtx context.Context, label string) context.Context {
+	if outputStreamFromCtx(goCtx) == nil {
+		return goCtx
+	}
+	return context.WithValue(goCtx, outputStreamLabelCtxKey{}, label)
+}
+
+// Raw commands do not have a script name, use the beginning of the command
+const maxOutputStreamCmdLabelLen int = 30
+
+func outputStreamPrefix(goCtx context.Context, stream *OutputStream, ipAddress string, cmd string) string {
+	hostName := ipAddress
+	if stream.HostName != nil {
+		if nickname := stream.HostName(ipAddress); nickname != "" {
+			hostName = nickname
+		}
+	}
+	label, _ := goCtx.Value(outputStreamLabelCtxKey{}).(string)
+	if label == "" {
+		label = strings.TrimSpace(strings.SplitN(strings.TrimSpace(cmd), "\n", 2)[0])
+		if len(label) > maxOutputStreamCmdLabelLen {
+			label = label[:maxOutputStreamCmdLabelLen] + "..."
+		}
+	}
+	return fmt.Sprintf("%s %s: ", hostName, label)
+}
+
+// Writes everything to the capture buffer, sends complete lines to the channel
+type lineStreamWriter struct {
+	mx      sync.Mutex
+	capture io.Writer
+	partial bytes.Buffer
+	prefix  string
+	c       chan<- string
+}
+
+func newLineStreamWriter(capture io.Writer, prefix string, c chan<- string) *lineStreamWriter {
+	return &lineStreamWriter{capture: capture, prefix: prefix, c: c}
+}
+
+func (w *lineStreamWriter) Write(p []byte) (int, error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	n, err := w.capture.Write(p)
+	if err != nil {
+		return n, err
+	}
+	w.partial.Write(p)
+	for {
+		idx := bytes.IndexByte(w.partial.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := string(w.partial.Next(idx + 1))
+		w.c <- w.prefix + strings.TrimRight(line, "\r\n")
+	}
+	return n, nil
+}
+
+// Sends the last line if it was not terminated by a newline
+func (w *lineStreamWriter) Flush() {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.partial.Len() > 0 {
+		w.c <- w.prefix + strings.TrimRight(w.partial.String(), "\r\n")
+		w.partial.Reset()
+	}
+}
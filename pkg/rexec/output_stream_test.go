@@ -0,0 +1,106 @@
+package rexec
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestLineStreamWriter(t *testing.T) {
+	cases := []struct {
+		name          string
+		writes        []string
+		expectedLines []string
+		flushedLines  []string
+	}{
+		{"one line", []string{"hello\n"}, []string{"cass001 a.sh: hello"}, []string{}},
+		{"several lines in one write", []string{"a\nb\nc\n"}, []string{"cass001 a.sh: a", "cass001 a.sh: b", "cass001 a.sh: c"}, []string{}},
+		{"line split across writes", []string{"hel", "lo\nwor", "ld\n"}, []string{"cass001 a.sh: hello", "cass001 a.sh: world"}, []string{}},
+		{"unterminated last line", []string{"a\nprogress 50%"}, []string{"cass001 a.sh: a"}, []string{"cass001 a.sh: progress 50%"}},
+		{"crlf", []string{"a\r\nb\r", "\n"}, []string{"cass001 a.sh: a", "cass001 a.sh: b"}, []string{}},
+		{"empty line", []string{"\n"}, []string{"cass001 a.sh: "}, []string{}},
+		{"nothing", []string{}, []string{}, []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lineChan := make(chan string, 10)
+			var capture bytes.Buffer
+			w := newLineStreamWriter(&capture, "cass001 a.sh: ", lineChan)
+			expectedCapture := ""
+			for _, s := range c.writes {
+				n, err := w.Write([]byte(s))
+				if err != nil || n != len(s) {
+					t.Fatalf("write returned %d, %v", n, err)
+				}
+				expectedCapture += s
+			}
+			lines := drainLines(lineChan)
+			if !slices.Equal(lines, c.expectedLines) {
+				t.Fatalf("expected lines %q, got %q", c.expectedLines, lines)
+			}
+
+			w.Flush()
+			flushedLines := drainLines(lineChan)
+			if !slices.Equal(flushedLines, c.flushedLines) {
+				t.Fatalf("expected flushed lines %q, got %q", c.flushedLines, flushedLines)
+			}
+			w.Flush()
+			if len(drainLines(lineChan)) != 0 {
+				t.Fatalf("second flush sent lines again")
+			}
+
+			// Capture keeps the output as is
+			if capture.String() != expectedCapture {
+				t.Fatalf("expected capture %q, got %q", expectedCapture, capture.String())
+			}
+		})
+	}
+}
+
+func drainLines(lineChan chan string) []string {
+	lines := make([]string, 0)
+	for {
+		select {
+		case line := <-lineChan:
+			lines = append(lines, line)
+		default:
+			return lines
+		}
+	}
+}
+
+func TestOutputStreamPrefix(t *testing.T) {
+	stream := &OutputStream{HostName: func(ipAddress string) string {
+		if ipAddress == "10.5.0.11" {
+			return "cass001"
+		}
+		return ""
+	}}
+	goCtx := WithOutputStream(context.Background(), stream)
+
+	cases := []struct {
+		name     string
+		goCtx    context.Context
+		ip       string
+		cmd      string
+		expected string
+	}{
+		{"script label", withOutputStreamLabel(goCtx, "scripts/cassandra/config.sh"), "10.5.0.11", "echo", "cass001 scripts/cassandra/config.sh: "},
+		{"unknown host", withOutputStreamLabel(goCtx, "scripts/cassandra/config.sh"), "10.5.0.99", "echo", "10.5.0.99 scripts/cassandra/config.sh: "},
+		{"command first line", goCtx, "10.5.0.11", "  df -h\nuptime", "cass001 df -h: "},
+		{"long command", goCtx, "10.5.0.11", "tail -n 20 /var/log/capidaemon/capidaemon.log", "cass001 tail -n 20 /var/log/capidaemon...: "},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			prefix := outputStreamPrefix(c.goCtx, stream, c.ip, c.cmd)
+			if prefix != c.expected {
+				t.Fatalf("expected %q, got %q", c.expected, prefix)
+			}
+		})
+	}
+
+	if withOutputStreamLabel(context.Background(), "a.sh").Value(outputStreamLabelCtxKey{}) != nil {
+		t.Fatalf("expected no label without output stream")
+	}
+}
@@ -0,0 +1,78 @@
+package rexec
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Script paths in the project start with this, external script dirs are laid out like this embedded directory
+const embeddedScriptsRoot string = "scripts"
+
+// Script path like scripts/grafana/install.sh -> <scriptDir>/grafana/install.sh
+func externalScriptFilePath(scriptDir string, scriptPath string) (string, bool) {
+	relPath, ok := strings.CutPrefix(scriptPath, embeddedScriptsRoot+"/")
+	if !ok || !fs.ValidPath(relPath) {
+		return "", false
+	}
+	return filepath.Join(scriptDir, filepath.FromSlash(relPath)), true
+}
+
+// First of scriptDirs that has this script, empty if the script comes from the embedded set
+func ScriptSourceDir(scriptDirs []string, scriptPath string) string {
+	for _, scriptDir := range scriptDirs {
+		filePath, ok := externalScriptFilePath(scriptDir, scriptPath)
+		if !ok {
+			return ""
+		}
+		if info, err := os.Stat(filePath); err == nil && info.Mode().IsRegular() {
+			return scriptDir
+		}
+	}
+	return ""
+}
+
+func readScript(scriptDirs []string, scriptPath string) ([]byte, error) {
+	if scriptDir := ScriptSourceDir(scriptDirs, scriptPath); scriptDir != "" {
+		filePath, _ := externalScriptFilePath(scriptDir, scriptPath)
+		scriptBytes, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read script %s from %s: %s", scriptPath, scriptDir, err.Error())
+		}
+		return scriptBytes, nil
+	}
+	return embeddedScriptsFs.ReadFile(scriptPath)
+}
+
+// Same keys as HarvestAllEmbeddedFilesPaths: scripts/<path in scriptDir>. Dot files and dirs (.git, editor swap files) are skipped.
+func HarvestExternalScriptPaths(scriptDir string, harvestedPathsMap map[string]bool) error {
+	info, err := os.Stat(scriptDir)
+	if err != nil {
+		return fmt.Errorf("cannot use script dir %s: %s", scriptDir, err.Error())
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("cannot use script dir %s: not a directory", scriptDir)
+	}
+	return filepath.WalkDir(scriptDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != scriptDir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(scriptDir, path)
+		if err != nil {
+			return err
+		}
+		harvestedPathsMap[embeddedScriptsRoot+"/"+filepath.ToSlash(relPath)] = false
+		return nil
+	})
+}
@@ -0,0 +1,142 @@
+package rexec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestScript(t *testing.T, scriptDir string, relPath string, body string) {
+	filePath := filepath.Join(scriptDir, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScriptSourceDir(t *testing.T) {
+	firstDir := t.TempDir()
+	secondDir := t.TempDir()
+	writeTestScript(t, firstDir, "grafana/install.sh", "echo first")
+	writeTestScript(t, secondDir, "grafana/install.sh", "echo second")
+	writeTestScript(t, secondDir, "grafana/config.sh", "echo second config")
+	writeTestScript(t, secondDir, "cassandra/install.sh", "echo overridden cassandra")
+	if err := os.MkdirAll(filepath.Join(firstDir, "grafana", "start.sh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	scriptDirs := []string{firstDir, secondDir}
+	cases := []struct {
+		name        string
+		scriptPath  string
+		expectedDir string
+		expectedSrc string
+	}{
+		{"first dir wins", "scripts/grafana/install.sh", firstDir, "echo first"},
+		{"falls through to second dir", "scripts/grafana/config.sh", secondDir, "echo second config"},
+		{"overrides embedded script", "scripts/cassandra/install.sh", secondDir, "echo overridden cassandra"},
+		{"embedded when not overridden", "scripts/cassandra/config.sh", "", ""},
+		{"directory is not a script", "scripts/grafana/start.sh", "", ""},
+		{"outside of scripts root", "grafana/install.sh", "", ""},
+		{"path escaping script dir", "scripts/../grafana/install.sh", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scriptDir := ScriptSourceDir(scriptDirs, c.scriptPath)
+			if scriptDir != c.expectedDir {
+				t.Fatalf("expected dir '%s', got '%s'", c.expectedDir, scriptDir)
+			}
+			if c.expectedSrc == "" {
+				return
+			}
+			scriptBytes, err := readScript(scriptDirs, c.scriptPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(scriptBytes) != c.expectedSrc {
+				t.Fatalf("expected '%s', got '%s'", c.expectedSrc, string(scriptBytes))
+			}
+		})
+	}
+
+	embeddedBytes, err := readScript(scriptDirs, "scripts/cassandra/config.sh")
+	if err != nil || len(embeddedBytes) == 0 {
+		t.Fatalf("expected embedded scripts/cassandra/config.sh, got error %v", err)
+	}
+	if ScriptSourceDir(nil, "scripts/cassandra/install.sh") != "" {
+		t.Fatalf("expected embedded script without script dirs")
+	}
+}
+
+func TestHarvestExternalScriptPaths(t *testing.T) {
+	scriptDir := t.TempDir()
+	writeTestScript(t, scriptDir, "grafana/install.sh", "echo install")
+	writeTestScript(t, scriptDir, "grafana/.install.sh.swp", "swap")
+	writeTestScript(t, scriptDir, ".git/config", "git")
+
+	harvested := map[string]bool{}
+	if err := HarvestExternalScriptPaths(scriptDir, harvested); err != nil {
+		t.Fatal(err)
+	}
+	if len(harvested) != 1 {
+		t.Fatalf("expected only scripts/grafana/install.sh, got %v", harvested)
+	}
+	if _, ok := harvested["scripts/grafana/install.sh"]; !ok {
+		t.Fatalf("expected scripts/grafana/install.sh, got %v", harvested)
+	}
+	if err := HarvestExternalScriptPaths(filepath.Join(scriptDir, "missing"), harvested); err == nil {
+		t.Fatalf("expected error for a missing script dir")
+	}
+}
+
+func TestEmbeddedScriptsHash(t *testing.T) {
+	scriptDir := t.TempDir()
+	paths := []string{"scripts/cassandra/install.sh", "scripts/common/increase_ssh_connection_limit.sh"}
+	embeddedPolicy := ScriptExecPolicy{}
+	overriddenPolicy := ScriptExecPolicy{ScriptDirs: []string{scriptDir}}
+
+	embeddedHash, err := EmbeddedScriptsHash(paths, embeddedPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameHash, _ := EmbeddedScriptsHash(paths, embeddedPolicy)
+	reversedHash, _ := EmbeddedScriptsHash([]string{paths[1], paths[0]}, embeddedPolicy)
+	noOverrideHash, _ := EmbeddedScriptsHash(paths, overriddenPolicy)
+	writeTestScript(t, scriptDir, "cassandra/install.sh", "echo overridden")
+	overriddenHash, _ := EmbeddedScriptsHash(paths, overriddenPolicy)
+
+	tmplPaths := []string{"scripts/test/install.sh.tmpl"}
+	renderedHash1, _ := EmbeddedScriptsHash(tmplPaths, ScriptExecPolicy{RenderedScripts: map[string]string{tmplPaths[0]: "echo 1"}})
+	renderedHash1Again, _ := EmbeddedScriptsHash(tmplPaths, ScriptExecPolicy{RenderedScripts: map[string]string{tmplPaths[0]: "echo 1"}})
+	renderedHash2, _ := EmbeddedScriptsHash(tmplPaths, ScriptExecPolicy{RenderedScripts: map[string]string{tmplPaths[0]: "echo 2"}})
+
+	cases := []struct {
+		name     string
+		hash1    string
+		hash2    string
+		expectEq bool
+	}{
+		{"same scripts", embeddedHash, sameHash, true},
+		{"script order matters", embeddedHash, reversedHash, false},
+		{"script dir without overrides", embeddedHash, noOverrideHash, true},
+		{"overridden script", embeddedHash, overriddenHash, false},
+		{"same rendered template", renderedHash1, renderedHash1Again, true},
+		{"different rendered template", renderedHash1, renderedHash2, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if (c.hash1 == c.hash2) != c.expectEq {
+				t.Fatalf("expected equal %t: %s vs %s", c.expectEq, c.hash1, c.hash2)
+			}
+		})
+	}
+
+	if _, err := EmbeddedScriptsHash(tmplPaths, ScriptExecPolicy{}); err == nil {
+		t.Fatalf("expected error for a template that was not rendered")
+	}
+	if _, err := EmbeddedScriptsHash([]string{"scripts/no/such.sh"}, ScriptExecPolicy{}); err == nil {
+		t.Fatalf("expected error for a missing script")
+	}
+}
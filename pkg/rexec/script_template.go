@@ -0,0 +1,138 @@
+package rexec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Scripts with this suffix are text/template files, rendered for each instance at project load
+const ScriptTemplateSuffix string = ".tmpl"
+
+func IsScriptTemplate(embeddedScriptPath string) bool {
+	return strings.HasSuffix(embeddedScriptPath, ScriptTemplateSuffix)
+}
+
+var envVarNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Env vars become NAME=value lines in front of the script, anything else in the name would be a command
+func IsValidEnvVarName(name string) bool {
+	return envVarNameRegex.MatchString(name)
+}
+
+// Values made of these characters mean the same to the shell with or without quotes
+var shellSafeValueRegex = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// Single-quoted shell word: no expansion inside, and a single quote itself is closed, escaped and reopened
+func ShellQuote(v string) string {
+	if shellSafeValueRegex.MatchString(v) {
+		return v
+	}
+	return "'" + strings.ReplaceAll(v, "'", `'\''`) + "'"
+}
+
+func shellScalar(v any) (string, error) {
+	switch typedV := v.(type) {
+	case nil:
+		return "''", nil
+	case string:
+		return ShellQuote(typedV), nil
+	case bool:
+		return strconv.FormatBool(typedV), nil
+	case float64:
+		// JSON numbers: 9042, not 9.042e+03
+		return strconv.FormatFloat(typedV, 'f', -1, 64), nil
+	case int:
+		return strconv.Itoa(typedV), nil
+	case int64:
+		return strconv.FormatInt(typedV, 10), nil
+	case fmt.Stringer:
+		return ShellQuote(typedV.String()), nil
+	default:
+		return "", fmt.Errorf("cannot use %T as a shell word, use shjson", v)
+	}
+}
+
+// Template func sh: one shell word for a scalar, space-separated words for a list, so both
+// X={{sh .Params.x}} and for h in {{sh .Params.hosts}} work
+func shellWords(v any) (string, error) {
+	switch typedV := v.(type) {
+	case []any:
+		words := make([]string, len(typedV))
+		for i, item := range typedV {
+			word, err := shellScalar(item)
+			if err != nil {
+				return "", fmt.Errorf("list item %d: %s", i, err.Error())
+			}
+			words[i] = word
+		}
+		return strings.Join(words, " "), nil
+	case []string:
+		words := make([]string, len(typedV))
+		for i, item := range typedV {
+			words[i] = ShellQuote(item)
+		}
+		return strings.Join(words, " "), nil
+	default:
+		return shellScalar(v)
+	}
+}
+
+func jsonString(v any) (string, error) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonBytes), nil
+}
+
+// Template func shjson: JSON as one shell word, like CASSANDRA_HOSTS='["10.5.0.11","10.5.0.12"]'
+func shellJson(v any) (string, error) {
+	s, err := jsonString(v)
+	if err != nil {
+		return "", err
+	}
+	return ShellQuote(s), nil
+}
+
+var scriptTemplateFuncs = template.FuncMap{
+	"sh":     shellWords,
+	"shjson": shellJson,
+	"json":   jsonString, // Not quoted: for heredocs with quoted delimiter and config files
+}
+
+// Renders a template script with data; missing map keys are errors, so typos in param names do not produce empty values
+func RenderScriptTemplate(scriptDirs []string, embeddedScriptPath string, data any) (string, error) {
+	tmplBytes, err := readScript(scriptDirs, embeddedScriptPath)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(embeddedScriptPath).Option("missingkey=error").Funcs(scriptTemplateFuncs).Parse(string(tmplBytes))
+	if err != nil {
+		return "", fmt.Errorf("cannot parse script template: %s", err.Error())
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("cannot render script template: %s", err.Error())
+	}
+	return rendered.String(), nil
+}
+
+// NAME=value lines in name order, so the same env produces the same command
+func envVarsPrefix(envVars map[string]string) string {
+	names := make([]string, 0, len(envVars))
+	for k := range envVars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	sb := strings.Builder{}
+	for _, k := range names {
+		sb.WriteString(fmt.Sprintf("%s=%s\n", k, ShellQuote(envVars[k])))
+	}
+	return sb.String()
+}
@@ -0,0 +1,123 @@
+package rexec
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"10.5.0.11", "10.5.0.11"},
+		{"/data/cassandra,/data1", "/data/cassandra,/data1"},
+		{"user@host:9042", "user@host:9042"},
+		{"", "''"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{`["10.5.0.11","10.5.0.12"]`, `'["10.5.0.11","10.5.0.12"]'`},
+		{"$HOME", "'$HOME'"},
+		{"`id`", "'`id`'"},
+		{"line1\nline2", "'line1\nline2'"},
+		{"'localhost:9100','10.5.0.5:9100'", `''\''localhost:9100'\'','\''10.5.0.5:9100'\'''`},
+	}
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			quoted := ShellQuote(c.value)
+			if quoted != c.expected {
+				t.Fatalf("expected %s, got %s", c.expected, quoted)
+			}
+			// The shell must read it back as the same single word
+			out, err := exec.Command("sh", "-c", "printf '%s|' "+quoted).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != c.value+"|" {
+				t.Fatalf("shell read %q back as %q", c.value, string(out))
+			}
+		})
+	}
+}
+
+func TestScriptTemplateFuncs(t *testing.T) {
+	data := map[string]any{
+		"Nickname": "cass001",
+		"Params": map[string]any{
+			"port":    float64(9042),
+			"ratio":   0.25,
+			"enabled": true,
+			"name":    "it's",
+			"hosts":   []any{"10.5.0.11", "10.5.0.12"},
+			"mixed":   []any{"a b", float64(1), false},
+			"nested":  []any{map[string]any{"x": 1}},
+			"strings": []string{"x", "y z"},
+			"empty":   nil,
+			"obj":     map[string]any{"dc": "dc1", "rf": float64(3)},
+		}}
+
+	cases := []struct {
+		name        string
+		template    string
+		expected    string
+		expectedErr string
+	}{
+		{"sh string", `{{sh .Nickname}}`, "cass001", ""},
+		{"sh quotes", `{{sh .Params.name}}`, `'it'\''s'`, ""},
+		{"sh integer number", `{{sh .Params.port}}`, "9042", ""},
+		{"sh fraction", `{{sh .Params.ratio}}`, "0.25", ""},
+		{"sh bool", `{{sh .Params.enabled}}`, "true", ""},
+		{"sh nil", `{{sh .Params.empty}}`, "''", ""},
+		{"sh list", `{{sh .Params.hosts}}`, "10.5.0.11 10.5.0.12", ""},
+		{"sh mixed list", `{{sh .Params.mixed}}`, "'a b' 1 false", ""},
+		{"sh string list", `{{sh .Params.strings}}`, "x 'y z'", ""},
+		{"sh object", `{{sh .Params.obj}}`, "", "use shjson"},
+		{"sh nested list", `{{sh .Params.nested}}`, "", "list item 0"},
+		{"shjson list", `{{shjson .Params.hosts}}`, `'["10.5.0.11","10.5.0.12"]'`, ""},
+		{"shjson object", `{{shjson .Params.obj}}`, `'{"dc":"dc1","rf":3}'`, ""},
+		{"shjson quotes", `{{shjson .Params.name}}`, `'"it'\''s"'`, ""},
+		{"json", `{{json .Params.obj}}`, `{"dc":"dc1","rf":3}`, ""},
+		{"missing param", `{{sh .Params.prot}}`, "", "cannot render script template"},
+		{"bad syntax", `{{sh .Params.port`, "", "cannot parse script template"},
+	}
+
+	scriptDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(scriptDir, "test"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scriptPath := "scripts/test/" + strings.ReplaceAll(c.name, " ", "_") + ".sh.tmpl"
+			if err := os.WriteFile(filepath.Join(scriptDir, "test", filepath.Base(scriptPath)), []byte(c.template), 0600); err != nil {
+				t.Fatal(err)
+			}
+			rendered, err := RenderScriptTemplate([]string{scriptDir}, scriptPath, data)
+			if c.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.expectedErr) {
+					t.Fatalf("expected error with '%s', got %v", c.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if rendered != c.expected {
+				t.Fatalf("expected %s, got %s", c.expected, rendered)
+			}
+		})
+	}
+}
+
+func TestEnvVarsPrefix(t *testing.T) {
+	prefix := envVarsPrefix(map[string]string{"B": "x y", "A": "10.5.0.11", "C": ""})
+	expected := "A=10.5.0.11\nB='x y'\nC=''\n"
+	if prefix != expected {
+		t.Fatalf("expected %q, got %q", expected, prefix)
+	}
+	if envVarsPrefix(map[string]string{}) != "" {
+		t.Fatalf("expected empty prefix for no env vars")
+	}
+}
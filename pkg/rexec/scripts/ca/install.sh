@@ -14,7 +14,7 @@ cd /home/$SSH_USER/ca
 curl -LOs $CAPILLARIES_RELEASE_URL/ca/ca.tgz
 if [ "$?" -ne "0" ]; then
     echo "Cannot download ca from $CAPILLARIES_RELEASE_URL/ca/ca.tgz to /home/$SSH_USER/ca"
-    exit $?
+    exit 1
 fi
 
 tar xvzf ca.tgz
@@ -12,13 +12,9 @@ if [ "$CASSANDRA_IP" = "" ]; then
   exit 1
 fi
 
-if [ "$NVME_REGEX" = "" ]; then
-  echo Error, missing: export NVME_REGEX="nvme[0-9]n[0-9] 558.8G"
-  exit 1
-fi
-
-if [[ "$NVME_REGEX" != nvme* ]]; then
-  echo Error, NVME_REGEX has unexpected format $NVME_REGEX
+# Mounted by capideploy (see instance_store in the project), like /data0,/data1
+if [ "$INSTANCE_STORE_MOUNTS" = "" ]; then
+  echo Error, missing: export INSTANCE_STORE_MOUNTS=/data0,/data1
   exit 1
 fi
 
@@ -37,18 +33,16 @@ sudo sed -i -e "s~endpoint_snitch:[\: \"a-zA-Z0-9\.]*~endpoint_snitch: SimpleSni
 #sudo sed -i -e "s~- /var/lib/cassandra/data~- /data/d~g" /etc/cassandra/cassandra.yaml
 #sudo sed -i -e "s~- /var/lib/cassandra/data~- /mnt/ramdisk/data~g" /etc/cassandra/cassandra.yaml
 sudo sed -i -e "s~- /var/lib/cassandra/data~~g" /etc/cassandra/cassandra.yaml
-# One disk or two disks (Cassandra instances can have one ore two nvme drives)
-if [ -d "/data1" ]; then
-  sudo sed -i -e "s~data_file_directories:[^\n]*~data_file_directories: [ /data0/d, /data1/d ]~g" /etc/cassandra/cassandra.yaml
-else 
-  sudo sed -i -e "s~data_file_directories:[^\n]*~data_file_directories: [ /data0/d ]~g" /etc/cassandra/cassandra.yaml
-fi
+# One or more instance store disks (or one RAID0 array)
+dataFileDirectories=$(echo $INSTANCE_STORE_MOUNTS | sed -e "s~,~/d, ~g")/d
+sudo sed -i -e "s~data_file_directories:[^\n]*~data_file_directories: [ $dataFileDirectories ]~g" /etc/cassandra/cassandra.yaml
+firstMount=$(echo $INSTANCE_STORE_MOUNTS | cut -d, -f1)
 
 # Commitlog on attached volume. Comment out to store commitlog on the ephemeral instance volume at /var/lib/cassandra/commitlog.
 #sudo sed -i -e "s~/var/lib/cassandra/commitlog~/data/c~g" /etc/cassandra/cassandra.yaml
 #sudo sed -i -e "s~/var/lib/cassandra/commitlog~/mnt/ramdisk/commitlog~g" /etc/cassandra/cassandra.yaml
 #sudo sed -i -e "s~/var/lib/cassandra/commitlog~~g" /etc/cassandra/cassandra.yaml
-sudo sed -i -e "s~commitlog_directory:[^\n]*~commitlog_directory: /data0/c~g" /etc/cassandra/cassandra.yaml
+sudo sed -i -e "s~commitlog_directory:[^\n]*~commitlog_directory: $firstMount/c~g" /etc/cassandra/cassandra.yaml
 
 # Minimal number of vnodes, we do not need elasticity
 sudo sed -i -e "s~num_tokens:[ 0-9]*~num_tokens: 1~g" /etc/cassandra/cassandra.yaml
@@ -75,14 +69,18 @@ sudo sed -i -e "s~write_request_timeout_in_ms:[ ]*[0-9]*~write_request_timeout_i
 
 sudo rm -fR /var/lib/cassandra/data/*
 sudo rm -fR /var/lib/cassandra/commitlog/*
-if [ ! -d "/data0" ]; then
-  sudo rm -fR /data0/*
-fi
-if [ ! -d "/data1" ]; then
-  sudo rm -fR /data1/*
-fi
+for mountPoint in $(echo $INSTANCE_STORE_MOUNTS | tr ',' ' '); do
+  sudo rm -fR $mountPoint/d $mountPoint/c
+done
 sudo rm -fR /var/lib/cassandra/saved_caches/*
 
+# Replacing a dead node: the new node takes over tokens of the node at this address (which may be its own address).
+# Always drop the option left by a previous replacement, otherwise the next config run replaces the node's own live address
+sudo sed -i '/replace_address_first_boot/d' /etc/cassandra/cassandra-env.sh
+if [ "$CASSANDRA_REPLACE_ADDRESS" != "" ]; then
+  echo 'JVM_OPTS="$JVM_OPTS -Dcassandra.replace_address_first_boot='$CASSANDRA_REPLACE_ADDRESS'"' | sudo tee -a /etc/cassandra/cassandra-env.sh
+fi
+
 # To avoid "Cannot start node if snitch’s data center (dc1) differs from previous data center (datacenter1)"
 # error, keep using dc and rack variables as they are (dc1,rack1) in /etc/cassandra/cassandra-rackdc.properties
 # but ignore the dc - it's a testing env
@@ -95,43 +93,8 @@ sudo rm -f rm /etc/cassandra/cassandra-topology.properties
 sudo sed -i -e "s~<maxFileSize>[^<]*</maxFileSize>~<maxFileSize>10MB</maxFileSize>~g" /etc/cassandra/logback.xml
 sudo sed -i -e "s~<totalSizeCap>[^<]*</totalSizeCap>~<totalSizeCap>1GB</totalSizeCap>~g" /etc/cassandra/logback.xml
 
-mount_device(){
-	local mount_dir="/data"$1
- 	local device_name=$2
-    echo Mounting $device_name at $mount_dir
-    if [ "$(lsblk -f | grep -E $device_name'[ ]+xfs')" == "" ]; then
-      echo Formatting partition
-	    sudo mkfs -t xfs /dev/$device_name
-    else
-      echo Partition already formatted
-    fi
-    if [ ! -d "$mount_dir" ]; then
-      echo Creating $mount_dir
-	  sudo mkdir $mount_dir
-    else
-      echo $mount_dir already created
-    fi
-    if [ "$(lsblk -f | grep $mount_dir)" == "" ]; then
-      echo Mounting...
-	    sudo mount /dev/$device_name $mount_dir
-    else
-      echo Already mounted
-    fi
-	sudo chown cassandra $mount_dir
-	sudo chmod 777 $mount_dir;
-}
-
-# "nvme[0-9]n[0-9] 558.8G"
-# "loop[0-9] [0-9.]+M"
-device_number=0
-lsblk | awk '{print $1,$4}' | grep -E "$NVME_REGEX" | awk '{print $1}' |
-while read -r device_name; do
-  mount_device $device_number $device_name
-  device_number=$((device_number+1)) 
-done
-
 sudo systemctl start cassandra
 if [ "$?" -ne "0" ]; then
     echo Cannot start cassandra, exiting
-    exit $?
+    exit 1
 fi
@@ -26,7 +26,7 @@ sudo DEBIAN_FRONTEND=noninteractive apt-get update -y
 sudo DEBIAN_FRONTEND=noninteractive apt-get install -y sysstat 2>/dev/null
 if [ "$?" -ne "0" ]; then
     echo sysstat install error, exiting
-    exit $?
+    exit 1
 fi
 
 # Cassandra requires Java 8
@@ -34,27 +34,27 @@ fi
 sudo DEBIAN_FRONTEND=noninteractive apt-get install -y openjdk-8-jdk openjdk-8-jre 2>/dev/null
 if [ "$?" -ne "0" ]; then
     echo openjdk install error, exiting
-    exit $?
+    exit 1
 fi
 
 # apt-get install has a habit to write "Running kernel seems to be up-to-date." to stderr. Ignore it and rely on the exit code
 sudo DEBIAN_FRONTEND=noninteractive apt-get install -y cassandra 2>/dev/null
 if [ "$?" -ne "0" ]; then
     echo cassandra install error, exiting
-    exit $?
+    exit 1
 fi
 
 sudo systemctl status cassandra
 if [ "$?" -ne "0" ]; then
     echo Bad cassandra service status, exiting
-    exit $?
+    exit 1
 fi
 
 # JMX Exporter
 curl -LOs https://repo1.maven.org/maven2/io/prometheus/jmx/jmx_prometheus_javaagent/$JMX_EXPORTER_VERSION/jmx_prometheus_javaagent-$JMX_EXPORTER_VERSION.jar
 if [ "$?" -ne "0" ]; then
     echo Cannot download JMX exporter, exiting
-    exit $?
+    exit 1
 fi
 sudo mv jmx_prometheus_javaagent-$JMX_EXPORTER_VERSION.jar /usr/share/cassandra/lib/
 sudo chown cassandra /usr/share/cassandra/lib/jmx_prometheus_javaagent-$JMX_EXPORTER_VERSION.jar
@@ -140,28 +140,6 @@ sudo chmod 755 /var/log/cassandra
 # sudo mount -t tmpfs -o size="$RAM_DISK_SIZE"m myramdisk /mnt/ramdisk
 # if [ "$?" -ne "0" ]; then
 #     echo Cannot mount ramdisk, exiting
-#     exit $?
+#     exit 1
 # fi
 
-# It requires cassandra user, so do not run it before you install Cassandra
-# This will mount NVME devices to /data0, /data1, etc
-# mount_device(){
-# 	mount_dir="/data"$1
-# 	device_name=$2
-# 	sudo mkfs -t xfs /dev/$device_name
-# 	sudo mkdir $mount_dir
-# 	sudo mount /dev/$device_name $mount_dir
-# 	sudo chown cassandra $mount_dir
-# 	sudo chmod 777 $mount_dir;
-# }
-
-# # "nvme[0-9]n[0-9] 558.8G"
-# # "loop[0-9] [0-9.]+M"
-# device_number=0
-# lsblk | awk '{print $1,$4}' | grep -E "$NVME_REGEX" | awk '{print $1}' |
-# while read -r device_name; do
-#   mount_device $device_number $device_name
-#   device_number=$((device_number+1)) 
-# done
-
-# echo $device_number disks matching: $NVME_REGEX
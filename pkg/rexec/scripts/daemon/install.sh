@@ -27,12 +27,12 @@ cd /home/$SSH_USER/bin
 curl -LOs $CAPILLARIES_RELEASE_URL/$OS_ARCH/$CAPI_BINARY.gz
 if [ "$?" -ne "0" ]; then
     echo "Cannot download $CAPILLARIES_RELEASE_URL/$OS_ARCH/$CAPI_BINARY.gz to /home/$SSH_USER/bin"
-    exit $?
+    exit 1
 fi
 curl -LOs $CAPILLARIES_RELEASE_URL/$OS_ARCH/$CAPI_BINARY.json
 if [ "$?" -ne "0" ]; then
     echo "Cannot download from $CAPILLARIES_RELEASE_URL/$OS_ARCH/$CAPI_BINARY.json to /home/$SSH_USER/bin"
-    exit $?
+    exit 1
 fi
 gzip -d -f $CAPI_BINARY.gz
 chmod 744 $CAPI_BINARY
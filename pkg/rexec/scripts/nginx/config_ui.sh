@@ -32,7 +32,7 @@ fi
 sudo nginx -t 2>/dev/null
 if [ "$?" -ne "0" ]; then
     echo nginx config error, exiting
-    exit $?
+    exit 1
 fi
 
 sudo systemctl restart nginx
\ No newline at end of file
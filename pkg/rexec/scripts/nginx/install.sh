@@ -4,7 +4,7 @@
 sudo DEBIAN_FRONTEND=noninteractive apt-get install -y nginx 2>/dev/null
 if [ "$?" -ne "0" ]; then
     echo nginx install error, exiting
-    exit $?
+    exit 1
 fi
 
 # Remove nginx stub site
@@ -14,7 +14,7 @@ sudo rm -f /etc/nginx/sites-enabled/default
 sudo nginx -t 2>/dev/null
 if [ "$?" -ne "0" ]; then
     echo nginx config error, exiting
-    exit $?
+    exit 1
 fi
 
 sudo systemctl restart nginx
\ No newline at end of file
@@ -28,5 +28,5 @@ sudo systemctl status node_exporter
 curl -s http://localhost:9100/metrics > /dev/null
 if [ "$?" -ne "0" ]; then
     echo localhost:9100/metrics
-    exit $?
+    exit 1
 fi
@@ -2,7 +2,7 @@
 # https://www.digitalocean.com/community/tutorials/how-to-install-prometheus-on-ubuntu-16-04
 
 if [ "$PROMETHEUS_TARGETS" = "" ]; then
-  echo "Error, missing: PROMETHEUS_TARGETS=\'localhost:9100\',\'10.5.1.10:9100\'"
+  echo "Error, missing: PROMETHEUS_TARGETS=\"'localhost:9100','10.5.1.10:9100'\""
  exit 1
 fi
 
@@ -53,5 +53,5 @@ sudo systemctl status prometheus
 curl -s http://localhost:9090
 if [ "$?" -ne "0" ]; then
     echo Cannot check localhost:9090
-    exit $?
+    exit 1
 fi
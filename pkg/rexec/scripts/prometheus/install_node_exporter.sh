@@ -20,7 +20,7 @@ echo Downloading https://github.com/prometheus/node_exporter/releases/download/v
 curl -LOs https://github.com/prometheus/node_exporter/releases/download/v$PROMETHEUS_NODE_EXPORTER_VERSION/$EXPORTER_DL_FILE.tar.gz
 if [ "$?" -ne "0" ]; then
     echo Cannot download, exiting
-    exit $?
+    exit 1
 fi
 tar xvf $EXPORTER_DL_FILE.tar.gz
 
@@ -28,7 +28,7 @@ echo Downloading https://github.com/prometheus/prometheus/releases/download/v$PR
 curl -LOs https://github.com/prometheus/prometheus/releases/download/v$PROMETHEUS_VERSION/$PROMETHEUS_DL_FILE.tar.gz
 if [ "$?" -ne "0" ]; then
     echo Cannot download, exiting
-    exit $?
+    exit 1
 fi
 tar xvf $PROMETHEUS_DL_FILE.tar.gz
 
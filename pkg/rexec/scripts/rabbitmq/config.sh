@@ -36,5 +36,5 @@ sudo rabbitmqctl set_permissions -p / $RABBITMQ_USER_NAME ".*" ".*" ".*"
 curl -s http://localhost:15672
 if [ "$?" -ne "0" ]; then
     echo Cannot check localhost:15672
-    exit $?
+    exit 1
 fi
@@ -21,14 +21,14 @@ sudo DEBIAN_FRONTEND=noninteractive apt-get update -y
 sudo DEBIAN_FRONTEND=noninteractive apt-get install -y curl gnupg 2>/dev/null
 if [ "$?" -ne "0" ]; then
     echo gnugpg install error, exiting
-    exit $?
+    exit 1
 fi
 
 # apt-get install has a habit to write "Running kernel seems to be up-to-date." to stderr. Ignore it and rely on the exit code
 sudo DEBIAN_FRONTEND=noninteractive apt-get install -y apt-transport-https 2>/dev/null
 if [ "$?" -ne "0" ]; then
     echo apt-transport-https install error, exiting
-    exit $?
+    exit 1
 fi
 
 ## Team RabbitMQ's main signing key
@@ -106,12 +106,12 @@ sudo DEBIAN_FRONTEND=noninteractive apt-get install -y erlang-base=$ERLANG_VER \
                         erlang-syntax-tools=$ERLANG_VER erlang-tftp=$ERLANG_VER erlang-tools=$ERLANG_VER erlang-xmerl 2>/dev/null
 if [ "$?" -ne "0" ]; then
     echo erlang install error, exiting
-    exit $?
+    exit 1
 fi
 
 # apt-get install has a habit to write "Running kernel seems to be up-to-date." to stderr. Ignore it and rely on the exit code
 sudo DEBIAN_FRONTEND=noninteractive apt-get install -y --fix-missing rabbitmq-server=$RABBITMQ_VER 2>/dev/null
 if [ "$?" -ne "0" ]; then
     echo rabbitmq install error, exiting
-    exit $?
+    exit 1
 fi
@@ -14,7 +14,7 @@ cd /home/$SSH_USER/ui
 curl -LOs $CAPILLARIES_RELEASE_URL/webui/webui.tgz
 if [ "$?" -ne "0" ]; then
     echo "Cannot download webui from $CAPILLARIES_RELEASE_URL/webui/webui.tgz to /home/$SSH_USER/ui"
-    exit $?
+    exit 1
 fi
 
 tar xvzf webui.tgz
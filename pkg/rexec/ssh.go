@@ -4,9 +4,7 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"net"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -84,7 +82,7 @@ func signerFromPem(pemBytes []byte) (ssh.Signer, error) {
 // 	}
 // }
 
-func NewSshClientConfig(user string, privateKeyOrPath string) (*ssh.ClientConfig, error) {
+func NewSshClientConfig(user string, privateKeyOrPath string, hostKeyCallback ssh.HostKeyCallback) (*ssh.ClientConfig, error) {
 	reBegin := regexp.MustCompile(`-----BEGIN [ a-zA-Z0-9]+ KEY-----`)
 	reEnd := regexp.MustCompile(`-----END [ a-zA-Z0-9]+ KEY-----`)
 	strBegin := reBegin.FindString(privateKeyOrPath)
@@ -101,11 +99,7 @@ func NewSshClientConfig(user string, privateKeyOrPath string) (*ssh.ClientConfig
 			return nil, fmt.Errorf("cannot use private key starting with %s: %s", strBegin, err.Error())
 		}
 	} else {
-		keyPath := privateKeyOrPath
-		if strings.HasPrefix(keyPath, "~/") {
-			homeDir, _ := os.UserHomeDir()
-			keyPath = filepath.Join(homeDir, keyPath[2:])
-		}
+		keyPath := ExpandHomePath(privateKeyOrPath)
 		pemBytes, err := os.ReadFile(keyPath)
 		if err != nil {
 			return nil, fmt.Errorf("cannot read private key file %s: %s", keyPath, err.Error())
@@ -122,9 +116,6 @@ func NewSshClientConfig(user string, privateKeyOrPath string) (*ssh.ClientConfig
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// use known_hosts file if you care about host validation
-			return nil
-		},
+		HostKeyCallback: hostKeyCallback,
 	}, nil
 }
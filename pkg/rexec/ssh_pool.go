@@ -0,0 +1,193 @@
+package rexec
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Health check round trip should be fast, a stopped/replaced instance or a dead tunnel may never answer
+const sshPoolHealthCheckTimeout time.Duration = 5 * time.Second
+
+// Keeps one bastion ssh client for all tunnels and one client per internal host for the duration of a capideploy command,
+// so scripts and commands do not pay for two handshakes each. Clients are health-checked before reuse and re-dialed if dead.
+type SshPool struct {
+	mx         sync.Mutex
+	bastionMx  sync.Mutex
+	bastionKey string
+	bastion    *ssh.Client
+	hosts      map[string]*ssh.Client
+	hostMxs    map[string]*sync.Mutex
+}
+
+func NewSshPool() *SshPool {
+	return &SshPool{
+		hosts:   map[string]*ssh.Client{},
+		hostMxs: map[string]*sync.Mutex{}}
+}
+
+var defaultSshPool = NewSshPool()
+
+// Called once the command is complete
+func CloseSshPool() {
+	defaultSshPool.Close()
+}
+
+func sshPoolKey(sshConfig *SshConfigDef, ipAddress string) string {
+	return fmt.Sprintf("%s@%s:%d", sshConfig.User, ipAddress, sshConfig.Port)
+}
+
+func isSshClientAlive(sshClient *ssh.Client) bool {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err == nil
+	case <-time.After(sshPoolHealthCheckTimeout):
+		return false
+	}
+}
+
+func (pool *SshPool) getBastionClient(sshConfig *SshConfigDef) (*ssh.Client, error) {
+	pool.bastionMx.Lock()
+	defer pool.bastionMx.Unlock()
+
+	bastionKey := sshPoolKey(sshConfig, sshConfig.BastionExternalIp)
+	if pool.bastion != nil {
+		if pool.bastionKey == bastionKey && isSshClientAlive(pool.bastion) {
+			return pool.bastion, nil
+		}
+		pool.bastion.Close()
+		pool.bastion = nil
+	}
+
+	bastionSshClientConfig, err := NewSshClientConfig(
+		sshConfig.User,
+		sshConfig.PrivateKeyOrPath,
+		sshConfig.hostKeyCallback())
+	if err != nil {
+		return nil, err
+	}
+
+	bastionUrl := fmt.Sprintf("%s:%d", sshConfig.BastionExternalIp, sshConfig.Port)
+	bastionClient, err := ssh.Dial("tcp", bastionUrl, bastionSshClientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("dial to bastion %s failed: %s", bastionUrl, err.Error())
+	}
+
+	pool.bastionKey = bastionKey
+	pool.bastion = bastionClient
+	return bastionClient, nil
+}
+
+func (pool *SshPool) getHostMx(hostKey string) *sync.Mutex {
+	pool.mx.Lock()
+	defer pool.mx.Unlock()
+	hostMx, ok := pool.hostMxs[hostKey]
+	if !ok {
+		hostMx = &sync.Mutex{}
+		pool.hostMxs[hostKey] = hostMx
+	}
+	return hostMx
+}
+
+// Returns a session-capable client for the host: bastion itself, or an internal host tunneled through bastion
+func (pool *SshPool) GetClient(sshConfig *SshConfigDef, ipAddress string) (*ssh.Client, error) {
+	if ipAddress == sshConfig.BastionExternalIp {
+		return pool.getBastionClient(sshConfig)
+	}
+
+	// Concurrent callers for the same host wait for one dial instead of dialing twice
+	hostKey := sshPoolKey(sshConfig, ipAddress)
+	hostMx := pool.getHostMx(hostKey)
+	hostMx.Lock()
+	defer hostMx.Unlock()
+
+	pool.mx.Lock()
+	hostClient := pool.hosts[hostKey]
+	pool.mx.Unlock()
+
+	if hostClient != nil {
+		if isSshClientAlive(hostClient) {
+			return hostClient, nil
+		}
+		hostClient.Close()
+		pool.mx.Lock()
+		delete(pool.hosts, hostKey)
+		pool.mx.Unlock()
+	}
+
+	bastionClient, err := pool.getBastionClient(sshConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	internalUrl := fmt.Sprintf("%s:%d", ipAddress, sshConfig.Port)
+	tunneledTcpConn, err := bastionClient.Dial("tcp", internalUrl)
+	if err != nil {
+		return nil, fmt.Errorf("dial to internal URL %s failed: %s", internalUrl, err.Error())
+	}
+
+	tunneledSshClientConfig, err := NewSshClientConfig(
+		sshConfig.User,
+		sshConfig.PrivateKeyOrPath,
+		sshConfig.hostKeyCallback())
+	if err != nil {
+		tunneledTcpConn.Close()
+		return nil, err
+	}
+	tunneledSshConn, chans, reqs, err := ssh.NewClientConn(tunneledTcpConn, internalUrl, tunneledSshClientConfig)
+	if err != nil {
+		tunneledTcpConn.Close()
+		return nil, fmt.Errorf("cannot establish ssh connection via TCP tunnel to internal URL %s: %s", internalUrl, err.Error())
+	}
+
+	hostClient = ssh.NewClient(tunneledSshConn, chans, reqs)
+	pool.mx.Lock()
+	pool.hosts[hostKey] = hostClient
+	pool.mx.Unlock()
+	return hostClient, nil
+}
+
+// Drops the client for the host, next GetClient re-dials. Evicting bastion drops the bastion client only:
+// tunneled clients fail their health check if they were using it.
+func (pool *SshPool) Evict(sshConfig *SshConfigDef, ipAddress string) {
+	if ipAddress == sshConfig.BastionExternalIp {
+		pool.bastionMx.Lock()
+		defer pool.bastionMx.Unlock()
+		if pool.bastion != nil {
+			pool.bastion.Close()
+			pool.bastion = nil
+		}
+		return
+	}
+
+	hostKey := sshPoolKey(sshConfig, ipAddress)
+	pool.mx.Lock()
+	defer pool.mx.Unlock()
+	if hostClient, ok := pool.hosts[hostKey]; ok {
+		hostClient.Close()
+		delete(pool.hosts, hostKey)
+	}
+}
+
+func (pool *SshPool) Close() {
+	pool.mx.Lock()
+	for hostKey, hostClient := range pool.hosts {
+		hostClient.Close()
+		delete(pool.hosts, hostKey)
+	}
+	pool.mx.Unlock()
+
+	pool.bastionMx.Lock()
+	if pool.bastion != nil {
+		pool.bastion.Close()
+		pool.bastion = nil
+	}
+	pool.bastionMx.Unlock()
+}
@@ -0,0 +1,167 @@
+package rexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	TransportSsh string = "ssh"
+	TransportSsm string = "ssm"
+)
+
+// How commands reach instances. Run returns when the command is complete, or, if goCtx is done, when the remote command
+// is stopped and stdout/stderr are not written anymore. Exit status is -1 if the command did not complete;
+// non-zero exit status comes with an error.
+type Transport interface {
+	Run(goCtx context.Context, ipAddress string, cmd string, stdout io.Writer, stderr io.Writer) (int, error)
+}
+
+// Set by the deploy provider for transports that need cloud clients, like ssm. Without it, commands go over ssh.
+func (sshConfig *SshConfigDef) SetTransport(transport Transport) {
+	sshConfig.transport = transport
+}
+
+// Interactive shells, port forwarding and tunnels need ssh connections, commands alone do not
+func (sshConfig *SshConfigDef) checkSshAvailable() error {
+	if sshConfig.Transport == TransportSsm {
+		return fmt.Errorf("not available with %s transport, use aws ssm start-session instead", TransportSsm)
+	}
+	return nil
+}
+
+func (sshConfig *SshConfigDef) getTransport() Transport {
+	if sshConfig.transport != nil {
+		return sshConfig.transport
+	}
+	return &sshTransport{sshConfig: sshConfig, pool: defaultSshPool}
+}
+
+// On timeout or cancellation, give the remote process this long to exit after the signal before closing the session
+const remoteCmdStopGracePeriod time.Duration = 5 * time.Second
+
+// Sessions on pooled ssh clients, through bastion for internal instances
+type sshTransport struct {
+	sshConfig *SshConfigDef
+	pool      *SshPool
+}
+
+// A live client refuses new sessions while other callers hold theirs (sshd MaxSessions, 10 by default)
+const (
+	sshNewSessionRetries    int           = 5
+	sshNewSessionRetryDelay time.Duration = 2 * time.Second
+)
+
+// Clients are shared: wait for other callers to release their sessions instead of closing the client under them.
+// Dead clients fail the pool health check and are re-dialed by GetClient.
+func (t *sshTransport) newSession(goCtx context.Context, ipAddress string) (*ssh.Session, error) {
+	var lastErr error
+	for attempt := 0; attempt <= sshNewSessionRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-goCtx.Done():
+				return nil, goCtx.Err()
+			case <-time.After(time.Duration(attempt) * sshNewSessionRetryDelay):
+			}
+		}
+		sshClient, err := t.pool.GetClient(t.sshConfig, ipAddress)
+		if err != nil {
+			return nil, err
+		}
+		session, err := sshClient.NewSession()
+		if err == nil {
+			return session, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("cannot create session for %s: %s", ipAddress, lastErr.Error())
+}
+
+func (t *sshTransport) Run(goCtx context.Context, ipAddress string, cmd string, stdout io.Writer, stderr io.Writer) (int, error) {
+	session, err := t.newSession(goCtx, ipAddress)
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- session.Run(cmd)
+	}()
+
+	select {
+	case err = <-runDone:
+	case <-goCtx.Done():
+		t.stopRemoteCmd(ipAddress, session, runDone)
+		return -1, goCtx.Err()
+	}
+
+	if err == nil {
+		return 0, nil
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), err
+	}
+	return -1, err
+}
+
+// Signals the remote process, closes the session, and, if the connection does not respond at all, drops it.
+// Returns only when session.Run is done, so stdout/stderr buffers are not written anymore.
+func (t *sshTransport) stopRemoteCmd(ipAddress string, session *ssh.Session, runDone <-chan error) {
+	// Best effort: older sshd versions ignore signal requests
+	_ = session.Signal(ssh.SIGTERM)
+	select {
+	case <-runDone:
+		return
+	case <-time.After(remoteCmdStopGracePeriod):
+	}
+
+	session.Close()
+	select {
+	case <-runDone:
+		return
+	case <-time.After(remoteCmdStopGracePeriod):
+	}
+
+	t.pool.Evict(t.sshConfig, ipAddress)
+	<-runDone
+}
+
+// Runs commands with local sh instead of an instance. A fake for exercising rexec callers and scripts without a deployment;
+// not selectable in the project file, use SshConfigDef.SetTransport.
+type LocalShellTransport struct {
+	OnRun func(ipAddress string, cmd string) // Optional, tells which command was meant for which instance
+}
+
+func (t *LocalShellTransport) Run(goCtx context.Context, ipAddress string, cmd string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if t.OnRun != nil {
+		t.OnRun(ipAddress, cmd)
+	}
+	localCmd := exec.CommandContext(goCtx, "sh", "-c", cmd)
+	localCmd.Stdout = stdout
+	localCmd.Stderr = stderr
+	// Children of sh may hold stdout/stderr open after sh is killed
+	localCmd.WaitDelay = remoteCmdStopGracePeriod
+	err := localCmd.Run()
+	if goCtx.Err() != nil {
+		return -1, goCtx.Err()
+	}
+	if err == nil {
+		return 0, nil
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), err
+	}
+	return -1, err
+}
@@ -0,0 +1,178 @@
+package rexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// SendCommand is asynchronous, there is no way to wait for the result other than polling
+const ssmCommandPollInterval time.Duration = 2 * time.Second
+
+// CancelCommand is called after goCtx is done, so it needs its own deadline
+const ssmCancelCommandTimeout time.Duration = 30 * time.Second
+
+// GetCommandInvocation returns at most this much of stdout and stderr, the rest is only available in S3/CloudWatch
+const (
+	ssmStdoutLimit int = 24000
+	ssmStderrLimit int = 8000
+)
+
+// Marks the end of the script in the heredoc, scripts are not expected to have this line
+const ssmScriptHeredocDelimiter string = "CAPIDEPLOY_SSM_SCRIPT_EOF"
+
+// Instance id for the address capideploy uses for this instance (internal, or external for bastion)
+type SsmInstanceIdResolver func(goCtx context.Context, ipAddress string) (string, error)
+
+// Runs commands with SSM SendCommand (AWS-RunShellScript): no inbound ssh needed, the SSM agent on the instance
+// talks to SSM using the instance profile. Output comes back when the command is complete; SSM truncates stdout to 24000 chars,
+// which is an error, and stderr to 8000 chars.
+type SsmTransport struct {
+	client            *ssm.Client
+	user              string
+	resolveInstanceId SsmInstanceIdResolver
+	mx                sync.Mutex
+	instanceIds       map[string]string
+}
+
+func NewSsmTransport(client *ssm.Client, user string, resolveInstanceId SsmInstanceIdResolver) *SsmTransport {
+	return &SsmTransport{
+		client:            client,
+		user:              user,
+		resolveInstanceId: resolveInstanceId,
+		instanceIds:       map[string]string{}}
+}
+
+func (t *SsmTransport) instanceId(goCtx context.Context, ipAddress string) (string, error) {
+	t.mx.Lock()
+	instanceId, ok := t.instanceIds[ipAddress]
+	t.mx.Unlock()
+	if ok {
+		return instanceId, nil
+	}
+	instanceId, err := t.resolveInstanceId(goCtx, ipAddress)
+	if err != nil {
+		return "", fmt.Errorf("cannot find instance id for %s: %s", ipAddress, err.Error())
+	}
+	t.mx.Lock()
+	t.instanceIds[ipAddress] = instanceId
+	t.mx.Unlock()
+	return instanceId, nil
+}
+
+func (t *SsmTransport) forgetInstanceId(ipAddress string) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	delete(t.instanceIds, ipAddress)
+}
+
+// SSM agent runs commands as root in /, while scripts expect the ssh user, its home directory and an empty stdin
+func ssmUserCommand(user string, cmd string) string {
+	return fmt.Sprintf(`capideployScript=$(mktemp)
+cat > $capideployScript <<'%s'
+%s
+%s
+chown %s $capideployScript
+chmod 600 $capideployScript
+sudo -u %s -i bash $capideployScript < /dev/null
+capideployExitCode=$?
+rm -f $capideployScript
+exit $capideployExitCode`, ssmScriptHeredocDelimiter, cmd, ssmScriptHeredocDelimiter, user, user)
+}
+
+func (t *SsmTransport) cancelCommand(commandId string, instanceId string) {
+	cancelCtx, cancel := context.WithTimeout(context.Background(), ssmCancelCommandTimeout)
+	defer cancel()
+	// Best effort: the command may be complete by now
+	_, _ = t.client.CancelCommand(cancelCtx, &ssm.CancelCommandInput{CommandId: aws.String(commandId), InstanceIds: []string{instanceId}})
+}
+
+func (t *SsmTransport) Run(goCtx context.Context, ipAddress string, cmd string, stdout io.Writer, stderr io.Writer) (int, error) {
+	instanceId, err := t.instanceId(goCtx, ipAddress)
+	if err != nil {
+		return -1, err
+	}
+
+	params := map[string][]string{"commands": {ssmUserCommand(t.user, cmd)}}
+	if deadline, ok := goCtx.Deadline(); ok {
+		// Agent-side timeout, so the command does not outlive us if CancelCommand does not make it
+		params["executionTimeout"] = []string{strconv.Itoa(int(time.Until(deadline).Seconds()) + 1)}
+	}
+	sendCommandInput := &ssm.SendCommandInput{
+		DocumentName: aws.String("AWS-RunShellScript"),
+		InstanceIds:  []string{instanceId},
+		Parameters:   params,
+		Comment:      aws.String("capideploy")}
+	sendOut, err := t.client.SendCommand(goCtx, sendCommandInput)
+	var invalidInstanceErr *types.InvalidInstanceId
+	if err != nil && errors.As(err, &invalidInstanceErr) {
+		// Instance at this address was replaced since it was resolved
+		t.forgetInstanceId(ipAddress)
+		instanceId, err = t.instanceId(goCtx, ipAddress)
+		if err != nil {
+			return -1, err
+		}
+		sendCommandInput.InstanceIds = []string{instanceId}
+		sendOut, err = t.client.SendCommand(goCtx, sendCommandInput)
+	}
+	if err != nil {
+		return -1, fmt.Errorf("cannot send command to %s(%s): %s", ipAddress, instanceId, err.Error())
+	}
+	commandId := *sendOut.Command.CommandId
+
+	for {
+		select {
+		case <-goCtx.Done():
+			t.cancelCommand(commandId, instanceId)
+			return -1, goCtx.Err()
+		case <-time.After(ssmCommandPollInterval):
+		}
+
+		invOut, err := t.client.GetCommandInvocation(goCtx, &ssm.GetCommandInvocationInput{CommandId: aws.String(commandId), InstanceId: aws.String(instanceId)})
+		if err != nil {
+			var notYetErr *types.InvocationDoesNotExist
+			if errors.As(err, &notYetErr) || goCtx.Err() != nil {
+				// Invocation shows up shortly after SendCommand; cancellation is handled above
+				continue
+			}
+			return -1, fmt.Errorf("cannot get command %s invocation on %s(%s): %s", commandId, ipAddress, instanceId, err.Error())
+		}
+
+		switch invOut.Status {
+		case types.CommandInvocationStatusPending,
+			types.CommandInvocationStatusInProgress,
+			types.CommandInvocationStatusDelayed,
+			types.CommandInvocationStatusCancelling:
+			continue
+		}
+
+		stdoutContent := aws.ToString(invOut.StandardOutputContent)
+		stderrContent := aws.ToString(invOut.StandardErrorContent)
+		if len(stderrContent) >= ssmStderrLimit {
+			stderrContent += "\n(stderr truncated by SSM)\n"
+		}
+		_, _ = io.WriteString(stdout, stdoutContent)
+		_, _ = io.WriteString(stderr, stderrContent)
+
+		if invOut.Status == types.CommandInvocationStatusSuccess {
+			// Callers parse stdout (last line of volume and instance store scripts), a cut-off result would be silently wrong
+			if len(stdoutContent) >= ssmStdoutLimit {
+				return 0, fmt.Errorf("command %s on %s(%s) succeeded, but its stdout is truncated by SSM to %d chars", commandId, ipAddress, instanceId, ssmStdoutLimit)
+			}
+			return 0, nil
+		}
+		exitStatus := int(invOut.ResponseCode)
+		if exitStatus < 0 || invOut.Status != types.CommandInvocationStatusFailed {
+			exitStatus = -1
+		}
+		return exitStatus, fmt.Errorf("command %s on %s(%s) is %s, exit code %d: %s", commandId, ipAddress, instanceId, invOut.Status, invOut.ResponseCode, aws.ToString(invOut.StatusDetails))
+	}
+}
@@ -0,0 +1,158 @@
+package rexec
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLocalShellSshConfig(onRun func(ipAddress string, cmd string)) *SshConfigDef {
+	sshConfig := &SshConfigDef{User: "ubuntu", Port: 22}
+	sshConfig.SetTransport(&LocalShellTransport{OnRun: onRun})
+	return sshConfig
+}
+
+func TestExecSshExitStatus(t *testing.T) {
+	sshConfig := newLocalShellSshConfig(nil)
+
+	er := ExecSsh(context.Background(), sshConfig, "10.5.0.11", "echo hello", map[string]string{}, 5)
+	if er.Error != nil || er.ExitStatus != 0 || er.Stdout != "hello\n" {
+		t.Fatalf("unexpected result of successful command: %s", er.ToString())
+	}
+
+	er = ExecSsh(context.Background(), sshConfig, "10.5.0.11", "echo partial; echo broken >&2; exit 3", map[string]string{}, 5)
+	if er.Error == nil || er.ExitStatus != 3 {
+		t.Fatalf("expected exit status 3 and an error: %s", er.ToString())
+	}
+	if er.Stdout != "partial\n" || er.Stderr != "broken\n" {
+		t.Fatalf("expected output of failed command to be kept: %s", er.ToString())
+	}
+	if !strings.Contains(er.Error.Error(), "broken") {
+		t.Fatalf("expected first stderr line in the error, got %s", er.Error.Error())
+	}
+
+	// Stderr alone is not a failure
+	er = ExecSsh(context.Background(), sshConfig, "10.5.0.11", "echo progress >&2", map[string]string{}, 5)
+	if er.Error != nil || er.ExitStatus != 0 {
+		t.Fatalf("expected stderr with exit code 0 to succeed: %s", er.ToString())
+	}
+}
+
+func TestExecSshTimeout(t *testing.T) {
+	sshConfig := newLocalShellSshConfig(nil)
+
+	startTs := time.Now()
+	er := ExecSsh(context.Background(), sshConfig, "10.5.0.11", "sleep 30", map[string]string{}, 1)
+	if er.Error == nil || !strings.Contains(er.Error.Error(), "timeout after 1s") {
+		t.Fatalf("expected timeout error: %s", er.ToString())
+	}
+	if er.ExitStatus != -1 {
+		t.Fatalf("expected exit status -1 for a command that did not complete, got %d", er.ExitStatus)
+	}
+	if time.Since(startTs) > 10*time.Second {
+		t.Fatalf("timeout took %.3fs", time.Since(startTs).Seconds())
+	}
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	er = ExecSsh(cancelledCtx, sshConfig, "10.5.0.11", "echo should not run", map[string]string{}, 5)
+	if er.Error == nil || !strings.Contains(er.Error.Error(), "cancelled") {
+		t.Fatalf("expected cancellation error: %s", er.ToString())
+	}
+}
+
+func TestExecSshEnvPrefix(t *testing.T) {
+	var ranCmd string
+	sshConfig := newLocalShellSshConfig(func(ipAddress string, cmd string) { ranCmd = cmd })
+
+	envVars := map[string]string{
+		"SIMPLE":          "10.5.0.11",
+		"WITH_SPACES":     "a b  c",
+		"WITH_QUOTES":     `it's "quoted"`,
+		"WITH_NEWLINE":    "line1\nline2",
+		"WITH_EXPANSION":  "$HOME `id` $(id)",
+		"CASSANDRA_HOSTS": `["10.5.0.11","10.5.0.12"]`,
+		"EMPTY":           ""}
+	names := []string{"SIMPLE", "WITH_SPACES", "WITH_QUOTES", "WITH_NEWLINE", "WITH_EXPANSION", "CASSANDRA_HOSTS", "EMPTY"}
+	cmd := `printf '%s|' "$SIMPLE" "$WITH_SPACES" "$WITH_QUOTES" "$WITH_NEWLINE" "$WITH_EXPANSION" "$CASSANDRA_HOSTS" "$EMPTY"`
+
+	er := ExecSsh(context.Background(), sshConfig, "10.5.0.11", cmd, envVars, 5)
+	if er.Error != nil {
+		t.Fatalf("unexpected error: %s", er.ToString())
+	}
+	expected := ""
+	for _, name := range names {
+		expected += envVars[name] + "|"
+	}
+	if er.Stdout != expected {
+		t.Fatalf("env values changed on the way to the script, expected %q, got %q", expected, er.Stdout)
+	}
+
+	// Same env, same command: names are sorted
+	if !strings.HasPrefix(ranCmd, "CASSANDRA_HOSTS=") {
+		t.Fatalf("expected env lines sorted by name, got %q", ranCmd)
+	}
+}
+
+func TestExecEmbeddedScriptsOnInstance(t *testing.T) {
+	ranIps := map[string]int{}
+	sshConfig := newLocalShellSshConfig(func(ipAddress string, cmd string) { ranIps[ipAddress]++ })
+
+	scriptDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(scriptDir, "test"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	scripts := map[string]string{
+		"ok.sh":     `echo "ok $SSH_USER"`,
+		"warn.sh":   "echo warning >&2",
+		"fail.sh":   "echo failed; exit 2",
+		"never.sh":  "echo should not run",
+		"stderr.sh": "echo strict >&2"}
+	for name, body := range scripts {
+		if err := os.WriteFile(filepath.Join(scriptDir, "test", name), []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	envVars := map[string]string{"SSH_USER": "ubuntu"}
+	policy := ScriptExecPolicy{DefaultTimeout: 5, ScriptDirs: []string{scriptDir}, StrictStderr: []string{"scripts/test/stderr.sh"}}
+
+	// Scripts fail by exit code only, stderr is a warning
+	logMsg, err := ExecEmbeddedScriptsOnInstance(context.Background(), sshConfig, "10.5.0.12", []string{"scripts/test/ok.sh", "scripts/test/warn.sh"}, envVars, policy, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s\n%s", err.Error(), logMsg)
+	}
+	if !strings.Contains(string(logMsg), "ok ubuntu") || !strings.Contains(string(logMsg), "WARNING") {
+		t.Fatalf("expected script output and stderr warning in the log:\n%s", logMsg)
+	}
+	if ranIps["10.5.0.12"] != 2 {
+		t.Fatalf("expected 2 scripts to run on 10.5.0.12, got %v", ranIps)
+	}
+
+	// Scripts stop at the first failure
+	_, err = ExecEmbeddedScriptsOnInstance(context.Background(), sshConfig, "10.5.0.13", []string{"scripts/test/fail.sh", "scripts/test/never.sh"}, envVars, policy, false)
+	if err == nil || !strings.Contains(err.Error(), "scripts/test/fail.sh") {
+		t.Fatalf("expected fail.sh error, got %v", err)
+	}
+	if ranIps["10.5.0.13"] != 1 {
+		t.Fatalf("expected never.sh not to run, got %v", ranIps)
+	}
+
+	_, err = ExecEmbeddedScriptsOnInstance(context.Background(), sshConfig, "10.5.0.14", []string{"scripts/test/stderr.sh"}, envVars, policy, false)
+	if err == nil || !strings.Contains(err.Error(), "wrote to stderr") {
+		t.Fatalf("expected strict stderr error, got %v", err)
+	}
+
+	// Rendered bodies are run as is, stderr is a warning unless the script is in StrictStderr
+	renderedPolicy := ScriptExecPolicy{DefaultTimeout: 5, RenderedScripts: map[string]string{"scripts/test/rendered.sh.tmpl": "echo rendered >&2"}}
+	if _, err = ExecEmbeddedScriptsOnInstance(context.Background(), sshConfig, "10.5.0.15", []string{"scripts/test/rendered.sh.tmpl"}, envVars, renderedPolicy, false); err != nil {
+		t.Fatalf("expected stderr with exit code 0 to pass, got %s", err.Error())
+	}
+	renderedPolicy.StrictStderr = []string{"scripts/test/rendered.sh.tmpl"}
+	_, err = ExecEmbeddedScriptsOnInstance(context.Background(), sshConfig, "10.5.0.15", []string{"scripts/test/rendered.sh.tmpl"}, envVars, renderedPolicy, false)
+	if err == nil || !strings.Contains(err.Error(), "wrote to stderr") {
+		t.Fatalf("expected strict stderr error, got %v", err)
+	}
+}